@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// clusterLookup resolves ConfigMaps and Secrets from a cluster through the
+// Kubernetes API.
+type clusterLookup struct {
+	client kubernetes.Interface
+	// namespace is looked in for workloads without one; empty means the
+	// client's default.
+	namespace string
+}
+
+// newClusterLookup connects to the cluster of the kubeconfig context
+// kubeContext, or of the current context when it is empty, with the
+// kubeconfig's credentials. Without a kubeconfig, the in-cluster
+// configuration of a Pod is used. An unknown context is reported up front,
+// with the available ones, instead of as failed lookups.
+func newClusterLookup(kubeContext string) (clusterLookup, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext})
+	if kubeContext != "" {
+		raw, err := config.RawConfig()
+		if err != nil {
+			return clusterLookup{}, fmt.Errorf("failed to load kubeconfig: %w", err)
+		}
+		if _, ok := raw.Contexts[kubeContext]; !ok {
+			contexts := make([]string, 0, len(raw.Contexts))
+			for name := range raw.Contexts {
+				contexts = append(contexts, name)
+			}
+			sort.Strings(contexts)
+			return clusterLookup{}, fmt.Errorf("kubeconfig context %q not found (available: %s)", kubeContext, strings.Join(contexts, ", "))
+		}
+	}
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return clusterLookup{}, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	namespace, _, err := config.Namespace()
+	if err != nil {
+		return clusterLookup{}, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return clusterLookup{}, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	return clusterLookup{client: client, namespace: namespace}, nil
+}
+
+func (l clusterLookup) ConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespaceOr(namespace)).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, lookupError(ctx, "ConfigMap", name, err)
+	}
+	return cm, nil
+}
+
+func (l clusterLookup) Secret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	s, err := l.client.CoreV1().Secrets(l.namespaceOr(namespace)).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, lookupError(ctx, "Secret", name, err)
+	}
+	return s, nil
+}
+
+// namespaceOr returns namespace, or the lookup's default when it is empty.
+func (l clusterLookup) namespaceOr(namespace string) string {
+	if namespace == "" {
+		return l.namespace
+	}
+	return namespace
+}
+
+// lookupError turns the error of getting one object into what the
+// injector.SourceLookup contract expects: nil when the object does not
+// exist, and the context's error when ctx expired, so timeouts are reported
+// as such.
+func lookupError(ctx context.Context, kind, name string, err error) error {
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	default:
+		return fmt.Errorf("failed to get %s %s: %w", kind, name, err)
+	}
+}
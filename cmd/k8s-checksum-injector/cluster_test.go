@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestClusterLookup(t *testing.T) {
+	client := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "prod"},
+		Data:       map[string]string{"LOG_LEVEL": "info"},
+	})
+	l := clusterLookup{client: client, namespace: "dev"}
+
+	cm, err := l.ConfigMap(context.Background(), "prod", "app-config")
+	if err != nil {
+		t.Fatalf("ConfigMap: %v", err)
+	}
+	if cm == nil || cm.Namespace != "prod" || cm.Data["LOG_LEVEL"] != "info" {
+		t.Fatalf("unexpected ConfigMap %+v", cm)
+	}
+
+	// Workloads without a namespace look in the context's namespace.
+	if cm, err := l.ConfigMap(context.Background(), "", "app-config"); err != nil || cm != nil {
+		t.Fatalf("expected no app-config in dev, got %+v, %v", cm, err)
+	}
+
+	s, err := l.Secret(context.Background(), "prod", "absent")
+	if err != nil || s != nil {
+		t.Fatalf("expected a missing Secret to return nil, nil; got %+v, %v", s, err)
+	}
+}
+
+func TestClusterLookupTimeout(t *testing.T) {
+	client := fake.NewClientset()
+	client.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(200 * time.Millisecond)
+		return true, nil, errors.New("connection reset")
+	})
+	l := clusterLookup{client: client}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.ConfigMap(ctx, "", "app-config"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestNewClusterLookupContext(t *testing.T) {
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+  - name: dev
+    cluster:
+      server: https://dev.example.com
+  - name: prod
+    cluster:
+      server: https://prod.example.com
+users:
+  - name: ci
+    user:
+      token: abc
+contexts:
+  - name: dev
+    context:
+      cluster: dev
+      user: ci
+  - name: prod
+    context:
+      cluster: prod
+      user: ci
+      namespace: payments
+`
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(kubeconfig), 0o600); err != nil {
+		t.Fatalf("failed to write kubeconfig: %v", err)
+	}
+	t.Setenv("KUBECONFIG", path)
+
+	l, err := newClusterLookup("prod")
+	if err != nil {
+		t.Fatalf("newClusterLookup: %v", err)
+	}
+	if l.namespace != "payments" {
+		t.Fatalf("expected the namespace of the prod context, got %q", l.namespace)
+	}
+	if l, err := newClusterLookup(""); err != nil || l.namespace != "default" {
+		t.Fatalf("expected the current context's default namespace, got %q, %v", l.namespace, err)
+	}
+
+	_, err = newClusterLookup("staging")
+	if err == nil || !strings.Contains(err.Error(), `kubeconfig context "staging" not found (available: dev, prod)`) {
+		t.Fatalf("expected an unknown context to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/komailo/k8s-checksum-injector/pkg/injector"
+)
+
+// manifestExtensions are the file extensions read from directories given to
+// -f. Files named explicitly are read whatever their extension.
+var manifestExtensions = map[string]bool{
+	".yaml": true,
+	".yml":  true,
+	".json": true,
+}
+
+// errTooManyFiles stops a directory walk that exceeds maxFiles.
+var errTooManyFiles = errors.New("too many manifest files")
+
+// manifestReader reads manifests from files and directories.
+type manifestReader struct {
+	// maxFiles bounds how many files a single directory walk may collect.
+	// Zero means no limit.
+	maxFiles int
+	// followSymlinks descends into symlinked directories and reads
+	// symlinked files. Directories already visited are skipped, so symlink
+	// loops terminate.
+	followSymlinks bool
+	log            *slog.Logger
+}
+
+// read returns the manifests at paths, in order, as one multi-document
+// stream. A directory is walked recursively in lexical order.
+func (r manifestReader) read(paths ...string) ([]byte, error) {
+	files, err := r.allFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	return concatFiles(files)
+}
+
+// readSince is read split by modification time: changed holds the files
+// modified at or after since, unchanged the others. An unchanged file with a
+// workload referencing a ConfigMap or Secret defined in a changed file counts
+// as changed, so the workload is updated. Files that do not parse are left
+// where their modification time puts them.
+func (r manifestReader) readSince(since time.Time, paths ...string) (changed, unchanged []byte, err error) {
+	files, err := r.allFiles(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	var recent, old []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read manifests: %w", err)
+		}
+		if info.ModTime().Before(since) {
+			old = append(old, file)
+		} else {
+			recent = append(recent, file)
+		}
+	}
+
+	var sources []injector.Reference
+	for _, file := range recent {
+		data, err := concatFiles([]string{file})
+		if err != nil {
+			return nil, nil, err
+		}
+		defined, _ := injector.DefinedSources(string(data))
+		sources = append(sources, defined...)
+	}
+	isOld := map[string]bool{}
+	for _, file := range old {
+		data, err := concatFiles([]string{file})
+		if err != nil {
+			return nil, nil, err
+		}
+		if affected, _ := injector.WorkloadsReferencing(string(data), sources); len(affected) > 0 {
+			r.log.Info("processing unchanged file that references a changed source", "path", file, "workload", affected[0].String())
+			continue
+		}
+		isOld[file] = true
+	}
+	// Files keep their input order either way.
+	recent, old = nil, nil
+	for _, file := range files {
+		if isOld[file] {
+			old = append(old, file)
+		} else {
+			recent = append(recent, file)
+		}
+	}
+
+	r.log.Info("reading manifests modified since", "since", since.Format(time.RFC3339), "changed", len(recent), "unchanged", len(old))
+	if changed, err = concatFiles(recent); err != nil {
+		return nil, nil, err
+	}
+	if unchanged, err = concatFiles(old); err != nil {
+		return nil, nil, err
+	}
+	return changed, unchanged, nil
+}
+
+// allFiles returns the manifest files at each of paths, in order.
+func (r manifestReader) allFiles(paths []string) ([]string, error) {
+	var all []string
+	for _, path := range paths {
+		files, err := r.files(path)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, files...)
+	}
+	return all, nil
+}
+
+// files returns the manifest files at path: path itself, or the files found
+// by walking it if it is a directory.
+func (r manifestReader) files(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifests: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = r.walk(path, map[string]bool{}, &files)
+	if errors.Is(err, errTooManyFiles) {
+		return nil, fmt.Errorf("%s contains more than %d manifest files; narrow the path or raise -max-files", path, r.maxFiles)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// concatFiles joins files into one multi-document stream.
+func concatFiles(files []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifests: %w", err)
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (r manifestReader) walk(dir string, visited map[string]bool, files *[]string) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read manifests: %w", err)
+	}
+	if visited[real] {
+		r.log.Info("skipping directory that was already read", "path", dir)
+		return nil
+	}
+	visited[real] = true
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read manifests: %w", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 {
+			if !r.followSymlinks {
+				r.log.Info("skipping symlink", "path", path)
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("failed to read manifests: %w", err)
+			}
+			isDir = info.IsDir()
+		}
+		if isDir {
+			if err := r.walk(path, visited, files); err != nil {
+				return err
+			}
+			continue
+		}
+		if !manifestExtensions[strings.ToLower(filepath.Ext(path))] {
+			continue
+		}
+		*files = append(*files, path)
+		if r.maxFiles > 0 && len(*files) > r.maxFiles {
+			return errTooManyFiles
+		}
+	}
+	return nil
+}
+
+// parseSince parses the -since value: a duration counted back from now, such
+// as "2h", or an RFC 3339 timestamp.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -since %q: must be a duration such as 2h or an RFC 3339 timestamp", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestManifestReaderDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"b/deployment.yaml": "kind: Deployment",
+		"a.yml":             "kind: ConfigMap\n",
+		"README.md":         "not a manifest",
+	})
+
+	r := manifestReader{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	data, err := r.read(dir)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if want := "kind: ConfigMap\n---\nkind: Deployment\n"; string(data) != want {
+		t.Fatalf("expected %q, got %q", want, data)
+	}
+}
+
+func TestManifestReaderMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yaml":     "kind: ConfigMap\n",
+		"b.yaml":     "kind: ConfigMap\n",
+		"sub/c.yaml": "kind: ConfigMap\n",
+	})
+
+	r := manifestReader{maxFiles: 2, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	_, err := r.read(dir)
+	if err == nil || !strings.Contains(err.Error(), "contains more than 2 manifest files") || !strings.Contains(err.Error(), dir) {
+		t.Fatalf("expected a file limit error naming %s, got %v", dir, err)
+	}
+
+	r.maxFiles = 3
+	if _, err := r.read(dir); err != nil {
+		t.Fatalf("expected three files to be within the limit, got %v", err)
+	}
+}
+
+func TestManifestReaderSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"sub/app.yaml": "kind: Deployment\n"})
+	if err := os.Symlink(dir, filepath.Join(dir, "sub", "loop")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "sub", "app.yaml"), filepath.Join(dir, "linked.yaml")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	tests := []struct {
+		follow bool
+		want   string
+	}{
+		{follow: false, want: "kind: Deployment\n"},
+		{follow: true, want: "kind: Deployment\n---\nkind: Deployment\n"},
+	}
+	for _, tt := range tests {
+		r := manifestReader{followSymlinks: tt.follow, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+		data, err := r.read(dir)
+		if err != nil {
+			t.Fatalf("follow=%v: read: %v", tt.follow, err)
+		}
+		if string(data) != tt.want {
+			t.Fatalf("follow=%v: expected %q, got %q", tt.follow, tt.want, data)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{value: "90m", want: now.Add(-90 * time.Minute)},
+		{value: "2024-04-30T08:00:00Z", want: time.Date(2024, 4, 30, 8, 0, 0, 0, time.UTC)},
+		{value: "2024-04-30", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.value, now)
+		if (err != nil) != tt.err {
+			t.Fatalf("%s: unexpected error %v", tt.value, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Fatalf("%s: expected %s, got %s", tt.value, tt.want, got)
+		}
+	}
+}
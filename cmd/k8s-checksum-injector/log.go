@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// newLogger returns a logger writing to w in the given format ("text" or
+// "json"). Warnings and errors are always emitted; info messages only when
+// verbose is set.
+func newLogger(w io.Writer, format string, verbose bool) (*slog.Logger, error) {
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelInfo
+	}
+	switch format {
+	case "text":
+		return slog.New(&plainHandler{w: w, level: level, mu: &sync.Mutex{}}), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s (must be 'text' or 'json')", format)
+	}
+}
+
+// plainHandler renders records as human-readable lines such as
+// "warning: skipping document kind=Secret: <error>".
+type plainHandler struct {
+	w      io.Writer
+	level  slog.Level
+	attrs  []slog.Attr
+	prefix string
+	mu     *sync.Mutex
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if r.Level >= slog.LevelWarn && r.Level < slog.LevelError {
+		b.WriteString("warning: ")
+	}
+	b.WriteString(r.Message)
+
+	var errText string
+	write := func(a slog.Attr) bool {
+		if a.Key == "error" {
+			errText = a.Value.String()
+			return true
+		}
+		fmt.Fprintf(&b, " %s=%s", h.prefix+a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	if errText != "" {
+		b.WriteString(": ")
+		b.WriteString(errText)
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+func (h *plainHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
@@ -1,33 +1,608 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/komailo/k8s-checksum-injector/pkg/injector"
+	"sigs.k8s.io/yaml"
 )
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the CLI with the given arguments and streams and returns the
+// process exit code.
+//
+// The optional "stabilize" subcommand strips every existing checksum key
+// before re-injecting, normalizing manifests after hand edits.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	name := "k8s-checksum-injector"
+	stabilize := len(args) > 0 && args[0] == "stabilize"
+	if stabilize {
+		name += " stabilize"
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
 	var modeStr string
-	flag.StringVar(&modeStr, "mode", string(injector.ModeLabel), "inject checksums as 'label' or 'annotation'")
-	flag.Parse()
+	var strictDecode bool
+	var skipBadDocs bool
+	var strict bool
+	var requireAll bool
+	var failFast bool
+	var warnIdentical bool
+	var ignoreSources string
+	var skipImmutable bool
+	var emptyAsAbsent bool
+	var credentialSecrets bool
+	var skipZeroReplicas bool
+	var selector string
+	var podTemplatePath string
+	var selfCheck bool
+	var trimValues bool
+	var orderSensitive bool
+	var onlyIfReferenced bool
+	var preciseKeys bool
+	var includeMetadata bool
+	var stripNameSuffix bool
+	var configMapInfix string
+	var keyTemplate string
+	var existingKeyFormat string
+	var onlyMissing bool
+	var secretInfix string
+	var dryRun bool
+	var globalDigest bool
+	var dumpRefs bool
+	var printHashInputs bool
+	var dumpHashes bool
+	var checkKeys bool
+	var canonicalize bool
+	var compact bool
+	var annotateSource bool
+	var annotateSources bool
+	var generationCounter bool
+	var docStart bool
+	var metricsAddr string
+	var eventsFile string
+	var postExecCommand string
+	var cacheDir string
+	var outputOrder string
+	var preserveEmpty bool
+	var fromCluster bool
+	var kubeContext string
+	var defaultNamespace string
+	var inputPaths pathsFlag
+	var baseDir string
+	var since string
+	var maxFiles int
+	var followSymlinks bool
+	var timeout time.Duration
+	var offline bool
+	var useResourceVersion bool
+	var changedExitCode int
+	var salt string
+	var hashLength int
+	var logFormat string
+	var format string
+	var fieldManager string
+	var verbose bool
+	var quiet bool
+	var listKinds bool
+	var workers int
+	fileRefs := keyValueFlag{}
+	extraAnnotations := keyValueFlag{}
+	var annotationsFile string
+	var targets targetsFlag
+	fs.StringVar(&modeStr, "mode", string(injector.ModeLabel), "inject checksums as 'label' or 'annotation'")
+	fs.Var(&targets, "inject", "write checksums to `target=label|annotation[,prefix=p/]` (repeatable, overrides -mode)")
+	fs.StringVar(&existingKeyFormat, "existing-key-format", "", "key `prefix` or template earlier runs wrote checksums under; changes are then only reported when those checksums differ")
+	fs.BoolVar(&onlyMissing, "only-missing", false, "only add checksum keys a Pod template does not have yet, leaving existing ones untouched")
+	fs.StringVar(&keyTemplate, "key-template", "", "Go `template` rendering each complete key from .Kind, .Name, .SanitizedName and .Namespace; overrides prefixes and infixes")
+	fs.StringVar(&configMapInfix, "configmap-infix", "configmap-", "put `infix` between the key prefix and a ConfigMap's name")
+	fs.StringVar(&secretInfix, "secret-infix", "secret-", "put `infix` between the key prefix and a Secret's name")
+	fs.BoolVar(&strictDecode, "strict-decode", false, "fail on unknown fields in ConfigMaps and Secrets")
+	fs.BoolVar(&skipBadDocs, "skip-bad-docs", false, "log and pass through documents that are not valid YAML instead of failing")
+	fs.BoolVar(&strict, "strict", false, "fail when a required ConfigMap or Secret reference cannot be resolved")
+	fs.BoolVar(&requireAll, "require-all-referenced", false, "fail when a workload is left without a checksum for any required reference")
+	fs.BoolVar(&failFast, "fail-fast", false, "stop at the first decode or reference problem instead of reporting all of them")
+	fs.BoolVar(&warnIdentical, "warn-identical-sources", false, "warn about differently named ConfigMaps or Secrets with identical data")
+	fs.StringVar(&ignoreSources, "ignore-sources", strings.Join(injector.DefaultIgnoredSources, ","), "comma-separated `names` of ConfigMaps and Secrets never reported as missing; empty to ignore none")
+	fs.BoolVar(&skipImmutable, "skip-immutable", false, "do not inject checksums for immutable ConfigMaps and Secrets")
+	fs.BoolVar(&credentialSecrets, "credential-secrets", false, "also inject checksums for imagePullSecrets and CSI nodePublishSecretRef Secrets")
+	fs.BoolVar(&emptyAsAbsent, "hash-empty-as-absent", false, "treat ConfigMaps and Secrets without data as absent: inject nothing for them and report them under -strict")
+	fs.StringVar(&podTemplatePath, "pod-template-path", "", "treat every object of an unsupported kind with a Pod template at the dotted `path`, e.g. spec.template, as a workload")
+	fs.BoolVar(&selfCheck, "self-check", false, "re-decode the output and verify every injected checksum before writing it")
+	fs.StringVar(&selector, "selector", "", "only inject into workloads whose labels match the label `selector`, e.g. tier=backend")
+	fs.BoolVar(&skipZeroReplicas, "skip-zero-replicas", false, "do not inject into workloads with spec.replicas set to 0")
+	fs.BoolVar(&includeMetadata, "include-metadata", false, "also hash the labels and annotations of ConfigMaps and Secrets")
+	fs.BoolVar(&trimValues, "trim-values", false, "ignore trailing whitespace in ConfigMap and Secret values when hashing")
+	fs.BoolVar(&onlyIfReferenced, "only-if-referenced", false, "only hash ConfigMaps and Secrets that some workload references")
+	fs.BoolVar(&preciseKeys, "precise-keys", false, "hash only the keys a workload references when it names keys of an object")
+	fs.BoolVar(&orderSensitive, "order-sensitive", false, "hash ConfigMap data in document key order instead of sorted")
+	fs.BoolVar(&stripNameSuffix, "strip-name-suffix", false, "match references and sources whose names differ only by a kustomize hash suffix")
+	fs.Var(fileRefs, "file-ref", "hash a file on disk as a ConfigMap, given as `name=path` (repeatable)")
+	fs.Var(extraAnnotations, "extra-annotations", "also write the annotation `key=value` to every workload's Pod template (repeatable)")
+	fs.StringVar(&annotationsFile, "annotations-from-file", "", "also write the annotations in the YAML map at `path` to every workload's Pod template")
+	fs.BoolVar(&fromCluster, "from-cluster", false, "resolve references missing from the input through the Kubernetes API of the current cluster")
+	fs.StringVar(&kubeContext, "context", "", "with -from-cluster, use the kubeconfig context `name` instead of the current one")
+	fs.StringVar(&defaultNamespace, "default-namespace", "", "assume namespace `name` for ConfigMaps, Secrets and workloads without one, e.g. default")
+	fs.DurationVar(&timeout, "timeout", 10*time.Second, "bound each -from-cluster lookup to `duration`")
+	fs.BoolVar(&useResourceVersion, "use-resource-version", false, "with -from-cluster, use each fetched object's resourceVersion as its checksum")
+	fs.BoolVar(&offline, "offline", false, "only resolve references from the input; never contact a cluster")
+	fs.Var(&inputPaths, "f", "read manifests from `path`, a file or a directory walked recursively for .yaml, .yml and .json files, instead of stdin (repeatable); the path - reads stdin, and the others then only resolve references")
+	fs.StringVar(&since, "since", "", "with -f, only process files modified since `time`, a duration such as 2h or an RFC 3339 timestamp, and older files with workloads using their sources; other files only resolve references")
+	fs.StringVar(&baseDir, "base-dir", "", "resolve references against the ConfigMaps and Secrets in the manifests under `path` without writing them")
+	fs.IntVar(&maxFiles, "max-files", 1000, "fail when a directory given to -f contains more than `n` manifest files; 0 means no limit")
+	fs.BoolVar(&followSymlinks, "follow-symlinks", false, "follow symlinks while walking a directory given to -f")
+	fs.BoolVar(&dryRun, "dry-run", false, "report workloads that would change instead of writing manifests")
+	fs.BoolVar(&canonicalize, "canonicalize", false, "re-render every document with sorted keys and uniform style")
+	fs.BoolVar(&compact, "compact", false, "render collections below each document's top-level keys in flow style to save lines")
+	fs.BoolVar(&preserveEmpty, "preserve-empty-docs", false, "keep empty documents in the output instead of dropping them")
+	fs.StringVar(&outputOrder, "output-order", string(injector.OrderPreserve), "document `order` of the output: 'preserve' for the input order or 'kind' for apply order, sources before workloads")
+	fs.BoolVar(&docStart, "doc-start", false, "start the output with a '---' document marker")
+	fs.BoolVar(&annotateSources, "annotate-sources", false, "write each ConfigMap and Secret's own checksum to its checksum-injector.komailo.io/self annotation")
+	fs.BoolVar(&generationCounter, "generation-counter", false, "count checksum changes in the checksum-injector.komailo.io/generation Pod template annotation")
+	fs.BoolVar(&annotateSource, "annotate-source", false, "comment every injected key with the ConfigMap or Secret it belongs to")
+	fs.BoolVar(&globalDigest, "global-digest", false, "print one checksum over every ConfigMap and Secret instead of writing manifests")
+	fs.BoolVar(&dumpRefs, "dump-refs", false, "print every workload's references and their checksums instead of writing manifests")
+	fs.BoolVar(&printHashInputs, "print-hash-inputs", false, "print the keys and values each ConfigMap and Secret is hashed from, with Secret values redacted, instead of writing manifests")
+	fs.BoolVar(&dumpHashes, "dump-hashes", false, "print a JSON object mapping <kind>/<namespace>/<name> to the checksum of every ConfigMap and Secret instead of writing manifests")
+	fs.BoolVar(&checkKeys, "check-keys", false, "validate every key that would be injected and report invalid ones instead of writing manifests")
+	fs.IntVar(&changedExitCode, "changed-exit-code", 1, "exit code used by -dry-run when any workload would change, e.g. 3; errors exit 1 and usage errors 2")
+	fs.IntVar(&hashLength, "hash-length", 12, "keep `n` hex characters of each SHA-256 checksum, up to 64; label targets allow at most 63")
+	fs.StringVar(&salt, "salt", "", "mix `value` into every checksum; changing it rolls every workload")
+	fs.StringVar(&format, "format", "yaml", "output `format`: 'yaml' for the injected manifests or 'patch' for a JSON Patch per changed workload")
+	fs.IntVar(&workers, "workers", runtime.GOMAXPROCS(0), "number of ConfigMaps and Secrets hashed in parallel; 1 hashes sequentially")
+	fs.StringVar(&fieldManager, "ssa-managed-fields", "", "with -format=patch, add a server-side apply configuration owned by field manager `name`")
+	fs.StringVar(&cacheDir, "cache-dir", "", "remember the digests of ConfigMaps and Secrets with a uid and resourceVersion in `dir` across runs")
+	fs.StringVar(&metricsAddr, "metrics", "", "serve run counters in Prometheus text format at /metrics on `addr`, e.g. :9090, while the run is in progress")
+	fs.StringVar(&eventsFile, "events-file", "", "append one JSON line per added, updated or removed checksum key to `path`, e.g. /dev/fd/3")
+	fs.StringVar(&postExecCommand, "post-exec", "", "pipe the manifests or patches through `command`, run by sh, and write what it prints instead")
+	fs.StringVar(&logFormat, "log-format", "text", "log format for stderr: 'text' or 'json'")
+	fs.BoolVar(&listKinds, "list-kinds", false, "print the supported workload kinds and their Pod spec paths, then exit")
+	fs.BoolVar(&verbose, "v", false, "log verbose progress information")
+	fs.BoolVar(&quiet, "quiet", false, "do not print the run summary to stderr")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	if listKinds {
+		if err := writeKinds(stdout, injector.SupportedKinds()); err != nil {
+			fmt.Fprintf(stderr, "failed to write output: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	logger, err := newLogger(stderr, logFormat, verbose)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	if format != "yaml" && format != "patch" {
+		fmt.Fprintf(stderr, "invalid format: %s (must be 'yaml' or 'patch')\n", format)
+		return 2
+	}
+	if fieldManager != "" && format != "patch" {
+		fmt.Fprintln(stderr, "-ssa-managed-fields requires -format=patch")
+		return 2
+	}
+	if kubeContext != "" && !fromCluster {
+		fmt.Fprintln(stderr, "-context requires -from-cluster")
+		return 2
+	}
+	if useResourceVersion && !fromCluster {
+		fmt.Fprintln(stderr, "-use-resource-version requires -from-cluster")
+		return 2
+	}
+	if onlyIfReferenced && globalDigest {
+		fmt.Fprintln(stderr, "-only-if-referenced and -global-digest are mutually exclusive")
+		return 2
+	}
+	filePaths, readStdin := inputPaths.splitStdin()
+	var sinceTime time.Time
+	if since != "" {
+		if len(filePaths) == 0 {
+			fmt.Fprintln(stderr, "-since requires -f")
+			return 2
+		}
+		if readStdin {
+			fmt.Fprintln(stderr, "-since cannot be combined with -f -")
+			return 2
+		}
+		if sinceTime, err = parseSince(since, time.Now()); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+	for name, path := range fileRefs {
+		if path == "" {
+			fmt.Fprintf(stderr, "-file-ref %s: missing path\n", name)
+			return 2
+		}
+	}
+	if offline && fromCluster {
+		fmt.Fprintln(stderr, "-offline and -from-cluster are mutually exclusive")
+		return 2
+	}
+
+	annotations, err := loadAnnotations(annotationsFile, extraAnnotations)
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+
+	reader := manifestReader{maxFiles: maxFiles, followSymlinks: followSymlinks, log: logger}
+	var base []byte
+	if baseDir != "" {
+		base, err = reader.read(baseDir)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+	}
+
+	var input []byte
+	if since != "" {
+		var unchanged []byte
+		input, unchanged, err = reader.readSince(sinceTime, inputPaths...)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		// Unchanged files only serve as context, like -base-dir.
+		base = appendStream(base, unchanged)
+	} else if len(filePaths) > 0 && !readStdin {
+		input, err = reader.read(filePaths...)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+	} else {
+		input, err = io.ReadAll(stdin)
+		if err != nil {
+			logger.Error("failed to read stdin", "error", err)
+			return 1
+		}
+		if len(filePaths) > 0 {
+			// Next to stdin, files only serve as context, like -base-dir.
+			baseDocs, err := reader.read(filePaths...)
+			if err != nil {
+				logger.Error(err.Error())
+				return 1
+			}
+			base = appendStream(base, baseDocs)
+		}
+	}
+
+	opts := injector.Options{
+		Mode:                 injector.Mode(modeStr),
+		Targets:              targets,
+		StrictDecode:         strictDecode,
+		SkipBadDocs:          skipBadDocs,
+		FileRefs:             fileRefs,
+		BaseManifests:        string(base),
+		Prune:                stabilize,
+		Salt:                 salt,
+		HashLength:           hashLength,
+		Strict:               strict,
+		RequireAllReferenced: requireAll,
+		FailFast:             failFast,
+		IgnoredSources:       splitList(ignoreSources),
+		WarnIdenticalSources: warnIdentical,
+		SkipImmutable:        skipImmutable,
+		EmptyAsAbsent:        emptyAsAbsent,
+		CredentialSecrets:    credentialSecrets,
+		SkipZeroReplicas:     skipZeroReplicas,
+		Selector:             selector,
+		PodTemplatePath:      podTemplatePath,
+		SelfCheck:            selfCheck,
+		DefaultNamespace:     defaultNamespace,
+		TrimValues:           trimValues,
+		OrderSensitive:       orderSensitive,
+		OnlyIfReferenced:     onlyIfReferenced,
+		PreciseKeys:          preciseKeys,
+		IncludeMetadata:      includeMetadata,
+		ExtraAnnotations:     annotations,
+		StripNameSuffix:      stripNameSuffix,
+		ConfigMapInfix:       configMapInfix,
+		KeyTemplate:          keyTemplate,
+		ExistingKeyFormat:    existingKeyFormat,
+		OnlyMissing:          onlyMissing,
+		SecretInfix:          secretInfix,
+		Canonicalize:         canonicalize,
+		Compact:              compact,
+		AnnotateSource:       annotateSource,
+		AnnotateSources:      annotateSources,
+		GenerationCounter:    generationCounter,
+		DocStart:             docStart,
+		OutputOrder:          injector.OutputOrder(outputOrder),
+		PreserveEmptyDocs:    preserveEmpty,
+		Timeout:              timeout,
+		Offline:              offline,
+		UseResourceVersion:   useResourceVersion,
+		Workers:              workers,
+		Logger:               logger,
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if fromCluster {
+		lookup, err := newClusterLookup(kubeContext)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		opts.Lookup = lookup
+	}
+	if cacheDir != "" {
+		opts.Cache = injector.DirCache{Dir: cacheDir}
+	}
+	// The counters feed the listener and the summary; without either,
+	// nothing is counted.
+	if metricsAddr != "" || !quiet {
+		opts.Metrics = &injector.Metrics{}
+	}
+	if metricsAddr != "" {
+		addr, stop, err := serveMetrics(metricsAddr, opts.Metrics, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		logger.Info("serving metrics", "address", addr)
+		defer func() {
+			metricsServed(addr)
+			stop()
+		}()
+	}
+
+	if printHashInputs {
+		inputs, err := injector.HashInputs(string(input), opts)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		if err := writeHashInputs(stdout, inputs); err != nil {
+			logger.Error("failed to write output", "error", err)
+			return 1
+		}
+		return 0
+	}
+
+	if dumpHashes {
+		inputs, err := injector.HashInputs(string(input), opts)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		if err := writeHashes(stdout, inputs); err != nil {
+			logger.Error("failed to write output", "error", err)
+			return 1
+		}
+		return 0
+	}
+
+	res, err := injector.Inject(string(input), opts)
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+	if cacheDir != "" {
+		// A cache that cannot be trimmed still works; it only grows.
+		if err := (injector.DirCache{Dir: cacheDir}).Evict(); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
+	if globalDigest {
+		if _, err := fmt.Fprintln(stdout, res.GlobalDigest); err != nil {
+			logger.Error("failed to write output", "error", err)
+			return 1
+		}
+		return 0
+	}
+
+	if dumpRefs {
+		if err := writeReferenceGraph(stdout, res.References); err != nil {
+			logger.Error("failed to write output", "error", err)
+			return 1
+		}
+		return 0
+	}
 
-	input, err := io.ReadAll(os.Stdin)
+	if checkKeys {
+		invalid := 0
+		for _, k := range res.Keys {
+			if err := k.Validate(); err != nil {
+				logger.Error(err.Error())
+				invalid++
+			}
+		}
+		if invalid > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	// The summary goes to stderr after the output, so it never mixes with
+	// manifests or patches.
+	summarize := func() {
+		if !quiet {
+			_ = writeSummary(stderr, logFormat, opts.Metrics.Counts())
+		}
+	}
+
+	if dryRun {
+		// The text report keeps its plain "would update" lines, which
+		// scripts grep for; JSON logs carry the workload as a field.
+		for _, w := range res.Changed {
+			if logFormat == "json" {
+				logger.Warn("would update", "workload", w.String())
+			} else {
+				fmt.Fprintf(stderr, "would update %s\n", w)
+			}
+		}
+		summarize()
+		if len(res.Changed) > 0 {
+			return changedExitCode
+		}
+		return 0
+	}
+
+	// With -post-exec the output is buffered for the command and only its
+	// result reaches stdout.
+	out := stdout
+	var buf bytes.Buffer
+	if postExecCommand != "" {
+		out = &buf
+	}
+	if format == "patch" {
+		err = writePatches(out, res.Patches, fieldManager)
+	} else {
+		_, err = io.WriteString(out, res.Output)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to read stdin: %v\n", err)
-		os.Exit(1)
+		logger.Error("failed to write output", "error", err)
+		return 1
 	}
+	if postExecCommand != "" {
+		transformed, err := postExec(context.Background(), postExecCommand, buf.Bytes(), stderr)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		if _, err := stdout.Write(transformed); err != nil {
+			logger.Error("failed to write output", "error", err)
+			return 1
+		}
+	}
+	// Events record changes that were written out, so the report-only
+	// modes above never log any.
+	if eventsFile != "" {
+		if err := writeEvents(eventsFile, time.Now(), res.KeyChanges); err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+	}
+	summarize()
+	return 0
+}
+
+// appendStream appends the manifests in b to the multi-document stream a.
+func appendStream(a, b []byte) []byte {
+	if len(a) > 0 && len(b) > 0 {
+		a = append(a, "---\n"...)
+	}
+	return append(a, b...)
+}
+
+// loadAnnotations merges the annotations from the YAML map in path, if any,
+// with those given on the command line, which take precedence.
+func loadAnnotations(path string, flags keyValueFlag) (map[string]string, error) {
+	annotations := map[string]string{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read annotations: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &annotations); err != nil {
+			return nil, fmt.Errorf("failed to parse annotations from %s: %w", path, err)
+		}
+	}
+	for k, v := range flags {
+		annotations[k] = v
+	}
+	return annotations, nil
+}
 
-	output, err := injector.InjectChecksums(string(input), injector.Mode(modeStr))
+// splitList splits a comma-separated flag value, returning an empty, non-nil
+// slice for an empty value.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// keyValueFlag collects repeated name=value flag arguments. The value may be
+// empty, as label and annotation values may.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	f[k] = v
+	return nil
+}
+
+// targetsFlag collects repeated -inject target specifications.
+type targetsFlag []injector.Target
+
+func (f *targetsFlag) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, t := range *f {
+		specs = append(specs, fmt.Sprintf("target=%s,prefix=%s", t.Mode, t.Prefix))
+	}
+	return strings.Join(specs, " ")
+}
+
+func (f *targetsFlag) Set(value string) error {
+	t, err := injector.ParseTarget(value)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		return err
 	}
+	*f = append(*f, t)
+	return nil
+}
+
+// pathsFlag collects repeated path arguments in order.
+type pathsFlag []string
+
+func (f *pathsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *pathsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
-	if _, err := os.Stdout.Write([]byte(output)); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to write output: %v\n", err)
-		os.Exit(1)
+// splitStdin separates "-", which stands for stdin, from the file paths.
+func (f pathsFlag) splitStdin() (files []string, stdin bool) {
+	for _, path := range f {
+		if path == "-" {
+			stdin = true
+			continue
+		}
+		files = append(files, path)
 	}
+	return files, stdin
 }
@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: app:latest
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+func runCLI(t *testing.T, input string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(input), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunDefaultsToPodTemplateLabels(t *testing.T) {
+	input := strings.Replace(sampleManifest, "  name: app\n", "  name: app\n  labels:\n    team: payments\n", 1)
+	code, stdout, stderr := runCLI(t, input)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+
+	for _, want := range []string{
+		"  labels:\n    team: payments\nspec:\n",
+		"  template:\n    spec:\n",
+		"    metadata:\n      labels:\n        checksum/configmap-app-config: c2cb39c0e655\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Fatalf("expected the checksum as a Pod template label only, missing %q in:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "annotations:") {
+		t.Fatalf("expected no annotations in label mode, got:\n%s", stdout)
+	}
+}
+
+func TestRunDryRunChangedExitCode(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-dry-run", "-changed-exit-code", "3")
+	if code != 3 {
+		t.Fatalf("expected exit code 3 for drift, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "" {
+		t.Fatalf("expected no manifests on stdout in dry-run, got:\n%s", stdout)
+	}
+	if !strings.Contains(stderr, "would update Deployment/app") {
+		t.Fatalf("expected drifted workload to be reported, got: %s", stderr)
+	}
+
+	if code, _, _ := runCLI(t, sampleManifest, "-dry-run"); code != 1 {
+		t.Fatalf("expected default changed exit code 1, got %d", code)
+	}
+}
+
+func TestRunDryRunWithoutDrift(t *testing.T) {
+	code, injected, stderr := runCLI(t, sampleManifest)
+	if code != 0 {
+		t.Fatalf("expected inject to exit 0, got %d (stderr: %s)", code, stderr)
+	}
+
+	if code, _, stderr := runCLI(t, injected, "-dry-run", "-changed-exit-code", "3"); code != 0 {
+		t.Fatalf("expected exit code 0 without drift, got %d (stderr: %s)", code, stderr)
+	}
+}
+
+func TestRunStabilize(t *testing.T) {
+	_, injected, _ := runCLI(t, sampleManifest)
+	edited := strings.Replace(injected, "    metadata:\n      labels:\n", "    metadata:\n      labels:\n        checksum/configmap-gone: 000000000000\n", 1)
+	if edited == injected {
+		t.Fatalf("failed to hand-edit fixture:\n%s", injected)
+	}
+
+	code, stdout, stderr := runCLI(t, edited, "stabilize")
+	if code != 0 {
+		t.Fatalf("expected stabilize to exit 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != injected {
+		t.Fatalf("expected stabilize to restore canonical output\nwant:\n%s\ngot:\n%s", injected, stdout)
+	}
+
+	if code, _, _ := runCLI(t, edited, "stabilize", "-dry-run"); code != 1 {
+		t.Fatalf("expected stabilize -dry-run to report drift, got %d", code)
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	input := sampleManifest + `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+spec:
+  template:
+    metadata:
+      labels:
+        checksum/configmap-app-config: c2cb39c0e655
+    spec:
+      containers:
+        - name: worker
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: absent-secret
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: static
+spec:
+  template:
+    spec:
+      containers:
+        - name: static
+`
+	code, stdout, stderr := runCLI(t, input)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	// The worker already has its ConfigMap checksum, which is not counted.
+	if want := "processed 3 workloads, injected 1 checksums into 1 workloads, 1 unresolved references\n"; stderr != want {
+		t.Fatalf("expected summary %q, got %q", want, stderr)
+	}
+	if strings.Contains(stdout, "processed") {
+		t.Fatalf("expected the summary to stay out of stdout, got:\n%s", stdout)
+	}
+
+	if _, _, stderr := runCLI(t, input, "-quiet"); stderr != "" {
+		t.Fatalf("expected -quiet to suppress the summary, got %q", stderr)
+	}
+}
+
+func TestRunJSONLogFormat(t *testing.T) {
+	code, _, stderr := runCLI(t, sampleManifest, "-log-format", "json", "-v", "-dry-run")
+	if code != 1 {
+		t.Fatalf("expected drift exit code, got %d (stderr: %s)", code, stderr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected info and warning lines, got: %s", stderr)
+	}
+	levels := map[string]bool{}
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected JSON log line, got %q: %v", line, err)
+		}
+		level, _ := entry["level"].(string)
+		levels[level] = true
+		if _, ok := entry["msg"].(string); !ok {
+			t.Fatalf("expected msg field in %q", line)
+		}
+		if level == "WARN" && entry["workload"] != "Deployment/app" {
+			t.Fatalf("expected workload field on drift warning, got %q", line)
+		}
+	}
+	if !levels["INFO"] || !levels["WARN"] {
+		t.Fatalf("expected INFO and WARN entries, got %v", levels)
+	}
+
+	code, _, stderr = runCLI(t, sampleManifest, "-log-format", "json", "-f", filepath.Join(t.TempDir(), "missing.yaml"))
+	if code != 1 {
+		t.Fatalf("expected error exit code, got %d", code)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stderr)), &entry); err != nil || entry["level"] != "ERROR" {
+		t.Fatalf("expected a JSON error line, got %q (%v)", stderr, err)
+	}
+}
+
+func TestRunGlobalDigest(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-global-digest")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	digest := strings.TrimSpace(stdout)
+	if len(digest) != 12 || strings.Contains(stdout, "kind:") {
+		t.Fatalf("expected only the digest on stdout, got %q", stdout)
+	}
+}
+
+func TestRunDumpRefs(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  TOKEN: QVBJX1RPS0VO
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: cfg
+          configMap:
+            name: app-config
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret
+            - secretRef:
+                name: extra-secret
+                optional: true
+          env:
+            - name: MISSING
+              valueFrom:
+                configMapKeyRef:
+                  name: absent-config
+                  key: value
+`
+
+	code, stdout, stderr := runCLI(t, input, "-dump-refs")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	want := [][]string{
+		{"WORKLOAD", "REFERENCE", "SOURCE", "SCOPE", "CHECKSUM"},
+		{"Deployment/app", "ConfigMap/absent-config", "envValueFrom", "-", "MISSING"},
+		{"Deployment/app", "ConfigMap/app-config", "envFrom", "object", "<checksum>"},
+		{"Deployment/app", "ConfigMap/app-config", "volume", "object", "<checksum>"},
+		{"Deployment/app", "Secret/app-secret", "envFrom", "object", "<checksum>"},
+		{"Deployment/app", "Secret/extra-secret", "envFrom", "-", "MISSING", "(optional)"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got:\n%s", len(want), stdout)
+	}
+	for i, fields := range want {
+		got := strings.Fields(lines[i])
+		if len(got) != len(fields) {
+			t.Fatalf("line %d: expected %v, got %q", i, fields, lines[i])
+		}
+		for j, f := range fields {
+			if f == "<checksum>" {
+				if len(got[j]) != 12 {
+					t.Fatalf("line %d: expected a checksum, got %q", i, lines[i])
+				}
+				continue
+			}
+			if got[j] != f {
+				t.Fatalf("line %d: expected %v, got %q", i, fields, lines[i])
+			}
+		}
+	}
+}
+
+func TestRunPrintHashInputs(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: czNjcmV0
+`
+
+	code, stdout, stderr := runCLI(t, input, "-print-hash-inputs")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if strings.Contains(stdout, "s3cret") || strings.Contains(stdout, "czNjcmV0") {
+		t.Fatalf("expected the Secret value to be redacted, got:\n%s", stdout)
+	}
+	for _, want := range []string{`  LOG_LEVEL: "info"`, "  password: <redacted, 6 bytes>"} {
+		if !strings.Contains(stdout, want) {
+			t.Fatalf("expected %q in output, got:\n%s", want, stdout)
+		}
+	}
+}
+
+func TestRunDumpHashes(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+  namespace: prod
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: czNjcmV0
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: db
+`
+
+	code, stdout, stderr := runCLI(t, input, "-dump-hashes")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	var hashes map[string]string
+	if err := json.Unmarshal([]byte(stdout), &hashes); err != nil {
+		t.Fatalf("expected a JSON object, got %v:\n%s", err, stdout)
+	}
+
+	if len(hashes) != 2 {
+		t.Fatalf("expected 2 hashes, got %v", hashes)
+	}
+	_, injected, _ := runCLI(t, input, "-quiet")
+	for key, label := range map[string]string{
+		"ConfigMap/prod/app-config": "checksum/configmap-app-config",
+		"Secret//db":                "checksum/secret-db",
+	} {
+		sum, ok := hashes[key]
+		if !ok {
+			t.Fatalf("expected %q in the dumped hashes, got %v", key, hashes)
+		}
+		if want := label + ": " + sum + "\n"; !strings.Contains(injected, want) {
+			t.Fatalf("expected the dumped hash of %s to match the injected %q, got:\n%s", key, want, injected)
+		}
+	}
+
+	immutable := strings.Replace(input, "  password: czNjcmV0\n", "  password: czNjcmV0\nimmutable: true\n", 1)
+	code, stdout, stderr = runCLI(t, immutable, "-dump-hashes", "-skip-immutable")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if strings.Contains(stdout, "Secret//db") {
+		t.Fatalf("expected the skipped Secret to be left out, got:\n%s", stdout)
+	}
+}
+
+func TestRunDumpHashesIgnoresWorkloads(t *testing.T) {
+	input := sampleManifest + `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: broken
+spec:
+  template:
+    metadata: unrendered
+    spec:
+      containers:
+        - name: broken
+          envFrom:
+            - configMapRef:
+                name: absent
+`
+
+	code, stdout, stderr := runCLI(t, input, "-dump-hashes", "-strict")
+	if code != 0 {
+		t.Fatalf("expected workloads to be skipped entirely, got exit code %d (stderr: %s)", code, stderr)
+	}
+	if want := "{\n  \"ConfigMap//app-config\": \"c2cb39c0e655\"\n}\n"; stdout != want {
+		t.Fatalf("expected only the source hashes, got:\n%s", stdout)
+	}
+	if stderr != "" {
+		t.Fatalf("expected no workload processing messages, got:\n%s", stderr)
+	}
+}
+
+func TestRunDumpRefsPreciseKeys(t *testing.T) {
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: czNjcmV0
+  user: YWRtaW4=
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: tls
+data:
+  tls.crt: Y2VydA==
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: tls
+          secret:
+            secretName: tls
+      containers:
+        - name: app
+          env:
+            - name: PASSWORD
+              valueFrom:
+                secretKeyRef:
+                  name: db
+                  key: password
+`
+
+	code, stdout, stderr := runCLI(t, input, "-dump-refs", "-precise-keys")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	want := [][]string{
+		{"WORKLOAD", "REFERENCE", "SOURCE", "SCOPE", "CHECKSUM"},
+		{"Deployment/app", "Secret/db", "envValueFrom", "keys=password"},
+		{"Deployment/app", "Secret/tls", "volume", "object"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got:\n%s", len(want), stdout)
+	}
+	for i, fields := range want {
+		got := strings.Fields(lines[i])
+		for j, f := range fields {
+			if j >= len(got) || got[j] != f {
+				t.Fatalf("line %d: expected %v, got %q", i, fields, lines[i])
+			}
+		}
+	}
+}
+
+func TestRunCheckKeys(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-check-keys")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "" || stderr != "" {
+		t.Fatalf("expected no output for valid keys, got stdout %q, stderr %q", stdout, stderr)
+	}
+
+	input := strings.ReplaceAll(sampleManifest, "app-config", "app-config-")
+	code, stdout, stderr = runCLI(t, input, "-check-keys")
+	if code != 1 {
+		t.Fatalf("expected exit code 1, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "" {
+		t.Fatalf("expected no manifests on stdout, got %q", stdout)
+	}
+	if !strings.Contains(stderr, `Deployment/app: invalid label key "checksum/configmap-app-config-"`) {
+		t.Fatalf("expected the invalid key to be reported, got %q", stderr)
+	}
+}
+
+func TestRunOfflineRejectsFromCluster(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-offline", "-from-cluster")
+	if code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+	if stdout != "" || !strings.Contains(stderr, "mutually exclusive") {
+		t.Fatalf("expected a usage error, got stdout %q, stderr %q", stdout, stderr)
+	}
+}
+
+func TestRunRejectsInvalidFlagValues(t *testing.T) {
+	for _, args := range [][]string{{"-mode", "bogus"}, {"-format", "x"}, {"-hash-length", "99"}, {"-selector", "a b"}, {"-no-such-flag"}} {
+		code, stdout, stderr := runCLI(t, sampleManifest, args...)
+		if code != 2 {
+			t.Fatalf("%v: expected exit code 2, got %d (stderr: %s)", args, code, stderr)
+		}
+		if stdout != "" {
+			t.Fatalf("%v: expected no output, got %q", args, stdout)
+		}
+	}
+}
+
+func TestRunUseResourceVersionRequiresFromCluster(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-use-resource-version")
+	if code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+	if stdout != "" || !strings.Contains(stderr, "requires -from-cluster") {
+		t.Fatalf("expected a usage error, got stdout %q, stderr %q", stdout, stderr)
+	}
+}
+
+func TestRunPatchFormat(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-format", "patch", "-mode", "annotation")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one patch document, got:\n%s", stdout)
+	}
+	var doc struct {
+		Kind  string
+		Name  string
+		Patch []map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &doc); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", lines[0], err)
+	}
+	if doc.Kind != "Deployment" || doc.Name != "app" || len(doc.Patch) != 1 {
+		t.Fatalf("unexpected patch document %s", lines[0])
+	}
+	if op := doc.Patch[0]; op["op"] != "add" || op["path"] != "/spec/template/metadata" {
+		t.Fatalf("expected the template metadata to be added, got %v", op)
+	}
+}
+
+func TestRunAnnotationsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "annotations.yaml")
+	if err := os.WriteFile(path, []byte("example.com/build-id: \"42\"\nexample.com/team: payments\n"), 0o644); err != nil {
+		t.Fatalf("failed to write annotations: %v", err)
+	}
+
+	code, stdout, stderr := runCLI(t, sampleManifest, "-annotations-from-file", path, "-extra-annotations", "example.com/build-id=43")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	for _, want := range []string{`example.com/build-id: "43"`, "example.com/team: payments", "checksum/configmap-app-config:"} {
+		if !strings.Contains(stdout, want) {
+			t.Fatalf("expected %q in output, got:\n%s", want, stdout)
+		}
+	}
+}
+
+func TestRunExtraAnnotationsEmptyValue(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-extra-annotations", "example.com/canary=")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, `example.com/canary: ""`) {
+		t.Fatalf("expected an empty-valued annotation, got:\n%s", stdout)
+	}
+
+	for _, args := range [][]string{{"-extra-annotations", "example.com/canary"}, {"-extra-annotations", "=value"}, {"-file-ref", "app-config="}} {
+		if code, _, stderr := runCLI(t, sampleManifest, args...); code != 2 {
+			t.Fatalf("%v: expected exit code 2, got %d (stderr: %s)", args, code, stderr)
+		}
+	}
+}
+
+func TestRunFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	parts := strings.SplitN(sampleManifest, "---\n", 2)
+	writeFiles(t, dir, map[string]string{"config.yaml": parts[0], "app/deployment.yaml": parts[1]})
+
+	code, stdout, stderr := runCLI(t, "", "-f", dir)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "checksum/configmap-app-config:") {
+		t.Fatalf("expected sources and workloads from separate files to be matched, got:\n%s", stdout)
+	}
+
+	code, _, stderr = runCLI(t, "", "-f", dir, "-max-files", "1")
+	if code != 1 || !strings.Contains(stderr, "raise -max-files") {
+		t.Fatalf("expected a file limit error, got exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestRunMultipleFiles(t *testing.T) {
+	dir := t.TempDir()
+	parts := strings.SplitN(sampleManifest, "---\n", 2)
+	writeFiles(t, dir, map[string]string{"a.yaml": parts[1], "b.yaml": parts[0]})
+
+	code, stdout, stderr := runCLI(t, "", "-f", filepath.Join(dir, "a.yaml"), "-f", filepath.Join(dir, "b.yaml"))
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "checksum/configmap-app-config: c2cb39c0e655") {
+		t.Fatalf("expected the Deployment to resolve the ConfigMap from the other file, got:\n%s", stdout)
+	}
+	deployment, configMap := strings.Index(stdout, "kind: Deployment"), strings.Index(stdout, "kind: ConfigMap")
+	if deployment < 0 || configMap < deployment {
+		t.Fatalf("expected documents in flag order, got:\n%s", stdout)
+	}
+}
+
+func TestRunStdinWithFiles(t *testing.T) {
+	dir := t.TempDir()
+	parts := strings.SplitN(sampleManifest, "---\n", 2)
+	writeFiles(t, dir, map[string]string{"configmap.yaml": parts[0]})
+
+	code, stdout, stderr := runCLI(t, parts[1], "-quiet", "-f", "-", "-f", dir)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "checksum/configmap-app-config: c2cb39c0e655") {
+		t.Fatalf("expected the stdin Deployment to resolve the ConfigMap from -f, got:\n%s", stdout)
+	}
+	if strings.Contains(stdout, "kind: ConfigMap") {
+		t.Fatalf("expected -f documents to be context only next to stdin, got:\n%s", stdout)
+	}
+
+	if code, _, stderr := runCLI(t, parts[1], "-f", "-", "-f", dir, "-since", "1h"); code != 2 || !strings.Contains(stderr, "-since cannot be combined with -f -") {
+		t.Fatalf("expected -since with stdin to be a usage error, got exit code %d (stderr: %s)", code, stderr)
+	}
+}
+
+func TestRunDocStart(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-doc-start")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.HasPrefix(stdout, "---\n") {
+		t.Fatalf("expected a leading document marker, got:\n%s", stdout)
+	}
+}
+
+func TestRunBaseDir(t *testing.T) {
+	dir := t.TempDir()
+	parts := strings.SplitN(sampleManifest, "---\n", 2)
+	writeFiles(t, dir, map[string]string{"configmap.yaml": parts[0]})
+
+	code, stdout, stderr := runCLI(t, parts[1], "-base-dir", dir)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "checksum/configmap-app-config: c2cb39c0e655") {
+		t.Fatalf("expected the reference to resolve against the base, got:\n%s", stdout)
+	}
+	if strings.Contains(stdout, "kind: ConfigMap") {
+		t.Fatalf("expected base sources to be left out of the output, got:\n%s", stdout)
+	}
+}
+
+func TestRunSince(t *testing.T) {
+	dir := t.TempDir()
+	parts := strings.SplitN(sampleManifest, "---\n", 2)
+	writeFiles(t, dir, map[string]string{"configmap.yaml": parts[0], "deployment.yaml": parts[1]})
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "configmap.yaml"), old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	code, stdout, stderr := runCLI(t, "", "-f", dir, "-since", "1h")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "checksum/configmap-app-config: c2cb39c0e655") {
+		t.Fatalf("expected the reference to resolve against the unchanged file, got:\n%s", stdout)
+	}
+	if strings.Contains(stdout, "kind: ConfigMap") {
+		t.Fatalf("expected the unchanged file to be left out of the output, got:\n%s", stdout)
+	}
+
+	// A workload in an unchanged file is still updated when a source it
+	// references changed; one that references nothing changed is not.
+	dir = t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"configmap.yaml":  parts[0],
+		"deployment.yaml": parts[1],
+		"other.yaml":      strings.ReplaceAll(parts[1], "app", "other"),
+	})
+	for _, name := range []string{"deployment.yaml", "other.yaml"} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	code, stdout, stderr = runCLI(t, "", "-f", dir, "-since", "1h")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stdout, "kind: Deployment\nmetadata:\n  name: app\n") || !strings.Contains(stdout, "checksum/configmap-app-config: c2cb39c0e655") {
+		t.Fatalf("expected the unchanged Deployment using the changed ConfigMap to be updated, got:\n%s", stdout)
+	}
+	if strings.Contains(stdout, "name: other") {
+		t.Fatalf("expected the unrelated unchanged file to be left out of the output, got:\n%s", stdout)
+	}
+
+	for _, args := range [][]string{{"-since", "1h"}, {"-f", dir, "-since", "yesterday"}} {
+		if code, _, stderr := runCLI(t, "", args...); code != 2 {
+			t.Fatalf("%v: expected exit code 2, got %d (stderr: %s)", args, code, stderr)
+		}
+	}
+}
+
+func TestRunMetrics(t *testing.T) {
+	// Without a scraper the command returns as soon as the output is
+	// written, so it never holds up a pipeline.
+	done := make(chan int, 1)
+	go func() {
+		code, _, _ := runCLI(t, sampleManifest, "-quiet", "-metrics", "127.0.0.1:0")
+		done <- code
+	}()
+	select {
+	case code := <-done:
+		if code != 0 {
+			t.Fatalf("expected exit code 0, got %d", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the command to return with -metrics set")
+	}
+
+	var scraped string
+	served := metricsServed
+	t.Cleanup(func() { metricsServed = served })
+	metricsServed = func(addr string) {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			t.Errorf("failed to scrape metrics: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("failed to read metrics: %v", err)
+		}
+		scraped = string(body)
+	}
+
+	code, _, stderr := runCLI(t, sampleManifest, "-metrics", "127.0.0.1:0")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	for _, want := range []string{"checksum_injector_workloads_processed_total 1\n", "checksum_injector_checksums_injected_total 1\n"} {
+		if !strings.Contains(scraped, want) {
+			t.Fatalf("expected %q in metrics, got:\n%s", want, scraped)
+		}
+	}
+
+	if code, _, stderr := runCLI(t, sampleManifest, "-metrics", "127.0.0.1:99999"); code != 1 || !strings.Contains(stderr, "failed to serve metrics") {
+		t.Fatalf("expected exit code 1 for an unusable address, got %d (stderr: %s)", code, stderr)
+	}
+}
+
+func TestRunEventsFile(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+stringData:
+  password: s3cret
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        checksum/configmap-app-config: stale
+        checksum/configmap-gone: 0123456789ab
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: db
+`
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	code, stdout, stderr := runCLI(t, input, "stabilize", "-quiet", "-events-file", path)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	// A second run over the output changes nothing, so it adds no events.
+	if code, _, stderr := runCLI(t, stdout, "stabilize", "-quiet", "-events-file", path); code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	// Report-only runs over the stale input write nothing, so they add no
+	// events either.
+	for _, args := range [][]string{{"-dry-run", "-changed-exit-code", "0"}, {"-dump-refs"}, {"-global-digest"}, {"-check-keys"}} {
+		args = append([]string{"stabilize", "-quiet", "-events-file", path}, args...)
+		if code, _, stderr := runCLI(t, input, args...); code != 0 {
+			t.Fatalf("%v: expected exit code 0, got %d (stderr: %s)", args, code, stderr)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read events: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected one event per changed key, got:\n%s", data)
+	}
+	want := []map[string]string{
+		{"op": "update", "key": "checksum/configmap-app-config", "old": "stale", "new": "c2cb39c0e655"},
+		{"op": "add", "key": "checksum/secret-db"},
+		{"op": "remove", "key": "checksum/configmap-gone", "old": "0123456789ab"},
+	}
+	for i, line := range lines {
+		var event map[string]string
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("expected a JSON event, got %v: %s", err, line)
+		}
+		if event["time"] == "" || event["kind"] != "Deployment" || event["name"] != "app" || event["field"] != "labels" {
+			t.Fatalf("expected the event to identify the workload and time, got %s", line)
+		}
+		for k, v := range want[i] {
+			if event[k] != v {
+				t.Fatalf("expected %s=%q in event %d, got %s", k, v, i, line)
+			}
+		}
+		if event["op"] == "add" && (event["old"] != "" || event["new"] == "") {
+			t.Fatalf("expected an added key to carry only its new value, got %s", line)
+		}
+	}
+}
+
+func TestRunCacheDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	// Only sources exported from a cluster, with a uid and resourceVersion,
+	// are cached.
+	if code, _, stderr := runCLI(t, sampleManifest, "-cache-dir", dir); code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected no cache for sources without a resourceVersion, got %v", err)
+	}
+
+	input := strings.Replace(sampleManifest, "  name: app-config\n", "  name: app-config\n  uid: 3f2a3a4e-0c61-4d0a-9d64-0b9d1f6a8e21\n  resourceVersion: \"4711\"\n", 1)
+	_, want, _ := runCLI(t, input)
+	for run := 0; run < 2; run++ {
+		code, stdout, stderr := runCLI(t, input, "-cache-dir", dir)
+		if code != 0 {
+			t.Fatalf("run %d: expected exit code 0, got %d (stderr: %s)", run, code, stderr)
+		}
+		if stdout != want {
+			t.Fatalf("run %d: expected output to match an uncached run\nwant:\n%s\ngot:\n%s", run, want, stdout)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Fatalf("expected one cache entry, got %d (%v)", len(entries), err)
+	}
+}
+
+func TestRunWorkersDeterministic(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&b, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config-%d\ndata:\n  VALUE: \"%d\"\n---\n", i, i)
+		fmt.Fprintf(&b, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: secret-%d\nstringData:\n  VALUE: \"%d\"\n---\n", i, i)
+		fmt.Fprintf(&b, "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app-%d\nspec:\n  template:\n    spec:\n      containers:\n        - name: app\n          envFrom:\n            - configMapRef:\n                name: config-%d\n            - secretRef:\n                name: secret-%d\n---\n", i, i, i)
+	}
+	input := b.String()
+
+	code, sequential, stderr := runCLI(t, input, "-workers", "1")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	code, parallel, stderr := runCLI(t, input, "-workers", "8")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if sequential != parallel {
+		t.Fatalf("expected identical output for -workers 1 and -workers 8\n-workers 1:\n%s\n-workers 8:\n%s", sequential, parallel)
+	}
+	if !strings.Contains(sequential, "checksum/secret-secret-49:") {
+		t.Fatalf("expected checksums in output, got:\n%s", sequential)
+	}
+}
+
+func TestRunListKinds(t *testing.T) {
+	code, stdout, stderr := runCLI(t, "", "-list-kinds")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	found := false
+	for _, line := range strings.Split(stdout, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "Deployment" {
+			found = fields[1] == "spec.template.spec"
+		}
+	}
+	if !found {
+		t.Fatalf("expected Deployment with its Pod spec path, got:\n%s", stdout)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := splitList(""); got == nil || len(got) != 0 {
+		t.Fatalf("expected an empty, non-nil list, got %#v", got)
+	}
+	if got, want := splitList("a, b,,c"), []string{"a", "b", "c"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestRunWarnIdenticalSources(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: worker-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-config
+data:
+  LOG_LEVEL: debug
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+stringData:
+  LOG_LEVEL: info
+`
+
+	code, _, stderr := runCLI(t, input, "-warn-identical-sources", "-quiet")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if want := "warning: sources have identical content kind=ConfigMap names=app-config,worker-config\n"; stderr != want {
+		t.Fatalf("expected %q, got %q", want, stderr)
+	}
+
+	if _, _, stderr := runCLI(t, input, "-quiet"); stderr != "" {
+		t.Fatalf("expected no warning without the flag, got %q", stderr)
+	}
+}
+
+func TestRunSkipBadDocs(t *testing.T) {
+	input := sampleManifest + "---\nkind: ConfigMap\nmetadata: {name: broken\n"
+
+	if code, _, _ := runCLI(t, input); code != 1 {
+		t.Fatalf("expected exit code 1 without -skip-bad-docs, got %d", code)
+	}
+
+	code, stdout, stderr := runCLI(t, input, "-skip-bad-docs")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if !strings.Contains(stderr, "warning: passing through document that failed to parse document=") {
+		t.Fatalf("expected the bad document to be logged, got %q", stderr)
+	}
+	if !strings.Contains(stdout, "checksum/") {
+		t.Fatalf("expected the valid documents to be injected, got:\n%s", stdout)
+	}
+	if !strings.HasSuffix(stdout, "---\nkind: ConfigMap\nmetadata: {name: broken\n") {
+		t.Fatalf("expected the bad document to be passed through, got:\n%s", stdout)
+	}
+}
+
+func TestRunPatchFormatFieldManager(t *testing.T) {
+	code, stdout, stderr := runCLI(t, sampleManifest, "-format", "patch", "-ssa-managed-fields", "checksum-injector")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+
+	var doc struct {
+		FieldManager       string                 `json:"fieldManager"`
+		ApplyConfiguration map[string]interface{} `json:"applyConfiguration"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &doc); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", stdout, err)
+	}
+	if doc.FieldManager != "checksum-injector" {
+		t.Fatalf("expected the field manager hint, got %q", doc.FieldManager)
+	}
+	apply, err := json.Marshal(doc.ApplyConfiguration)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	want := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"app"},"spec":{"template":{"metadata":{"labels":{"checksum/configmap-app-config":"`
+	if !strings.HasPrefix(string(apply), want) {
+		t.Fatalf("expected an apply configuration with only the checksum labels, got %s", apply)
+	}
+
+	if code, _, _ := runCLI(t, sampleManifest, "-ssa-managed-fields", "checksum-injector"); code != 2 {
+		t.Fatalf("expected -ssa-managed-fields without -format=patch to be rejected, got exit code %d", code)
+	}
+}
+
+func TestRunPostExec(t *testing.T) {
+	_, want, _ := runCLI(t, sampleManifest, "-quiet")
+
+	code, stdout, stderr := runCLI(t, sampleManifest, "-quiet", "-post-exec", "cat")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != want {
+		t.Fatalf("expected cat to pass the output through unchanged\nwant:\n%s\ngot:\n%s", want, stdout)
+	}
+
+	code, stdout, _ = runCLI(t, sampleManifest, "-quiet", "-post-exec", "sed 's/^kind: /kind:  /'")
+	if code != 0 || !strings.Contains(stdout, "kind:  Deployment\n") {
+		t.Fatalf("expected the transformed output, got exit code %d and:\n%s", code, stdout)
+	}
+
+	code, stdout, stderr = runCLI(t, sampleManifest, "-quiet", "-post-exec", "cat >/dev/null; echo broken >&2; exit 3")
+	if code != 1 {
+		t.Fatalf("expected exit code 1 for a failing command, got %d", code)
+	}
+	if stdout != "" {
+		t.Fatalf("expected no output from a failing command, got:\n%s", stdout)
+	}
+	if !strings.Contains(stderr, "broken") || !strings.Contains(stderr, "exit status 3") {
+		t.Fatalf("expected the command's stderr and exit status to be reported, got: %s", stderr)
+	}
+}
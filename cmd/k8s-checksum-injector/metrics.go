@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/komailo/k8s-checksum-injector/pkg/injector"
+)
+
+// serveMetrics serves m at /metrics on addr, e.g. ":9090", in the background
+// and returns the address it listens on and a function that stops it.
+// Errors after the listener is up are logged to logger.
+func serveMetrics(addr string, m *injector.Metrics, logger *slog.Logger) (string, func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to serve metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("failed to serve metrics", "error", err)
+		}
+	}()
+	return ln.Addr().String(), func() { _ = srv.Close() }, nil
+}
+
+// metricsServed is called with the address of the metrics listener once the
+// run is done, just before the listener stops. Tests replace it to scrape
+// the final counters.
+var metricsServed = func(addr string) {}
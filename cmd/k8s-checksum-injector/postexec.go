@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// postExec pipes output through command, run by sh so it may carry arguments
+// and pipes, and returns what the command writes to stdout. The command's
+// stderr is passed through to stderr. A command that fails, including by
+// exiting non-zero, yields an error and no output, so a broken transformer
+// never emits partial manifests.
+func postExec(ctx context.Context, command string, output []byte, stderr io.Writer) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(output)
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("post-exec %q: %w", command, err)
+	}
+	return stdout.Bytes(), nil
+}
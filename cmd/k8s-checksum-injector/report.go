@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/komailo/k8s-checksum-injector/pkg/injector"
+)
+
+// writeReferenceGraph prints one line per workload reference with the
+// checksum it resolved to, MISSING when the source is not in the input,
+// IGNORED when it is missing but on the ignore list, UNRENDERED when its name
+// is an unrendered template, EMPTY when the source has no data under
+// -hash-empty-as-absent, or SKIPPED when the source is excluded from
+// injection.
+func writeReferenceGraph(w io.Writer, graph []injector.WorkloadReferences) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKLOAD\tREFERENCE\tSOURCE\tSCOPE\tCHECKSUM")
+	for _, workload := range graph {
+		for _, ref := range workload.References {
+			status := ref.Checksum
+			switch {
+			case !ref.Resolved && ref.Ignored:
+				status = "IGNORED"
+			case ref.Unrendered:
+				status = "UNRENDERED"
+			case ref.Empty:
+				status = "EMPTY"
+			case !ref.Resolved && ref.Optional:
+				status = "MISSING (optional)"
+			case !ref.Resolved:
+				status = "MISSING"
+			case status == "":
+				status = "SKIPPED"
+			}
+			fmt.Fprintf(tw, "%s\t%s/%s\t%s\t%s\t%s\n", workload.Workload, ref.Kind, ref.Name, ref.Source, hashScope(ref), status)
+		}
+	}
+	return tw.Flush()
+}
+
+// hashScope describes what a reference's checksum covers: "object" for the
+// whole object, "keys=a,b" for the keys digested under -precise-keys, or "-"
+// when nothing is injected.
+func hashScope(ref injector.ResolvedReference) string {
+	switch {
+	case !ref.Resolved || ref.Checksum == "":
+		return "-"
+	case ref.HashedKeys != nil:
+		return "keys=" + strings.Join(ref.HashedKeys, ",")
+	default:
+		return "object"
+	}
+}
+
+// writeHashInputs prints each source with its checksum, or EMPTY or SKIPPED
+// like writeReferenceGraph, followed by one indented line per data entry in
+// digest order. ConfigMap values are quoted so trailing whitespace shows;
+// Secret values are replaced by their length.
+func writeHashInputs(w io.Writer, inputs []injector.SourceHashInput) error {
+	for _, in := range inputs {
+		name := in.Kind + "/" + in.Name
+		if in.Namespace != "" {
+			name = in.Kind + "/" + in.Namespace + "/" + in.Name
+		}
+		status := in.Checksum
+		switch {
+		case in.Empty:
+			status = "EMPTY"
+		case in.Skipped:
+			status = "SKIPPED"
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", name, status); err != nil {
+			return err
+		}
+		for _, e := range in.Entries {
+			var err error
+			if e.Redacted {
+				_, err = fmt.Fprintf(w, "  %s: <redacted, %d bytes>\n", e.Key, e.Length)
+			} else {
+				_, err = fmt.Fprintf(w, "  %s: %q\n", e.Key, e.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeHashes prints one indented JSON object mapping
+// "<kind>/<namespace>/<name>" to the checksum of each source. The namespace
+// is empty for sources without one, and later sources of the same identity
+// replace earlier ones, as they do when resolving references. Sources that
+// resolve to no checksum, Empty or Skipped ones, are left out.
+func writeHashes(w io.Writer, inputs []injector.SourceHashInput) error {
+	hashes := make(map[string]string, len(inputs))
+	for _, in := range inputs {
+		id := in.Kind + "/" + in.Namespace + "/" + in.Name
+		if in.Checksum == "" {
+			delete(hashes, id)
+			continue
+		}
+		hashes[id] = in.Checksum
+	}
+	data, err := json.MarshalIndent(hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// writeSummary prints the one-line run summary from the run's counters. With
+// JSON logs it is one more JSON record, written whatever the verbosity.
+func writeSummary(w io.Writer, logFormat string, c injector.MetricCounts) error {
+	if logFormat == "json" {
+		slog.New(slog.NewJSONHandler(w, nil)).Info("summary", "workloads", c.Workloads, "checksums", c.Checksums, "changed", c.Changed, "unresolved", c.Unresolved)
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "processed %d workloads, injected %d checksums into %d workloads, %d unresolved references\n", c.Workloads, c.Checksums, c.Changed, c.Unresolved)
+	return err
+}
+
+// patchDocument is the JSON rendering of one workload's patch.
+type patchDocument struct {
+	Kind      string                    `json:"kind"`
+	Namespace string                    `json:"namespace,omitempty"`
+	Name      string                    `json:"name"`
+	Patch     []injector.PatchOperation `json:"patch"`
+	// FieldManager and ApplyConfiguration are only set for server-side
+	// apply output.
+	FieldManager       string                 `json:"fieldManager,omitempty"`
+	ApplyConfiguration map[string]interface{} `json:"applyConfiguration,omitempty"`
+}
+
+// writePatches prints one JSON document per changed workload, one per line,
+// each carrying the workload's identity and its RFC 6902 JSON Patch. A
+// non-empty fieldManager adds the server-side apply configuration that
+// manager should apply.
+func writePatches(w io.Writer, patches []injector.WorkloadPatch, fieldManager string) error {
+	enc := json.NewEncoder(w)
+	for _, p := range patches {
+		doc := patchDocument{Kind: p.Workload.Kind, Namespace: p.Workload.Namespace, Name: p.Workload.Name, Patch: p.Operations}
+		if fieldManager != "" {
+			doc.FieldManager = fieldManager
+			doc.ApplyConfiguration = p.ApplyConfiguration
+		}
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeKinds prints one line per supported workload kind with the path of
+// its Pod spec. Kinds restricted to an API group are shown as kind.group.
+func writeKinds(w io.Writer, kinds []injector.KindInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tPOD SPEC PATH")
+	for _, k := range kinds {
+		kind := k.Kind
+		if k.Group != "" {
+			kind += "." + k.Group
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", kind, k.PodSpecPath)
+	}
+	return tw.Flush()
+}
+
+// changeEvent is the JSON rendering of one checksum key change in the
+// -events-file stream.
+type changeEvent struct {
+	Time      string `json:"time"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Op        string `json:"op"`
+	Field     string `json:"field"`
+	Key       string `json:"key"`
+	Old       string `json:"old,omitempty"`
+	New       string `json:"new,omitempty"`
+}
+
+// writeEvents appends one JSON line per change to the file at path, creating
+// it if needed, so successive runs build up a log of checksum changes. All
+// events of a run carry the same timestamp.
+func writeEvents(path string, now time.Time, changes []injector.KeyChange) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, c := range changes {
+		event := changeEvent{
+			Time:      now.UTC().Format(time.RFC3339),
+			Kind:      c.Workload.Kind,
+			Namespace: c.Workload.Namespace,
+			Name:      c.Workload.Name,
+			Op:        c.Op,
+			Field:     c.Field,
+			Key:       c.Key,
+			Old:       c.Old,
+			New:       c.New,
+		}
+		if err := enc.Encode(event); err != nil {
+			return fmt.Errorf("failed to write events: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write events: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write events: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write events: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package injector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AffectedWorkloads returns the workloads in input whose Pod templates
+// reference the ConfigMap or Secret named sourceName, in input order, to
+// predict which rollouts a change to that object would trigger. sourceKind
+// is KindConfigMap or KindSecret. Optional references count; workloads that
+// fail to decode are skipped. Like injection with default options,
+// references are matched by name only and credential Secrets are not
+// tracked.
+func AffectedWorkloads(input, sourceKind, sourceName string) ([]WorkloadRef, error) {
+	if sourceKind != KindConfigMap && sourceKind != KindSecret {
+		return nil, fmt.Errorf("invalid source kind %q (must be %s or %s)", sourceKind, KindConfigMap, KindSecret)
+	}
+	return WorkloadsReferencing(input, []Reference{{Kind: sourceKind, Name: sourceName}})
+}
+
+// WorkloadsReferencing returns the workloads in input that reference any of
+// sources, in input order. Only the Kind and Name of sources are compared,
+// as in AffectedWorkloads.
+func WorkloadsReferencing(input string, sources []Reference) ([]WorkloadRef, error) {
+	docs, err := decodeStream(strings.NewReader(input), false)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[Reference]bool, len(sources))
+	for _, s := range sources {
+		wanted[Reference{Kind: s.Kind, Name: s.Name}] = true
+	}
+
+	var affected []WorkloadRef
+	for _, doc := range docs {
+		wk, ok := lookupWorkloadKind(scalarAt(documentRoot(doc), "apiVersion"), getKind(doc))
+		if !ok {
+			continue
+		}
+		w, err := decodeWorkload(doc, wk)
+		if err != nil {
+			continue
+		}
+		for _, ref := range referencedObjects(w.spec, Options{}) {
+			if wanted[Reference{Kind: ref.Kind, Name: ref.Name}] {
+				affected = append(affected, w.ref)
+				break
+			}
+		}
+	}
+	return affected, nil
+}
+
+// DefinedSources returns the ConfigMaps and Secrets in input, in input
+// order, as references with only Kind and Name set.
+func DefinedSources(input string) ([]Reference, error) {
+	docs, err := decodeStream(strings.NewReader(input), false)
+	if err != nil {
+		return nil, err
+	}
+	var sources []Reference
+	for _, doc := range docs {
+		kind := getKind(doc)
+		if kind != KindConfigMap && kind != KindSecret {
+			continue
+		}
+		if name := scalarAt(documentRoot(doc), "metadata", "name"); name != "" {
+			sources = append(sources, Reference{Kind: kind, Name: name})
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,115 @@
+package injector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAffectedWorkloads(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: prod
+spec:
+  template:
+    spec:
+      containers:
+        - name: api
+          envFrom:
+            - configMapRef:
+                name: shared-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+spec:
+  template:
+    spec:
+      volumes:
+        - name: cfg
+          configMap:
+            name: shared-config
+            optional: true
+      containers:
+        - name: worker
+          envFrom:
+            - configMapRef:
+                name: shared-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: unrelated
+spec:
+  template:
+    spec:
+      containers:
+        - name: unrelated
+          envFrom:
+            - secretRef:
+                name: shared-config
+`
+
+	tests := []struct {
+		name string
+		kind string
+		want []WorkloadRef
+	}{
+		{
+			name: "shared-config",
+			kind: KindConfigMap,
+			want: []WorkloadRef{
+				{Kind: "Deployment", Namespace: "prod", Name: "api"},
+				{Kind: "Deployment", Name: "worker"},
+			},
+		},
+		{
+			name: "shared-config",
+			kind: KindSecret,
+			want: []WorkloadRef{{Kind: "Deployment", Name: "unrelated"}},
+		},
+		{
+			name: "other-config",
+			kind: KindConfigMap,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := AffectedWorkloads(input, tt.kind, tt.name)
+		if err != nil {
+			t.Fatalf("AffectedWorkloads(%s %s): %v", tt.kind, tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("AffectedWorkloads(%s %s): expected %+v, got %+v", tt.kind, tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := AffectedWorkloads(input, "Deployment", "api"); err == nil {
+		t.Fatalf("expected an error for an invalid source kind")
+	}
+
+	sources, err := DefinedSources(input)
+	if err != nil {
+		t.Fatalf("DefinedSources: %v", err)
+	}
+	if want := []Reference{{Kind: KindConfigMap, Name: "shared-config"}}; !reflect.DeepEqual(sources, want) {
+		t.Fatalf("DefinedSources: expected %+v, got %+v", want, sources)
+	}
+	got, err := WorkloadsReferencing(input, append(sources, Reference{Kind: KindSecret, Name: "shared-config"}))
+	if err != nil {
+		t.Fatalf("WorkloadsReferencing: %v", err)
+	}
+	want := []WorkloadRef{{Kind: "Deployment", Namespace: "prod", Name: "api"}, {Kind: "Deployment", Name: "worker"}, {Kind: "Deployment", Name: "unrelated"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("WorkloadsReferencing: expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,202 @@
+package injector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DigestCache stores source digests under a key derived from the source's
+// identity and version. Implementations must be safe for concurrent use;
+// failing to store or load an entry only costs the work of digesting again.
+type DigestCache interface {
+	Get(key string) (digest string, ok bool)
+	Put(key, digest string)
+}
+
+// cacheVersion is part of every cache key, so changes to the digest format
+// never return stale entries.
+const cacheVersion = "v3"
+
+// cacheKey returns the identity part of the key a source's digest is cached
+// under: a SHA-256 of its kind, namespace, name, uid and resourceVersion
+// along with the options and data keys the digest depends on. digest adds a
+// fingerprint of the content, so a source edited locally under an unchanged
+// resourceVersion misses. Sources without a uid or resourceVersion, such as
+// those rendered by a build, are not cached and the key is empty.
+func cacheKey(kind string, meta metav1.ObjectMeta, keys []string, opts Options) string {
+	if opts.Cache == nil || meta.UID == "" || meta.ResourceVersion == "" {
+		return ""
+	}
+	h := sha256.New()
+	for _, field := range []string{cacheVersion, kind, meta.Namespace, meta.Name, string(meta.UID), meta.ResourceVersion, opts.Salt} {
+		writeName(h, field)
+	}
+	fmt.Fprintf(h, "%t %t\x00", opts.TrimValues, opts.IncludeMetadata)
+	if opts.IncludeMetadata {
+		for _, prefix := range prunePrefixes(opts.targets()) {
+			writeName(h, prefix)
+		}
+	}
+	for _, k := range keys {
+		writeName(h, k)
+	}
+	return cacheVersion + "-" + hex.EncodeToString(h.Sum(nil))
+}
+
+// digest returns the checksum of the bytes write produces. With a cache key,
+// the key is extended by a CRC-64 of those bytes, which is much cheaper than
+// SHA-256, and a valid cached digest under it is returned; a computed one is
+// stored.
+func digest(opts Options, key string, write func(h io.Writer)) string {
+	if key != "" {
+		fingerprint := crc64.New(crcTable)
+		write(fingerprint)
+		key += "-" + strconv.FormatUint(fingerprint.Sum64(), 16)
+		if cached, ok := opts.Cache.Get(key); ok && validDigest(cached) {
+			return cached[:opts.hashLength()]
+		}
+	}
+	h := sha256.New()
+	write(h)
+	full := hex.EncodeToString(h.Sum(nil))
+	if key != "" {
+		opts.Cache.Put(key, full)
+	}
+	return full[:opts.hashLength()]
+}
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// chunkSize is the size of the buffers writeString copies strings through.
+const chunkSize = 32 << 10
+
+var chunkPool = sync.Pool{New: func() interface{} {
+	buf := make([]byte, chunkSize)
+	return &buf
+}}
+
+// writeString writes s to w. Writers that accept strings get it as is; the
+// others, such as SHA-256, get it in chunks through a pooled buffer, since
+// converting a multi-megabyte value to a []byte at once would copy all of it.
+func writeString(w io.Writer, s string) {
+	if sw, ok := w.(io.StringWriter); ok {
+		sw.WriteString(s)
+		return
+	}
+	buf := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(buf)
+	for len(s) > 0 {
+		n := copy(*buf, s)
+		w.Write((*buf)[:n])
+		s = s[n:]
+	}
+}
+
+// validDigest reports whether s is a full hex-encoded SHA-256 digest, so a
+// truncated or corrupted cache entry is recomputed instead of injected.
+func validDigest(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// DirCache is a DigestCache keeping one small file per entry in a directory,
+// which persists digests across runs. The directory is created on first use,
+// readable only by its owner: whoever can write to it controls the injected
+// checksums.
+type DirCache struct {
+	Dir string
+	// MaxEntries is the number of entries Evict keeps. Zero means
+	// defaultCacheEntries.
+	MaxEntries int
+}
+
+// defaultCacheEntries is how many entries a DirCache keeps by default.
+const defaultCacheEntries = 10000
+
+func (c DirCache) Get(key string) (string, bool) {
+	path := filepath.Join(c.Dir, key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	// Evict drops the least recently used entries first.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return string(data), true
+}
+
+func (c DirCache) Put(key, digest string) {
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return
+	}
+	// Write through a temporary file so concurrent runs never read a
+	// partial entry.
+	tmp, err := os.CreateTemp(c.Dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.WriteString(tmp, digest)
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		return
+	}
+	_ = os.Rename(tmp.Name(), filepath.Join(c.Dir, key))
+}
+
+// Evict removes the least recently used entries beyond MaxEntries. A
+// missing directory holds no entries.
+func (c DirCache) Evict() error {
+	max := c.MaxEntries
+	if max == 0 {
+		max = defaultCacheEntries
+	}
+	entries, err := os.ReadDir(c.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to evict cache entries: %w", err)
+	}
+	type entry struct {
+		name string
+		used time.Time
+	}
+	var files []entry
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, entry{name: e.Name(), used: info.ModTime()})
+	}
+	if len(files) <= max {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].used.After(files[j].used) })
+	for _, f := range files[max:] {
+		if err := os.Remove(filepath.Join(c.Dir, f.name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to evict cache entries: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package injector
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// countingCache wraps a DigestCache and counts hits and misses.
+type countingCache struct {
+	DigestCache
+	mu           sync.Mutex
+	hits, misses int
+}
+
+func (c *countingCache) Get(fingerprint string) (string, bool) {
+	digest, ok := c.DigestCache.Get(fingerprint)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return digest, ok
+}
+
+const cachedSourcesManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+  uid: 6c1e0f55-54a4-4b0f-9a4e-7f0e3c1b9d01
+  resourceVersion: "1001"
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+  uid: 0b8d7a3e-1f2c-4e5d-8a9b-6c7d8e9f0a1b
+  resourceVersion: "1002"
+stringData:
+  TOKEN: abc
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: rendered
+data:
+  MODE: batch
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret
+            - configMapRef:
+                name: rendered
+`
+
+func TestInjectDirCache(t *testing.T) {
+	input := cachedSourcesManifest
+	dir := filepath.Join(t.TempDir(), "cache")
+
+	uncached, err := Inject(input, Options{Mode: ModeLabel, Salt: "prod"})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	cache := &countingCache{DigestCache: DirCache{Dir: dir}}
+	for run := 0; run < 2; run++ {
+		res, err := Inject(input, Options{Mode: ModeLabel, Salt: "prod", Cache: cache})
+		if err != nil {
+			t.Fatalf("run %d: Inject: %v", run, err)
+		}
+		if res.Output != uncached.Output || res.GlobalDigest != uncached.GlobalDigest {
+			t.Fatalf("run %d: expected cached output to match\nwant:\n%s\ngot:\n%s", run, uncached.Output, res.Output)
+		}
+	}
+	// The two sources with a uid and resourceVersion each have a salted
+	// checksum and an unsalted global digest entry; the rendered one is
+	// never cached.
+	if cache.misses != 4 || cache.hits != 4 {
+		t.Fatalf("expected a cold run and a warm run over 2 cached sources, got %d misses and %d hits", cache.misses, cache.hits)
+	}
+
+	// A different salt changes the checksums and must not hit; the
+	// unsalted digests still do.
+	res, err := Inject(input, Options{Mode: ModeLabel, Salt: "staging", Cache: cache})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if cache.hits != 6 || res.Output == uncached.Output {
+		t.Fatalf("expected a changed salt to miss the cache for checksums only, got %d hits", cache.hits)
+	}
+
+	// A new revision of a source misses, even if its name and size are
+	// unchanged.
+	changed := strings.Replace(strings.Replace(input, "LOG_LEVEL: info", "LOG_LEVEL: warn", 1), `"1001"`, `"1003"`, 1)
+	want, err := Inject(changed, Options{Mode: ModeLabel, Salt: "prod"})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	res, err = Inject(changed, Options{Mode: ModeLabel, Salt: "prod", Cache: cache})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if res.Output != want.Output || cache.hits != 8 {
+		t.Fatalf("expected the new revision to be digested again, got %d hits\nwant:\n%s\ngot:\n%s", cache.hits, want.Output, res.Output)
+	}
+
+	// A source edited locally under an unchanged resourceVersion misses
+	// too, since the key covers its content.
+	edited := strings.Replace(input, "LOG_LEVEL: info", "LOG_LEVEL: debug", 1)
+	want, err = Inject(edited, Options{Mode: ModeLabel, Salt: "prod"})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	res, err = Inject(edited, Options{Mode: ModeLabel, Salt: "prod", Cache: cache})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if res.Output != want.Output || res.Output == uncached.Output || cache.hits != 10 {
+		t.Fatalf("expected the edited source to be digested again, got %d hits\nwant:\n%s\ngot:\n%s", cache.hits, want.Output, res.Output)
+	}
+
+	// Corrupted entries are recomputed rather than injected.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read cache: %v", err)
+	}
+	for _, e := range entries {
+		if err := os.WriteFile(filepath.Join(dir, e.Name()), []byte("garbage"), 0o644); err != nil {
+			t.Fatalf("failed to corrupt cache: %v", err)
+		}
+	}
+	res, err = Inject(input, Options{Mode: ModeLabel, Salt: "prod", Cache: DirCache{Dir: dir}})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if res.Output != uncached.Output {
+		t.Fatalf("expected corrupted entries to be ignored\nwant:\n%s\ngot:\n%s", uncached.Output, res.Output)
+	}
+}
+
+func TestDirCacheEvict(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	cache := DirCache{Dir: dir, MaxEntries: 2}
+	if err := cache.Evict(); err != nil {
+		t.Fatalf("expected a missing directory to be empty, got %v", err)
+	}
+
+	digest := strings.Repeat("a", 2*sha256.Size)
+	start := time.Now().Add(-time.Hour)
+	for i, key := range []string{"used", "old", "new"} {
+		cache.Put(key, digest)
+		used := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, key), used, used); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	// Reading an entry marks it as recently used.
+	if _, ok := cache.Get("used"); !ok {
+		t.Fatalf("expected a cached entry")
+	}
+	if err := cache.Evict(); err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	for key, want := range map[string]bool{"old": false, "used": true, "new": true} {
+		if _, ok := cache.Get(key); ok != want {
+			t.Fatalf("expected entry %q kept to be %v", key, want)
+		}
+	}
+}
+
+func TestWriteStringMatchesWrite(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, 3*chunkSize + 7} {
+		s := strings.Repeat("abcdefg", size/7+1)[:size]
+		want := sha256.Sum256([]byte(s))
+		h := sha256.New()
+		writeString(h, s)
+		if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+			t.Fatalf("size %d: expected writeString to digest like Write, got %x, want %x", size, got, want)
+		}
+	}
+}
+
+func BenchmarkHashConfigMapLargeValue(b *testing.B) {
+	cm := &corev1.ConfigMap{Data: map[string]string{"blob": strings.Repeat("x", 8<<20)}}
+	cm.Name = "large"
+	b.Run("writeString", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(cm.Data["blob"])))
+		for i := 0; i < b.N; i++ {
+			hashConfigMap(cm, Options{})
+		}
+	})
+	// Converting the value as a whole, as the digest used to, for comparison.
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(cm.Data["blob"])))
+		for i := 0; i < b.N; i++ {
+			h := sha256.New()
+			h.Write([]byte(cm.Data["blob"]))
+			h.Sum(nil)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package injector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeDocuments parses every YAML document in r. Empty documents are
+// dropped unless PreserveEmptyDocs is set. With SkipBadDocs, documents that
+// fail to parse are logged and passed through as raw documents instead of
+// failing the whole stream.
+func decodeDocuments(r io.Reader, opts Options, log *slog.Logger) ([]*yaml.Node, error) {
+	if !opts.SkipBadDocs {
+		return decodeStream(r, opts.PreserveEmptyDocs)
+	}
+
+	// A yaml.v3 decoder cannot recover from a syntax error, so each document
+	// is split off on its "---" line and decoded on its own.
+	chunks, err := splitDocuments(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+	var docs []*yaml.Node
+	for i, chunk := range chunks {
+		parsed, err := decodeStream(bytes.NewReader(chunk), opts.PreserveEmptyDocs)
+		if err != nil {
+			log.Warn("passing through document that failed to parse", "document", i, "error", err)
+			docs = append(docs, rawDocument(chunk))
+			continue
+		}
+		docs = append(docs, parsed...)
+	}
+	return docs, nil
+}
+
+// rawDocumentTag marks a document that failed to parse under SkipBadDocs.
+const rawDocumentTag = "!checksum-injector/raw"
+
+// rawDocument wraps text that is not valid YAML in a document node that
+// writeDocuments copies to the output verbatim, without a bare "---" line
+// that introduced it. It has no content, so it is never a source or a
+// workload.
+func rawDocument(text []byte) *yaml.Node {
+	value := string(text)
+	if first, rest, ok := strings.Cut(value, "\n"); ok && strings.TrimSuffix(first, "\r") == "---" {
+		value = rest
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Tag: rawDocumentTag, Value: value}
+}
+
+func isRawDocument(doc *yaml.Node) bool {
+	return doc != nil && doc.Kind == yaml.DocumentNode && doc.Tag == rawDocumentTag
+}
+
+func decodeStream(r io.Reader, keepEmpty bool) ([]*yaml.Node, error) {
+	decoder := yaml.NewDecoder(r)
+	var docs []*yaml.Node
+	for {
+		doc := &yaml.Node{}
+		err := decoder.Decode(doc)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+		if isEmptyDocument(doc) && !keepEmpty {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// splitDocuments cuts a multi-document stream into one chunk per document.
+// Each chunk but the first starts with the "---" line that introduced it.
+func splitDocuments(r io.Reader) ([][]byte, error) {
+	var chunks [][]byte
+	var current bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isDocumentSeparator(line) && current.Len() > 0 {
+			chunks = append(chunks, append([]byte(nil), current.Bytes()...))
+			current.Reset()
+		}
+		current.WriteString(line)
+		current.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.Bytes())
+	}
+	return chunks, nil
+}
+
+func isDocumentSeparator(line string) bool {
+	if !strings.HasPrefix(line, "---") {
+		return false
+	}
+	rest := line[len("---"):]
+	rest = strings.TrimSuffix(rest, "\r")
+	return rest == "" || rest[0] == ' ' || rest[0] == '\t'
+}
+
+// explainSecretDecodeError replaces err with one naming the Secret and its
+// data keys that are not valid base64, the usual cause of a hand-edited
+// Secret failing to decode. Other errors are returned unchanged.
+func explainSecretDecodeError(doc *yaml.Node, err error) error {
+	root := documentRoot(doc)
+	data := findMap(root, "data")
+	if data == nil {
+		return err
+	}
+	var bad []string
+	for i := 0; i+1 < len(data.Content); i += 2 {
+		value := data.Content[i+1]
+		if value.Kind != yaml.ScalarNode || isNullNode(value) {
+			continue
+		}
+		if _, decodeErr := base64.StdEncoding.DecodeString(value.Value); decodeErr != nil {
+			bad = append(bad, strconv.Quote(data.Content[i].Value))
+		}
+	}
+	if len(bad) == 0 {
+		return err
+	}
+	name := scalarAt(root, "metadata", "name")
+	if len(bad) == 1 {
+		return fmt.Errorf("Secret/%s: data key %s is not valid base64", name, bad[0])
+	}
+	return fmt.Errorf("Secret/%s: data keys %s are not valid base64", name, strings.Join(bad, ", "))
+}
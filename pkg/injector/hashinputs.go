@@ -0,0 +1,152 @@
+package injector
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SourceHashInput lists the data entries of one ConfigMap or Secret in the
+// order they are fed to its digest, for debugging checksum mismatches. The
+// salt, the name and, under IncludeMetadata, labels and annotations are
+// digested too but not listed.
+type SourceHashInput struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Checksum is the checksum references to the source resolve to. It is
+	// empty when Skipped or Empty is set.
+	Checksum string
+	// Skipped reports an immutable source under SkipImmutable, whose
+	// references resolve without a checksum being injected.
+	Skipped bool
+	// Empty reports a source without data under EmptyAsAbsent, which
+	// resolves no references.
+	Empty   bool
+	Entries []HashInputEntry
+}
+
+// HashInputEntry is one data key and the value digested for it.
+type HashInputEntry struct {
+	Key string
+	// Value is the value as digested, after TrimValues. It is always empty
+	// for Secrets, whose values are never exposed.
+	Value string
+	// Length is the length of the digested value in bytes.
+	Length int
+	// Redacted reports that Value was withheld.
+	Redacted bool
+}
+
+// HashInputs returns what every ConfigMap and Secret in the input and
+// FileRefs is digested from, in that order, decoded and checksummed as Inject
+// resolves references to them. BaseManifests only resolve references, so
+// their sources are not listed. Sources that fail to decode are skipped
+// unless StrictDecode is set. Secret values are redacted.
+func HashInputs(input string, opts Options) ([]SourceHashInput, error) {
+	log := opts.logger()
+	docs, err := decodeDocuments(strings.NewReader(input), opts, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []SourceHashInput
+	for i, doc := range docs {
+		switch kind := getKind(doc); kind {
+		case KindConfigMap:
+			cm, order, err := decodeConfigMapDocument(doc, opts)
+			if err != nil {
+				if opts.StrictDecode {
+					return nil, fmt.Errorf("failed to decode ConfigMap: %w", err)
+				}
+				log.Warn("skipping document that failed to decode", "kind", kind, "document", i, "error", err)
+				continue
+			}
+			keys := sortedKeys(cm.Data)
+			if opts.OrderSensitive {
+				keys = order
+			}
+			in := configMapHashInput(cm, keys, opts)
+			in.setChecksum(configMapChecksum(cm, hashConfigMapKeys(cm, keys, opts), opts))
+			inputs = append(inputs, in)
+		case KindSecret:
+			s, err := decodeSecretDocument(doc, opts)
+			if err != nil {
+				if opts.StrictDecode {
+					return nil, fmt.Errorf("failed to decode Secret: %w", err)
+				}
+				log.Warn("skipping document that failed to decode", "kind", kind, "document", i, "error", err)
+				continue
+			}
+			in := secretHashInput(s, opts)
+			in.setChecksum(secretChecksum(s, hashSecret(s, opts), opts))
+			inputs = append(inputs, in)
+		}
+	}
+
+	names := make([]string, 0, len(opts.FileRefs))
+	for name := range opts.FileRefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cm, err := fileConfigMap(name, opts.FileRefs[name])
+		if err != nil {
+			return nil, err
+		}
+		in := configMapHashInput(cm, sortedKeys(cm.Data), opts)
+		in.Checksum = hashConfigMap(cm, opts)
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+// setChecksum records sum, as returned by sourceChecksum.
+func (in *SourceHashInput) setChecksum(sum string) {
+	switch sum {
+	case emptyChecksum:
+		in.Empty = true
+	case skippedChecksum:
+		in.Skipped = true
+	default:
+		in.Checksum = sum
+	}
+}
+
+func configMapHashInput(cm *corev1.ConfigMap, keys []string, opts Options) SourceHashInput {
+	in := SourceHashInput{Kind: KindConfigMap, Namespace: cm.Namespace, Name: cm.Name}
+	excluded := excludedKeys(cm)
+	for _, k := range keys {
+		if excluded[k] {
+			continue
+		}
+		value := cm.Data[k]
+		if opts.TrimValues {
+			value = strings.TrimRightFunc(value, unicode.IsSpace)
+		}
+		in.Entries = append(in.Entries, HashInputEntry{Key: k, Value: value, Length: len(value)})
+	}
+	return in
+}
+
+func secretHashInput(s *corev1.Secret, opts Options) SourceHashInput {
+	in := SourceHashInput{Kind: KindSecret, Namespace: s.Namespace, Name: s.Name}
+	data := effectiveSecretData(s)
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value := data[k]
+		if opts.TrimValues {
+			value = bytes.TrimRightFunc(value, unicode.IsSpace)
+		}
+		in.Entries = append(in.Entries, HashInputEntry{Key: k, Length: len(value), Redacted: true})
+	}
+	return in
+}
@@ -0,0 +1,117 @@
+package injector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHashInputs(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  b: "two  "
+  a: one
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+  namespace: prod
+data:
+  password: czNjcmV0
+stringData:
+  user: admin
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	opts := Options{Mode: ModeLabel, TrimValues: true}
+	inputs, err := HashInputs(input, opts)
+	if err != nil {
+		t.Fatalf("HashInputs: %v", err)
+	}
+	if len(inputs) != 2 {
+		t.Fatalf("expected two sources, got %+v", inputs)
+	}
+
+	cm := inputs[0]
+	wantCM := []HashInputEntry{{Key: "a", Value: "one", Length: 3}, {Key: "b", Value: "two", Length: 3}}
+	if !reflect.DeepEqual(cm.Entries, wantCM) {
+		t.Fatalf("ConfigMap entries mismatch\nwant: %+v\ngot:  %+v", wantCM, cm.Entries)
+	}
+	res, err := Inject(input, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got := res.References[0].References[0].Checksum; got != cm.Checksum {
+		t.Fatalf("expected the injected checksum %s, got %s", got, cm.Checksum)
+	}
+
+	secret := inputs[1]
+	if secret.Namespace != "prod" || secret.Name != "db" {
+		t.Fatalf("expected Secret prod/db, got %+v", secret)
+	}
+	wantSecret := []HashInputEntry{{Key: "password", Length: 6, Redacted: true}, {Key: "user", Length: 5, Redacted: true}}
+	if !reflect.DeepEqual(secret.Entries, wantSecret) {
+		t.Fatalf("Secret entries mismatch\nwant: %+v\ngot:  %+v", wantSecret, secret.Entries)
+	}
+}
+
+func TestHashInputsResolvedChecksums(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: frozen
+immutable: true
+data:
+  a: one
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: blank
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  a: one
+`
+	base := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: base-config
+data:
+  a: one
+`
+	opts := Options{Mode: ModeLabel, SkipImmutable: true, EmptyAsAbsent: true, BaseManifests: base}
+	inputs, err := HashInputs(input, opts)
+	if err != nil {
+		t.Fatalf("HashInputs: %v", err)
+	}
+	if len(inputs) != 3 {
+		t.Fatalf("expected the three input sources only, got %+v", inputs)
+	}
+	if in := inputs[0]; !in.Skipped || in.Empty || in.Checksum != "" {
+		t.Fatalf("expected the immutable ConfigMap to be skipped, got %+v", in)
+	}
+	if in := inputs[1]; !in.Empty || in.Skipped || in.Checksum != "" {
+		t.Fatalf("expected the Secret without data to be empty, got %+v", in)
+	}
+	if in := inputs[2]; in.Name != "app-config" || in.Checksum == "" || in.Skipped || in.Empty {
+		t.Fatalf("expected a checksum for app-config, got %+v", in)
+	}
+}
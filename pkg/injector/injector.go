@@ -4,14 +4,24 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
+	"unicode"
 
 	yaml "gopkg.in/yaml.v3"
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	sigyaml "sigs.k8s.io/yaml"
 )
 
@@ -23,164 +33,1205 @@ const (
 	ModeAnnotation Mode = "annotation"
 )
 
+// Options controls how checksums are computed and injected.
+type Options struct {
+	// Mode selects whether checksums are written as labels or annotations.
+	// It is ignored when Targets is set.
+	Mode Mode
+	// Targets lists every place checksums are written to, each with its own
+	// key prefix. When empty, checksums go to Mode under "checksum/".
+	Targets []Target
+	// StrictDecode rejects ConfigMaps and Secrets that contain unknown fields
+	// instead of silently ignoring them.
+	StrictDecode bool
+	// FileRefs maps a ConfigMap name to a file on disk. Each file is hashed as
+	// if it had been rendered with `kubectl create configmap --from-file`, so
+	// workloads can reference it before the ConfigMap exists. File references
+	// take precedence over ConfigMaps of the same name in the input.
+	FileRefs map[string]string
+	// Prune removes checksum keys from Pod templates that no longer correspond
+	// to a resolved reference, so hand-edited or stale keys do not linger.
+	Prune bool
+	// HashLength is the number of hex characters of the SHA-256 digest kept
+	// in each checksum, at most 64. Zero means 12. Longer checksums make
+	// accidental collisions less likely; label values are limited to 63
+	// characters, so 64 is rejected for label targets.
+	HashLength int
+	// Salt is mixed into every digest so checksums cannot be compared across
+	// environments that use different salts. Changing it changes every
+	// checksum and therefore rolls every workload.
+	Salt string
+	// IncludeMetadata also folds the labels and annotations of ConfigMaps and
+	// Secrets into their checksums. kubectl's last-applied-configuration and
+	// restartedAt annotations and keys under the injector's own prefixes are
+	// left out so they cannot cause spurious changes. A Secret's type is
+	// never digested, so omitting the default Opaque type or spelling it out
+	// yields the same checksum.
+	IncludeMetadata bool
+	// TrimValues hashes every ConfigMap and Secret value with trailing
+	// whitespace removed, so tools that add or drop a final newline do not
+	// change the checksum. The objects themselves are left untouched. Trimmed
+	// and untrimmed checksums differ for values that end in whitespace.
+	TrimValues bool
+	// KeyTemplate, when set, is a text/template rendering the complete key
+	// for each referenced object from a KeyTemplateData, e.g.
+	// "cfg.example.com/{{.Kind}}-{{.SanitizedName}}". It replaces the target
+	// prefixes and the infixes; every target gets the same key. Rendered keys
+	// must be legal label and annotation keys, and distinct for distinct
+	// objects. Prune only removes keys under the target prefixes.
+	KeyTemplate string
+	// ExistingKeyFormat names where checksums were written by an earlier
+	// run, for drift detection across a change of key format. It is either a
+	// key prefix, to which the default key name (infix and object name) is
+	// appended, or a key template in the syntax of KeyTemplate. Checksums
+	// are still written in the current format, but a workload only counts
+	// as changed by them when the value under the existing key differs from
+	// the recomputed checksum, so Result.Changed and a dry run report drift
+	// rather than the migration itself.
+	ExistingKeyFormat string
+	// OnlyMissing only adds checksum keys a Pod template does not have yet
+	// and never updates existing ones, even stale ones, so workloads can be
+	// moved to checksums gradually without rolling those already deployed.
+	// Kept keys are not pruned and are left out of Result.Keys.
+	OnlyMissing bool
+	// OnlyIfReferenced hashes only the ConfigMaps and Secrets that some
+	// workload in the input references, which saves work on large bundles
+	// without changing any injected checksum. GlobalDigest then only covers
+	// the referenced sources.
+	OnlyIfReferenced bool
+	// PreciseKeys digests only the data keys a workload references when all
+	// of its references to an object name keys, through env var keyRefs or
+	// volume items, so changing any other key does not roll it. Any
+	// reference to the whole object, such as envFrom or a volume without
+	// items, makes the whole object count. FileRefs, Lookup sources and
+	// InjectIntoDeployment always hash whole objects.
+	PreciseKeys bool
+	// OrderSensitive digests the data of ConfigMaps in the input in the
+	// order the keys appear in the document rather than sorted, for data
+	// rendered into order-sensitive files. Reordering keys then changes the
+	// checksum. Secrets and ConfigMaps returned by Lookup are still hashed
+	// in sorted key order.
+	OrderSensitive bool
+	// ConfigMapInfix and SecretInfix start the name segment of every key, in
+	// front of the object name, to tell ConfigMaps and Secrets of the same
+	// name apart. They default to "configmap-" and "secret-".
+	ConfigMapInfix string
+	SecretInfix    string
+	// StripNameSuffix lets a reference and a source match when their names
+	// only differ by a kustomize-style content hash suffix ("-" followed by
+	// ten hash characters), e.g. when name suffixing is disabled on only one
+	// side. Keys are then built from the unsuffixed name, so they stay the
+	// same across generations.
+	StripNameSuffix bool
+	// Selector, when set, is a label selector in kubectl syntax, e.g.
+	// "tier=backend,env!=dev", matched against each workload's
+	// metadata.labels. Workloads that do not match are left untouched.
+	Selector string
+	// PodTemplatePath is a dotted path, such as "spec.template", at which
+	// documents of unregistered kinds, e.g. one-off custom resources, are
+	// assumed to hold a Pod template. Every such document with a Pod spec
+	// below that path is treated as a workload. Registered kinds keep their
+	// own paths.
+	PodTemplatePath string
+	// SelfCheck re-decodes the rendered output before returning or writing
+	// it and fails the run if it does not parse or any injected checksum is
+	// missing from it or has a different value.
+	SelfCheck bool
+	// DefaultNamespace is assumed for sources and workloads without
+	// metadata.namespace, so that omitting the namespace and spelling out
+	// the same one identify an object alike, e.g. in GlobalDigest, the
+	// Namespace of KeyTemplate, HashInputs and Lookup, and when references
+	// resolve to the sources of their workload's namespace. Empty leaves
+	// omitted namespaces empty.
+	DefaultNamespace string
+	// SkipZeroReplicas leaves workloads that explicitly set spec.replicas to
+	// 0 untouched, e.g. scaled-down Deployments kept as templates.
+	SkipZeroReplicas bool
+	// SkipImmutable excludes ConfigMaps and Secrets marked `immutable: true`
+	// from injection. Immutable objects are replaced under a new name rather
+	// than edited, so the name change already rolls the workload.
+	SkipImmutable bool
+	// CredentialSecrets also tracks the Secrets a Pod needs before it starts
+	// rather than the configuration it reads: imagePullSecrets and the
+	// nodePublishSecretRef of CSI volumes. They are often managed outside
+	// the manifests, so they are off by default.
+	CredentialSecrets bool
+	// EmptyAsAbsent treats ConfigMaps and Secrets without any data as if
+	// they were not there: references to them are unresolved, so nothing is
+	// injected for them and Strict and RequireAllReferenced report them,
+	// as empty rather than missing.
+	EmptyAsAbsent bool
+	// IgnoredSources names ConfigMaps and Secrets that are expected to be
+	// missing from the input, such as those a service mesh injects into
+	// every namespace. They are still injected when present, but never
+	// reported as unresolved by Strict or RequireAllReferenced. Nil means
+	// DefaultIgnoredSources; an empty slice ignores nothing.
+	IgnoredSources []string
+	// Strict fails the run when a workload has a required reference that
+	// cannot be resolved from the input, or Pod template annotations over
+	// the 256KiB Kubernetes accepts, which are otherwise only warned about.
+	// All problems are reported together unless FailFast is set.
+	Strict bool
+	// SkipBadDocs passes documents that are not valid YAML through to the
+	// output verbatim, logging their position in the stream, instead of
+	// rejecting the whole input. The remaining documents are processed as
+	// usual.
+	SkipBadDocs bool
+	// PreserveEmptyDocs keeps empty documents, e.g. those between two
+	// consecutive "---" markers, in the output instead of dropping them, so
+	// the output has as many documents as the input. They are never
+	// processed.
+	PreserveEmptyDocs bool
+	// OutputOrder selects the order documents are written in. Empty means
+	// OrderPreserve.
+	OutputOrder OutputOrder
+	// DocStart emits a "---" marker before the first document too, for
+	// parsers that expect every document to be introduced by one.
+	DocStart bool
+	// AnnotateSource adds a line comment naming the source object to every
+	// injected key, e.g. "# from ConfigMap app-config", for human review.
+	AnnotateSource bool
+	// RequireAllReferenced fails the run when any workload ends up without a
+	// checksum for one of its required references, naming the workload and
+	// how many of its references are covered. Sources excluded on purpose,
+	// such as immutable ones under SkipImmutable, count as covered.
+	RequireAllReferenced bool
+	// WarnIdenticalSources logs differently named ConfigMaps, or Secrets,
+	// whose data is identical, which often hints at a copy-paste mistake.
+	WarnIdenticalSources bool
+	// FailFast stops at the first problem found by StrictDecode, Strict or
+	// RequireAllReferenced instead of collecting all of them.
+	FailFast bool
+	// Canonicalize re-renders every document in a uniform style (sorted map
+	// keys, block collections, default scalar quoting) instead of preserving
+	// the input formatting of untouched nodes.
+	Canonicalize bool
+	// AnnotateSources writes each ConfigMap and Secret's own checksum to its
+	// SelfAnnotation, so it can be compared with the checksums on workloads.
+	// Sources that are not hashed, such as unreferenced ones under
+	// OnlyIfReferenced, are left alone.
+	AnnotateSources bool
+	// Compact renders the collections below each document's top-level keys
+	// in flow style, e.g. "metadata: {name: app}", to reduce the line
+	// count. Collections holding comments stay in block style, since flow
+	// style cannot carry them. It is applied after Canonicalize.
+	Compact bool
+	// ExtraAnnotations are written to every workload's Pod template next to
+	// the checksums, into the labels or annotations each target writes to,
+	// whether or not it references any ConfigMap or Secret, e.g. to stamp a
+	// build ID in the same pass.
+	ExtraAnnotations map[string]string
+	// GenerationCounter keeps a count of checksum changes in the
+	// GenerationAnnotation of every Pod template: it is incremented when the
+	// workload's checksums are added, changed or pruned, and left alone
+	// otherwise. Since changes are detected against the checksums already in
+	// the input, it only counts across runs that are fed the previous output.
+	GenerationCounter bool
+	// BaseManifests holds manifests, e.g. a base directory that is applied
+	// separately, whose ConfigMaps and Secrets resolve references like those
+	// in the input but are not written to the output. Sources in the input
+	// take precedence over base sources of the same namespace and name.
+	BaseManifests string
+	// Lookup, when set, is asked for referenced ConfigMaps and Secrets that
+	// are not in the input, e.g. to resolve them from a live cluster.
+	Lookup SourceLookup
+	// Timeout bounds each Lookup call. Zero means no limit.
+	Timeout time.Duration
+	// UseResourceVersion uses the metadata.resourceVersion of objects
+	// returned by Lookup as their checksum instead of hashing their content.
+	// It changes on every write, including no-op updates. Sources in the
+	// input have no meaningful resourceVersion and are always hashed.
+	UseResourceVersion bool
+	// Offline guarantees that references are only resolved from the input:
+	// Lookup is never called, even when set.
+	Offline bool
+	// Workers is the number of goroutines ConfigMaps and Secrets are hashed
+	// on. Zero means GOMAXPROCS; one hashes sequentially. The result does not
+	// depend on it.
+	Workers int
+	// Cache, when set, remembers the digests of sources that carry a uid and
+	// resourceVersion, as exported from a cluster, so unchanged revisions are
+	// not digested again on repeated runs. Checksums are the same with and
+	// without it, as long as sources are not edited without dropping their
+	// resourceVersion.
+	Cache DigestCache
+	// Metrics, when set, counts processed workloads, injected checksums and
+	// unresolved references. It can be shared across runs.
+	Metrics *Metrics
+	// Logger receives warnings and verbose progress messages. A nil Logger
+	// discards them.
+	Logger *slog.Logger
+}
+
+func (o Options) logger() *slog.Logger {
+	if o.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return o.Logger
+}
+
+// checksumKeyPrefix is the prefix shared by every injected key.
+const checksumKeyPrefix = "checksum/"
+
+// Result describes the outcome of an injection run.
+type Result struct {
+	// Output is the rendered manifest stream.
+	Output string
+	// Changed lists the workloads whose checksums were added or updated, in
+	// input order.
+	Changed []WorkloadRef
+	// GlobalDigest is a single checksum over every ConfigMap and Secret in
+	// the input. It is not injected anywhere; compare it across environments
+	// to tell whether all configuration is identical. It is built from the
+	// whole, unsalted digest of each source, so Salt and HashLength do not
+	// change it.
+	GlobalDigest string
+	// References lists, per workload in input order, every reference found
+	// in its Pod template and what it resolved to.
+	References []WorkloadReferences
+	// Keys lists every checksum key written to a Pod template, per workload
+	// in input order and per target.
+	Keys []InjectedKey
+	// Patches holds, for each changed workload in input order, the JSON Patch
+	// that applies its checksum changes to the input object.
+	Patches []WorkloadPatch
+	// KeyChanges lists every checksum key added, updated or pruned, per
+	// workload in input order.
+	KeyChanges []KeyChange
+}
+
+// KeyChange is one checksum key added, updated or pruned in a workload's Pod
+// template.
+type KeyChange struct {
+	Workload WorkloadRef
+	// Op is "add", "update" or "remove".
+	Op string
+	// Field is the Pod template metadata field, "labels" or "annotations".
+	Field string
+	Key   string
+	// Old is the previous value; it is empty for an added key.
+	Old string
+	// New is the injected value; it is empty for a removed key.
+	New string
+}
+
+// InjectedKey is one checksum key written to a workload's Pod template.
+type InjectedKey struct {
+	Workload WorkloadRef
+	// Field is the Pod template metadata field, "labels" or "annotations".
+	Field string
+	Key   string
+	Value string
+}
+
+// WorkloadReferences is the resolved reference list of one workload.
+type WorkloadReferences struct {
+	Workload   WorkloadRef
+	References []ResolvedReference
+}
+
+// ResolvedReference is a reference together with the source it resolved to.
+type ResolvedReference struct {
+	Reference
+	// Resolved reports whether the referenced object was found.
+	Resolved bool
+	// Checksum is the injected checksum. It is empty when the reference is
+	// unresolved or its source is excluded from injection.
+	Checksum string
+	// Ignored reports whether the name is in Options.IgnoredSources. An
+	// ignored reference that is not resolved is never reported as missing.
+	Ignored bool
+	// Unrendered reports that the reference is not resolved and its name
+	// holds template markers such as "${" or "{{", so the input looks like
+	// it was not rendered. Such a reference is warned about instead of being
+	// reported as missing.
+	Unrendered bool
+	// Empty reports that the reference is not resolved because its source
+	// has no data and Options.EmptyAsAbsent is set.
+	Empty bool
+	// HashedKeys lists the data keys Checksum covers under
+	// Options.PreciseKeys, in the order they are digested: sorted, or in
+	// document order for ConfigMaps under OrderSensitive. Excluded keys are
+	// not listed. It is nil when Checksum covers the whole object.
+	HashedKeys []string
+}
+
+// WorkloadRef identifies a workload document in the input.
+type WorkloadRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// String renders the reference as kind/namespace/name, omitting an empty
+// namespace.
+func (w WorkloadRef) String() string {
+	if w.Namespace == "" {
+		return w.Kind + "/" + w.Name
+	}
+	return w.Kind + "/" + w.Namespace + "/" + w.Name
+}
+
 // InjectChecksums processes the provided Kubernetes manifests and injects
-// checksum markers for referenced ConfigMaps and Secrets into Deployment
-// templates. The returned string preserves the YAML document structure of the
-// input.
+// checksum markers for referenced ConfigMaps and Secrets into the Pod
+// templates of the workload kinds listed by SupportedKinds. The returned
+// string preserves the YAML document structure of the input.
 func InjectChecksums(input string, mode Mode) (string, error) {
-	if mode != ModeLabel && mode != ModeAnnotation {
-		return "", fmt.Errorf("invalid mode: %s (must be 'label' or 'annotation')", mode)
+	return InjectChecksumsWithOptions(input, Options{Mode: mode})
+}
+
+// InjectChecksumsWithOptions behaves like InjectChecksums but accepts the full
+// set of Options.
+func InjectChecksumsWithOptions(input string, opts Options) (string, error) {
+	res, err := Inject(input, opts)
+	if err != nil {
+		return "", err
 	}
+	return res.Output, nil
+}
 
-	decoder := yaml.NewDecoder(strings.NewReader(input))
-	var docs []*yaml.Node
+// Inject processes the manifests like InjectChecksumsWithOptions and
+// additionally reports which workloads were modified.
+func Inject(input string, opts Options) (*Result, error) {
+	res, docs, err := process(strings.NewReader(input), opts)
+	if err != nil {
+		return nil, err
+	}
+	var out strings.Builder
+	if err := writeDocuments(&out, docs, opts); err != nil {
+		return nil, err
+	}
+	res.Output = out.String()
+	if opts.SelfCheck {
+		if err := selfCheck(res.Output, res.Keys, opts); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
 
-	for {
-		doc := &yaml.Node{}
-		err := decoder.Decode(doc)
-		if err == io.EOF {
-			break
+// InjectStream behaves like Inject but reads the manifests from r and writes
+// the rendered stream to w. Sources may follow the workloads that reference
+// them, so every document is decoded before anything is written; nothing is
+// written when processing fails.
+func InjectStream(r io.Reader, w io.Writer, opts Options) error {
+	res, docs, err := process(r, opts)
+	if err != nil {
+		return err
+	}
+	if !opts.SelfCheck {
+		return writeDocuments(w, docs, opts)
+	}
+	var out strings.Builder
+	if err := writeDocuments(&out, docs, opts); err != nil {
+		return err
+	}
+	if err := selfCheck(out.String(), res.Keys, opts); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, out.String())
+	return err
+}
+
+// Validate reports the first setting of o that Inject rejects before
+// reading any input, such as an invalid target, hash length or selector.
+func (o Options) Validate() error {
+	_, err := o.parse()
+	return err
+}
+
+// parsedOptions holds the settings of Options that are parsed once per run.
+type parsedOptions struct {
+	templates    keyTemplates
+	templatePath []string
+	selector     labels.Selector
+}
+
+// parse validates o and parses the settings a run needs in parsed form.
+func (o Options) parse() (parsedOptions, error) {
+	var p parsedOptions
+	for _, t := range o.targets() {
+		if err := validateTarget(t); err != nil {
+			return p, err
 		}
-		if err != nil {
-			return "", fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if err := validateInfixes(o); err != nil {
+		return p, err
+	}
+	if err := validateHashLength(o); err != nil {
+		return p, err
+	}
+	if err := validateOutputOrder(o.OutputOrder); err != nil {
+		return p, err
+	}
+	var err error
+	if p.templates, err = parseKeyTemplates(o); err != nil {
+		return p, err
+	}
+	if p.templatePath, err = parsePodTemplatePath(o.PodTemplatePath); err != nil {
+		return p, err
+	}
+	if o.Selector != "" {
+		if p.selector, err = labels.Parse(o.Selector); err != nil {
+			return p, fmt.Errorf("invalid selector %q: %w", o.Selector, err)
 		}
-		if isEmptyDocument(doc) {
-			continue
+	}
+	return p, nil
+}
+
+// process decodes the manifests from r and injects checksums into the
+// decoded documents, which it returns for rendering. Result.Output is left
+// empty.
+func process(r io.Reader, opts Options) (*Result, []*yaml.Node, error) {
+	parsed, err := opts.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	templates, templatePath, selector := parsed.templates, parsed.templatePath, parsed.selector
+
+	log := opts.logger()
+	docs, err := decodeDocuments(r, opts, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	baseDocs, err := decodeStream(strings.NewReader(opts.BaseManifests), false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("base manifests: %w", err)
+	}
+	// Base documents come first so sources in the input override them.
+	position := func(i int) slog.Attr {
+		if i < len(baseDocs) {
+			return slog.Int("base_document", i)
 		}
-		docs = append(docs, doc)
+		return slog.Int("document", i-len(baseDocs))
 	}
 
+	problems := problemList{failFast: opts.FailFast}
 	var configMaps []*corev1.ConfigMap
+	var cmKeyOrders [][]string
 	var secrets []*corev1.Secret
-	var deployments []deploymentDoc
+	var workloads []workloadDoc
+	// sourceDocs maps sources from the input, not the base manifests, to
+	// their documents for AnnotateSources.
+	sourceDocs := map[interface{}]*yaml.Node{}
 
-	for _, doc := range docs {
-		switch getKind(doc) {
+	for i, doc := range append(baseDocs, docs...) {
+		kind := getKind(doc)
+		switch kind {
 		case "ConfigMap":
-			cm := &corev1.ConfigMap{}
-			if err := decodeDocument(doc, cm); err == nil {
-				configMaps = append(configMaps, cm)
+			cm, order, err := decodeConfigMapDocument(doc, opts)
+			if err != nil {
+				if opts.StrictDecode {
+					if problems.add(fmt.Errorf("failed to decode ConfigMap: %w", err)) {
+						return nil, nil, problems.err()
+					}
+					continue
+				}
+				log.Warn("skipping document that failed to decode", "kind", kind, position(i), "error", err)
+				continue
+			}
+			configMaps = append(configMaps, cm)
+			if i >= len(baseDocs) {
+				sourceDocs[cm] = doc
 			}
+			cmKeyOrders = append(cmKeyOrders, order)
 		case "Secret":
-			s := &corev1.Secret{}
-			if err := decodeDocument(doc, s); err == nil {
-				secrets = append(secrets, s)
+			s, err := decodeSecretDocument(doc, opts)
+			if err != nil {
+				if opts.StrictDecode {
+					if problems.add(fmt.Errorf("failed to decode Secret: %w", err)) {
+						return nil, nil, problems.err()
+					}
+					continue
+				}
+				log.Warn("skipping document that failed to decode", "kind", kind, position(i), "error", err)
+				continue
 			}
-		case "Deployment":
-			dep := &appsv1.Deployment{}
-			if err := decodeDocument(doc, dep); err == nil {
-				deployments = append(deployments, deploymentDoc{node: doc, obj: dep})
+			secrets = append(secrets, s)
+			if i >= len(baseDocs) {
+				sourceDocs[s] = doc
 			}
+		default:
+			wk, ok := lookupWorkloadKind(scalarAt(documentRoot(doc), "apiVersion"), kind)
+			if !ok {
+				wk, ok = genericWorkloadKind(doc, kind, templatePath)
+			}
+			if !ok || i < len(baseDocs) {
+				continue
+			}
+			w, err := decodeWorkload(doc, wk)
+			if err != nil {
+				log.Warn("skipping document that failed to decode", "kind", kind, position(i), "error", err)
+				continue
+			}
+			w.ref.Namespace = opts.namespace(w.ref.Namespace)
+			workloads = append(workloads, w)
 		}
 	}
 
-	cmHashes := make(map[string]string, len(configMaps))
-	for _, cm := range configMaps {
-		if cm.Name == "" {
-			continue
+	allConfigMaps, allSecrets := configMaps, secrets
+	if opts.OnlyIfReferenced {
+		configMaps, cmKeyOrders, secrets = onlyReferenced(workloads, configMaps, cmKeyOrders, secrets, opts)
+	}
+
+	// Hashing is the only expensive step, so it runs on the worker pool;
+	// everything order-dependent happens below on the collected sums.
+	// The global digest is over unsalted, whole digests, which only need
+	// hashing separately when the injected checksums are salted or cut.
+	cmSums := make([]string, len(configMaps))
+	secretSums := make([]string, len(secrets))
+	cmContent := make([]string, len(configMaps))
+	secretContent := make([]string, len(secrets))
+	contentOpts, separateContent := opts.contentOptions()
+	forEach(len(configMaps)+len(secrets), opts.Workers, func(i int) {
+		if i < len(configMaps) {
+			keys := sortedKeys(configMaps[i].Data)
+			if opts.OrderSensitive {
+				keys = cmKeyOrders[i]
+			}
+			cmSums[i] = hashConfigMapKeys(configMaps[i], keys, opts)
+			cmContent[i] = cmSums[i]
+			if separateContent {
+				cmContent[i] = hashConfigMapKeys(configMaps[i], keys, contentOpts)
+			}
+			return
+		}
+		i -= len(configMaps)
+		secretSums[i] = hashSecret(secrets[i], opts)
+		secretContent[i] = secretSums[i]
+		if separateContent {
+			secretContent[i] = hashSecret(secrets[i], contentOpts)
+		}
+	})
+
+	if opts.AnnotateSources {
+		for i, cm := range configMaps {
+			annotateSelf(sourceDocs[cm], cmSums[i])
+		}
+		for i, s := range secrets {
+			annotateSelf(sourceDocs[s], secretSums[i])
+		}
+	}
+
+	var sources []sourceDigest
+	cmHashes := newSourceHashes()
+	for i, cm := range configMaps {
+		sum := cmSums[i]
+		sources = append(sources, sourceDigest{KindConfigMap, cm.Namespace, cm.Name, cmContent[i]})
+		if cm.Name != "" {
+			cmHashes.set(cm.Namespace, cm.Name, configMapChecksum(cm, sum, opts))
+		}
+	}
+	for name, path := range opts.FileRefs {
+		cm, err := fileConfigMap(name, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmHashes.override(name, hashConfigMap(cm, opts))
+	}
+
+	secretHashes := newSourceHashes()
+	for i, s := range secrets {
+		sum := secretSums[i]
+		sources = append(sources, sourceDigest{KindSecret, s.Namespace, s.Name, secretContent[i]})
+		if s.Name != "" {
+			secretHashes.set(s.Namespace, s.Name, secretChecksum(s, sum, opts))
+		}
+	}
+
+	if opts.WarnIdenticalSources {
+		warnIdenticalSources(log, allConfigMaps, allSecrets, opts)
+	}
+
+	if opts.StripNameSuffix {
+		for _, cm := range configMaps {
+			cmHashes.addSuffixAlias(sourceID{cm.Namespace, cm.Name})
 		}
-		cmHashes[cm.Name] = hashConfigMap(cm)
+		for _, s := range secrets {
+			secretHashes.addSuffixAlias(sourceID{s.Namespace, s.Name})
+		}
+	}
+
+	if opts.Lookup != nil && !opts.Offline {
+		lookupMissing(workloads, cmHashes, secretHashes, opts)
 	}
 
-	secretHashes := make(map[string]string, len(secrets))
-	for _, s := range secrets {
-		if s.Name == "" {
+	var precise *preciseSources
+	if opts.PreciseKeys {
+		precise = newPreciseSources(configMaps, cmKeyOrders, secrets, opts)
+	}
+
+	res := &Result{GlobalDigest: globalDigest(sources)}
+	for _, w := range workloads {
+		ref := w.ref
+		if opts.SkipZeroReplicas && w.scaledToZero() {
+			log.Info("skipping workload scaled to zero", "workload", ref.String())
+			continue
+		}
+		if selector != nil && !selector.Matches(labels.Set(w.labels())) {
+			log.Info("skipping workload not matching the selector", "workload", ref.String())
 			continue
 		}
-		secretHashes[s.Name] = hashSecret(s)
+		for _, volume := range unnamedVolumes(w.spec) {
+			log.Info("ignoring ConfigMap or Secret volume without a name", "workload", ref.String(), "volume", volume)
+		}
+		for _, r := range unnamedKeyRefs(w.spec) {
+			log.Info("ignoring env var whose key reference has no name", "workload", ref.String(), "container", r.container, "env", r.env)
+		}
+		snap := snapshotMetadata(w)
+		update := processWorkloadDoc(w, cmHashes, secretHashes, precise, templates, opts)
+		warned := map[Reference]bool{}
+		for _, r := range update.references {
+			if r.Unrendered && !warned[r.Reference] {
+				warned[r.Reference] = true
+				log.Warn("reference name contains template markers; the input appears unrendered", "workload", ref.String(), "kind", r.Kind, "name", r.Name)
+			}
+		}
+		opts.Metrics.observe(update)
+		if update.changed {
+			log.Info("updated checksums", "workload", ref.String())
+			res.Changed = append(res.Changed, ref)
+			res.Patches = append(res.Patches, WorkloadPatch{
+				Workload:           ref,
+				Operations:         snap.patch(w),
+				ApplyConfiguration: applyConfiguration(w, update.keys, update.extra(opts)),
+			})
+		}
+		res.References = append(res.References, WorkloadReferences{Workload: ref, References: update.references})
+		res.Keys = append(res.Keys, update.keys...)
+		res.KeyChanges = append(res.KeyChanges, update.changes...)
+		if problems.add(update.errs...) {
+			return nil, nil, problems.err()
+		}
+		if opts.Strict {
+			if problems.add(unresolvedErrors(ref, update.references, cmHashes, secretHashes)...) {
+				return nil, nil, problems.err()
+			}
+		}
+		if err := annotationSizeError(w); err != nil {
+			if !opts.Strict {
+				log.Warn(err.Error())
+			} else if problems.add(err) {
+				return nil, nil, problems.err()
+			}
+		}
+		if opts.RequireAllReferenced {
+			if err := incompleteError(ref, update.references); err != nil {
+				if problems.add(err) {
+					return nil, nil, problems.err()
+				}
+			}
+		}
+	}
+	if err := problems.err(); err != nil {
+		return nil, nil, err
 	}
+	return res, docs, nil
+}
+
+// totalAnnotationSizeLimit is the combined size of annotation keys and
+// values the API server accepts on one object.
+const totalAnnotationSizeLimit = 256 * 1024
 
-	for _, dep := range deployments {
-		processDeploymentDoc(dep, cmHashes, secretHashes, mode)
+// annotationSizeError reports Pod template annotations of w that add up to
+// more than the API server accepts, which would get the workload rejected.
+func annotationSizeError(w workloadDoc) error {
+	size := 0
+	for k, v := range stringMap(findMap(documentRoot(w.node), w.kind.metadataPath("annotations")...)) {
+		size += len(k) + len(v)
+	}
+	if size <= totalAnnotationSizeLimit {
+		return nil
 	}
+	return fmt.Errorf("%s: Pod template annotations total %d bytes, more than the %d bytes Kubernetes accepts", w.ref, size, totalAnnotationSizeLimit)
+}
 
-	var buf bytes.Buffer
-	encoder := yaml.NewEncoder(&buf)
-	encoder.SetIndent(2)
-	for _, doc := range docs {
-		if err := encoder.Encode(doc); err != nil {
-			return "", fmt.Errorf("failed to render YAML: %w", err)
+// namespace returns ns, or DefaultNamespace when ns is empty.
+func (o Options) namespace(ns string) string {
+	if ns == "" {
+		return o.DefaultNamespace
+	}
+	return ns
+}
+
+// problemList collects the problems of a run so they can be reported
+// together, or stops at the first one when failFast is set.
+type problemList struct {
+	errs     []error
+	failFast bool
+}
+
+// add records errs and reports whether processing has to stop.
+func (p *problemList) add(errs ...error) bool {
+	p.errs = append(p.errs, errs...)
+	return p.failFast && len(p.errs) > 0
+}
+
+// err returns the recorded problems as one error, or only the first one in
+// fail-fast mode.
+func (p *problemList) err() error {
+	if p.failFast && len(p.errs) > 0 {
+		return p.errs[0]
+	}
+	return errors.Join(p.errs...)
+}
+
+// checksumEntry is a key name segment and the checksum stored under it.
+type checksumEntry struct {
+	name  string
+	value string
+	// key is the full key rendered from Options.KeyTemplate. When set, it is
+	// used as is instead of a target prefix followed by name.
+	key string
+	// source describes the object the checksum belongs to, e.g.
+	// "ConfigMap app-config".
+	source string
+	// data is what key templates are rendered from for this entry.
+	data KeyTemplateData
+}
+
+// keyFor returns the key the entry is written under for a target prefix.
+func (e checksumEntry) keyFor(prefix string) string {
+	if e.key != "" {
+		return e.key
+	}
+	return prefix + e.name
+}
+
+// resolveChecksums resolves the references of a Pod spec in namespace
+// against the hash maps, as sourceHashes.resolve does, and returns the checksum entries to inject,
+// deduplicated by key, along with what each reference resolved to. Objects
+// known to precise, which may be nil, are digested over only the keys the
+// spec references. tmpl is the parsed KeyTemplate, if any. References whose
+// key template renders an illegal key, or the key of another object, are
+// reported as errors and not injected.
+func resolveChecksums(spec *corev1.PodSpec, namespace string, cmHashes, secretHashes sourceHashes, precise *preciseSources, tmpl *template.Template, opts Options) ([]checksumEntry, []ResolvedReference, []error) {
+	var updates []checksumEntry
+	var resolved []ResolvedReference
+	var errs []error
+	// seen maps each key to the object it was rendered for; references to
+	// the same object share it.
+	seen := map[string]string{}
+	cmInfix, secretInfix := opts.infixes()
+
+	refs := scopedReferences(spec, opts)
+	scopes := objectScopes(refs)
+	for _, scoped := range refs {
+		ref := scoped.Reference
+		hashes, infix := cmHashes, cmInfix
+		if ref.Kind == KindSecret {
+			hashes, infix = secretHashes, secretInfix
+		}
+		keyBase := ref.Name
+		if opts.StripNameSuffix {
+			keyBase = stripNameSuffix(ref.Name)
+		}
+		id, sum, ok := hashes.resolve(namespace, ref.Name)
+		if !ok {
+			id, sum, ok = hashes.resolve(namespace, keyBase)
+		}
+		empty := ok && sum == emptyChecksum
+		if empty {
+			sum, ok = "", false
+		}
+		var hashed []string
+		if keys := scopes[Reference{Kind: ref.Kind, Name: ref.Name}]; ok && sum != skippedChecksum && keys != nil {
+			if preciseSum, preciseKeys, known := precise.sum(ref.Kind, id, keys); known {
+				sum, hashed = preciseSum, preciseKeys
+			}
+		}
+		resolved = append(resolved, ResolvedReference{Reference: ref, Resolved: ok, Checksum: sum, Ignored: opts.ignored(ref.Name), Unrendered: !ok && unrendered(ref.Name), Empty: empty, HashedKeys: hashed})
+		if !ok || sum == skippedChecksum {
+			continue
+		}
+		entry := checksumEntry{
+			name:   keyName(infix, keyBase),
+			value:  sum,
+			source: ref.Kind + " " + ref.Name,
+			data:   KeyTemplateData{Kind: ref.Kind, Name: ref.Name, SanitizedName: sanitizeKey(keyBase), Namespace: namespace},
+		}
+		if tmpl != nil {
+			key, err := renderKey(tmpl, entry.data)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			entry.key = key
+		}
+		key, object := entry.keyFor(""), ref.Kind+" "+keyBase
+		if other, dup := seen[key]; dup {
+			if other != object {
+				errs = append(errs, fmt.Errorf("%s and %s both have the key %q; only the first is injected", other, object, key))
+			}
+			continue
 		}
+		seen[key] = object
+		updates = append(updates, entry)
 	}
-	if err := encoder.Close(); err != nil {
-		return "", fmt.Errorf("failed to finalize YAML output: %w", err)
+	return updates, resolved, errs
+}
+
+// sortedKeys returns the keys of m in lexical order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
+
+// prunePrefixes returns the key prefixes Prune removes stale keys under.
+func prunePrefixes(targets []Target) []string {
+	prefixes := []string{checksumKeyPrefix}
+	for _, t := range targets {
+		prefixes = append(prefixes, t.Prefix)
+	}
+	return prefixes
+}
 
-	return buf.String(), nil
+// workloadUpdate is the outcome of processing one workload.
+type workloadUpdate struct {
+	// changed reports whether any key was added, changed or pruned.
+	changed    bool
+	references []ResolvedReference
+	keys       []InjectedKey
+	changes    []KeyChange
+	// errs are the problems that kept checksums from being injected.
+	errs []error
+	// generation is the GenerationAnnotation after the update, if any.
+	generation string
 }
 
-func processDeploymentDoc(dep deploymentDoc, cmHashes, secretHashes map[string]string, mode Mode) {
-	cmRefs, secretRefs := referencedObjects(dep.obj)
+// processWorkloadDoc injects checksums for the workload's references into its
+// Pod template and reports what changed and what each reference resolved to.
+func processWorkloadDoc(w workloadDoc, cmHashes, secretHashes sourceHashes, precise *preciseSources, templates keyTemplates, opts Options) workloadUpdate {
+	updates, resolved, errs := resolveChecksums(w.spec, w.ref.Namespace, cmHashes, secretHashes, precise, templates.key, opts)
 
-	type pair struct {
-		key   string
-		value string
+	res := workloadUpdate{references: resolved}
+	for _, err := range errs {
+		res.errs = append(res.errs, fmt.Errorf("%s: %w", w.ref, err))
+	}
+	root := documentRoot(w.node)
+	if root == nil {
+		return res
 	}
 
-	var updates []pair
+	// A field that is not a mapping is reported and skipped; the other
+	// fields are still written and pruned.
+	targets := opts.targets()
+	keep := map[string]bool{}
+	if len(updates) > 0 {
+		for _, t := range targets {
+			field := metadataField(t.Mode)
+			target := ensureMap(root, w.kind.metadataPath(field)...)
+			if target == nil {
+				res.errs = append(res.errs, fmt.Errorf("%s: %w", w.ref, notMapError(root, w.kind.metadataPath(field)...)))
+				continue
+			}
 
-	for _, name := range cmRefs {
-		if sum, ok := cmHashes[name]; ok {
-			updates = append(updates, pair{
-				key:   fmt.Sprintf("checksum/configmap-%s", sanitizeKey(name)),
-				value: sum,
-			})
+			for _, update := range updates {
+				key := update.keyFor(t.Prefix)
+				keep[field+"/"+key] = true
+				if opts.OnlyMissing && hasKey(target, key) {
+					continue
+				}
+				res.keys = append(res.keys, InjectedKey{Workload: w.ref, Field: field, Key: key, Value: update.value})
+				if old, existed := scalarAt(target, key), hasKey(target, key); !existed {
+					res.changes = append(res.changes, KeyChange{Workload: w.ref, Op: "add", Field: field, Key: key, New: update.value})
+				} else if old != update.value {
+					res.changes = append(res.changes, KeyChange{Workload: w.ref, Op: "update", Field: field, Key: key, Old: old, New: update.value})
+				}
+				comment := ""
+				if opts.AnnotateSource {
+					comment = "# from " + update.source
+				}
+				if opts.ExistingKeyFormat == "" {
+					if setStringMapValue(target, key, update.value, comment) {
+						res.changed = true
+					}
+					continue
+				}
+				existingKey, err := update.existingKey(opts.ExistingKeyFormat, templates.existing)
+				if err != nil {
+					res.errs = append(res.errs, fmt.Errorf("%s: %w", w.ref, err))
+				}
+				if err != nil || scalarAt(target, existingKey) != update.value {
+					res.changed = true
+				}
+				setStringMapValue(target, key, update.value, comment)
+			}
 		}
 	}
 
-	for _, name := range secretRefs {
-		if sum, ok := secretHashes[name]; ok {
-			updates = append(updates, pair{
-				key:   fmt.Sprintf("checksum/secret-%s", sanitizeKey(name)),
-				value: sum,
-			})
+	checksumsChanged := res.changed
+
+	for _, field := range opts.extraFields() {
+		target := ensureMap(root, w.kind.metadataPath(field)...)
+		if target == nil {
+			// Reported above when there were checksums to write.
+			if len(updates) == 0 {
+				res.errs = append(res.errs, fmt.Errorf("%s: %w", w.ref, notMapError(root, w.kind.metadataPath(field)...)))
+			}
+			continue
+		}
+		for _, key := range sortedKeys(opts.ExtraAnnotations) {
+			keep[field+"/"+key] = true
+			if setStringMapValue(target, key, opts.ExtraAnnotations[key], "") {
+				res.changed = true
+			}
 		}
 	}
 
-	if len(updates) == 0 {
-		return
+	if opts.GenerationCounter {
+		keep["annotations/"+GenerationAnnotation] = true
 	}
 
-	root := documentRoot(dep.node)
-	if root == nil {
-		return
+	if opts.Prune {
+		prefixes := prunePrefixes(targets)
+		for _, mode := range []Mode{ModeLabel, ModeAnnotation} {
+			field := metadataField(mode)
+			m := findMap(root, w.kind.metadataPath(field)...)
+			if m == nil || m.Kind != yaml.MappingNode {
+				continue
+			}
+			before := stringMap(m)
+			if pruneChecksumKeys(m, prefixes, func(key string) bool { return keep[field+"/"+key] }) {
+				res.changed = true
+				checksumsChanged = true
+				after := stringMap(m)
+				for _, key := range sortedKeys(before) {
+					if _, ok := after[key]; !ok {
+						res.changes = append(res.changes, KeyChange{Workload: w.ref, Op: "remove", Field: field, Key: key, Old: before[key]})
+					}
+				}
+			}
+		}
 	}
 
-	var target *yaml.Node
-	switch mode {
-	case ModeLabel:
-		target = ensureMap(root, "spec", "template", "metadata", "labels")
-	case ModeAnnotation:
-		target = ensureMap(root, "spec", "template", "metadata", "annotations")
-	default:
-		return
+	if opts.GenerationCounter {
+		if checksumsChanged {
+			if err := bumpGeneration(root, w.kind.metadataPath("annotations")); err != nil {
+				res.errs = append(res.errs, fmt.Errorf("%s: %w", w.ref, err))
+			}
+		}
+		res.generation = scalarAt(findMap(root, w.kind.metadataPath("annotations")...), GenerationAnnotation)
 	}
-	if target == nil {
-		return
+	return res
+}
+
+// extraFields returns the Pod template metadata fields ExtraAnnotations are
+// written to: those of the targets, each once, in target order.
+func (o Options) extraFields() []string {
+	if len(o.ExtraAnnotations) == 0 {
+		return nil
 	}
+	var fields []string
+	seen := map[string]bool{}
+	for _, t := range o.targets() {
+		if field := metadataField(t.Mode); !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
 
-	for _, update := range updates {
-		setStringMapValue(target, update.key, update.value)
+// extra returns the entries written to the workload besides its checksums,
+// by metadata field: ExtraAnnotations and the GenerationAnnotation.
+func (u workloadUpdate) extra(opts Options) map[string]map[string]string {
+	extra := map[string]map[string]string{}
+	for _, field := range opts.extraFields() {
+		extra[field] = opts.ExtraAnnotations
 	}
+	if u.generation != "" {
+		annotations := map[string]string{GenerationAnnotation: u.generation}
+		for k, v := range extra["annotations"] {
+			annotations[k] = v
+		}
+		extra["annotations"] = annotations
+	}
+	return extra
 }
 
-type deploymentDoc struct {
-	node *yaml.Node
-	obj  *appsv1.Deployment
+// GenerationAnnotation counts, under Options.GenerationCounter, how many
+// times the checksums of a Pod template have changed.
+const GenerationAnnotation = "checksum-injector.komailo.io/generation"
+
+// bumpGeneration increments the GenerationAnnotation of the annotations at
+// path, starting from 1 when it is not set yet.
+func bumpGeneration(root *yaml.Node, path []string) error {
+	annotations := ensureMap(root, path...)
+	if annotations == nil {
+		return notMapError(root, path...)
+	}
+	generation := 0
+	if value := scalarAt(annotations, GenerationAnnotation); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s annotation %q: must be a non-negative integer", GenerationAnnotation, value)
+		}
+		generation = n
+	}
+	setStringMapValue(annotations, GenerationAnnotation, strconv.Itoa(generation+1), "")
+	return nil
 }
 
-func decodeDocument(doc *yaml.Node, out interface{}) error {
-	root := documentRoot(doc)
-	if root == nil {
-		return fmt.Errorf("empty document")
+// unresolvedErrors describes the required references of workload that could
+// not be resolved. A name that only exists as the other kind of source gets a
+// targeted message, since that usually means the reference uses the wrong
+// field (e.g. secretKeyRef instead of configMapKeyRef).
+func unresolvedErrors(workload WorkloadRef, refs []ResolvedReference, cmHashes, secretHashes sourceHashes) []error {
+	required := map[Reference]bool{}
+	var errs []error
+	for _, ref := range refs {
+		if ref.Resolved || ref.Optional || ref.Ignored {
+			continue
+		}
+		key := Reference{Kind: ref.Kind, Name: ref.Name}
+		if required[key] {
+			continue
+		}
+		required[key] = true
+
+		if ref.Unrendered {
+			errs = append(errs, fmt.Errorf("%s: %s %q: reference name contains template markers; the input appears unrendered", workload, ref.Kind, ref.Name))
+			continue
+		}
+		if ref.Empty {
+			errs = append(errs, fmt.Errorf("%s: %s %q is empty, which counts as absent", workload, ref.Kind, ref.Name))
+			continue
+		}
+		other, otherKind := secretHashes, KindSecret
+		if ref.Kind == KindSecret {
+			other, otherKind = cmHashes, KindConfigMap
+		}
+		if _, _, ok := other.resolve(workload.Namespace, ref.Name); ok {
+			errs = append(errs, fmt.Errorf("%s: %s reference %q resolves to a %s", workload, ref.Kind, ref.Name, otherKind))
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s: %s %q not found in input", workload, ref.Kind, ref.Name))
 	}
-	data, err := yaml.Marshal(root)
+	return errs
+}
+
+// incompleteError reports the required references of workload that did not
+// resolve to a checksum, or nil if there are none.
+func incompleteError(workload WorkloadRef, refs []ResolvedReference) error {
+	required := map[Reference]bool{}
+	var missing []string
+	for _, ref := range refs {
+		if ref.Optional || (ref.Ignored && !ref.Resolved) {
+			continue
+		}
+		key := Reference{Kind: ref.Kind, Name: ref.Name}
+		if required[key] {
+			continue
+		}
+		required[key] = true
+		if ref.Empty {
+			missing = append(missing, ref.Kind+" "+ref.Name+" (empty)")
+		} else if ref.Unrendered {
+			missing = append(missing, ref.Kind+" "+ref.Name+" (name contains template markers; the input appears unrendered)")
+		} else if !ref.Resolved {
+			missing = append(missing, ref.Kind+" "+ref.Name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s: %d of %d required references have no checksum: %s", workload, len(missing), len(required), strings.Join(missing, ", "))
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataField returns the Pod template metadata field written in mode.
+func metadataField(mode Mode) string {
+	if mode == ModeAnnotation {
+		return "annotations"
+	}
+	return "labels"
+}
+
+// pruneChecksumKeys removes keys under any of prefixes from mapNode unless
+// keep reports them as still wanted, and reports whether anything was removed.
+func pruneChecksumKeys(mapNode *yaml.Node, prefixes []string, keep func(key string) bool) bool {
+	content := mapNode.Content[:0]
+	removed := false
+	for i := 0; i < len(mapNode.Content)-1; i += 2 {
+		key := mapNode.Content[i].Value
+		if hasAnyPrefix(key, prefixes) && !keep(key) {
+			removed = true
+			continue
+		}
+		content = append(content, mapNode.Content[i], mapNode.Content[i+1])
+	}
+	mapNode.Content = content
+	return removed
+}
+
+func decodeDocument(doc *yaml.Node, out interface{}) error {
+	data, err := marshalDocument(doc)
 	if err != nil {
 		return err
 	}
 	return sigyaml.Unmarshal(data, out)
 }
 
+// decodeSource decodes a ConfigMap or Secret document. When strict is set,
+// unknown or duplicate fields are reported as errors.
+func decodeSource(doc *yaml.Node, out interface{}, strict bool) error {
+	if !strict {
+		return decodeDocument(doc, out)
+	}
+	data, err := marshalDocument(doc)
+	if err != nil {
+		return err
+	}
+	return sigyaml.UnmarshalStrict(data, out)
+}
+
+// decodeConfigMapDocument decodes the ConfigMap in doc, defaulting its
+// namespace. order lists its data keys in document order under
+// OrderSensitive and is nil otherwise.
+func decodeConfigMapDocument(doc *yaml.Node, opts Options) (cm *corev1.ConfigMap, order []string, err error) {
+	cm = &corev1.ConfigMap{}
+	if err := decodeSource(doc, cm, opts.StrictDecode); err != nil {
+		return nil, nil, err
+	}
+	cm.Namespace = opts.namespace(cm.Namespace)
+	if opts.OrderSensitive {
+		order = mappingKeys(findMap(documentRoot(doc), "data"))
+	}
+	return cm, order, nil
+}
+
+// decodeSecretDocument decodes the Secret in doc, defaulting its namespace.
+func decodeSecretDocument(doc *yaml.Node, opts Options) (*corev1.Secret, error) {
+	s := &corev1.Secret{}
+	if err := decodeSource(doc, s, opts.StrictDecode); err != nil {
+		return nil, explainSecretDecodeError(doc, err)
+	}
+	s.Namespace = opts.namespace(s.Namespace)
+	return s, nil
+}
+
+func marshalDocument(doc *yaml.Node) ([]byte, error) {
+	root := documentRoot(doc)
+	if root == nil {
+		return nil, fmt.Errorf("empty document")
+	}
+	return yaml.Marshal(root)
+}
+
 func documentRoot(doc *yaml.Node) *yaml.Node {
 	if doc == nil {
 		return nil
@@ -208,6 +1259,10 @@ func getKind(doc *yaml.Node) string {
 	return ""
 }
 
+// ensureMap walks path from node and returns the mapping found there,
+// creating missing mappings and turning null values into empty mappings at
+// every level. It returns nil without modifying anything further when a step
+// holds any other kind of value.
 func ensureMap(node *yaml.Node, path ...string) *yaml.Node {
 	current := node
 	if current == nil || current.Kind != yaml.MappingNode {
@@ -226,119 +1281,440 @@ func ensureMap(node *yaml.Node, path ...string) *yaml.Node {
 			valueNode := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
 			current.Content = append(current.Content, keyNode, valueNode)
 			next = valueNode
-		} else if next.Kind != yaml.MappingNode {
+		} else if isNullNode(next) {
 			next.Kind = yaml.MappingNode
 			next.Tag = "!!map"
+			next.Style = 0
 			next.Value = ""
 			next.Content = nil
+		} else if next.Kind != yaml.MappingNode {
+			return nil
 		}
 		current = next
 	}
 	return current
 }
 
-func setStringMapValue(mapNode *yaml.Node, key, value string) {
+// notMapError explains why ensureMap returned nil for path: it names the
+// first step holding a value that is neither a mapping nor null.
+func notMapError(node *yaml.Node, path ...string) error {
+	current := node
+	for i, key := range path {
+		var next *yaml.Node
+		for j := 0; j+1 < len(current.Content); j += 2 {
+			if current.Content[j].Value == key {
+				next = current.Content[j+1]
+				break
+			}
+		}
+		if next == nil || isNullNode(next) {
+			break
+		}
+		if next.Kind != yaml.MappingNode {
+			what := "a sequence"
+			if next.Kind == yaml.ScalarNode {
+				what = fmt.Sprintf("the scalar %q", next.Value)
+			}
+			return fmt.Errorf("cannot inject into %s: %s is %s, not a mapping", strings.Join(path, "."), strings.Join(path[:i+1], "."), what)
+		}
+		current = next
+	}
+	return fmt.Errorf("cannot inject into %s: not a mapping", strings.Join(path, "."))
+}
+
+// findMap walks path from node and returns the mapping found there, or nil if
+// any step is missing or not a mapping. Unlike ensureMap it never modifies
+// the tree.
+func findMap(node *yaml.Node, path ...string) *yaml.Node {
+	current := node
+	for _, key := range path {
+		if current == nil || current.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i < len(current.Content)-1; i += 2 {
+			if current.Content[i].Value == key {
+				next = current.Content[i+1]
+				break
+			}
+		}
+		current = next
+	}
+	if current == nil || current.Kind != yaml.MappingNode {
+		return nil
+	}
+	return current
+}
+
+// setStringMapValue sets key to value in mapNode and reports whether the
+// stored value changed. An existing scalar keeps its quoting style, so only
+// the value itself differs in the output. A non-empty comment replaces the
+// line comment of the value; an empty one leaves any existing comment alone.
+func setStringMapValue(mapNode *yaml.Node, key, value, comment string) bool {
 	for i := 0; i < len(mapNode.Content)-1; i += 2 {
 		if mapNode.Content[i].Value == key {
-			mapNode.Content[i+1].Kind = yaml.ScalarNode
-			mapNode.Content[i+1].Tag = "!!str"
-			mapNode.Content[i+1].Style = 0
-			mapNode.Content[i+1].Value = value
-			return
+			existing := mapNode.Content[i+1]
+			changed := existing.Kind != yaml.ScalarNode || existing.Value != value
+			if existing.Kind != yaml.ScalarNode {
+				existing.Style = 0
+			}
+			existing.Kind = yaml.ScalarNode
+			existing.Tag = "!!str"
+			existing.Value = value
+			if comment != "" {
+				existing.LineComment = comment
+			}
+			return changed
 		}
 	}
 	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
-	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value, LineComment: comment}
 	mapNode.Content = append(mapNode.Content, keyNode, valueNode)
+	return true
+}
+
+// hasKey reports whether the mapping node has an entry for key.
+func hasKey(mapNode *yaml.Node, key string) bool {
+	for i := 0; i < len(mapNode.Content)-1; i += 2 {
+		if mapNode.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingKeys returns the keys of mapNode in document order. A nil or
+// non-mapping node has no keys.
+func mappingKeys(mapNode *yaml.Node) []string {
+	if mapNode == nil || mapNode.Kind != yaml.MappingNode {
+		return nil
+	}
+	keys := make([]string, 0, len(mapNode.Content)/2)
+	for i := 0; i+1 < len(mapNode.Content); i += 2 {
+		keys = append(keys, mapNode.Content[i].Value)
+	}
+	return keys
 }
 
+// isNullNode reports whether node is an explicit or implicit YAML null, such
+// as "~", "null" or a key without a value.
+func isNullNode(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null"
+}
+
+// isEmptyDocument reports whether doc has no content: nothing at all, or
+// only an implicit null as yaml.v3 decodes a bare "---". Documents that
+// carry a comment are kept.
 func isEmptyDocument(doc *yaml.Node) bool {
 	if doc == nil {
 		return true
 	}
-	if doc.Kind != yaml.DocumentNode {
+	if doc.Kind != yaml.DocumentNode || isRawDocument(doc) {
+		return false
+	}
+	if len(doc.Content) == 0 {
+		return true
+	}
+	if len(doc.Content) > 1 || hasComments(doc) {
 		return false
 	}
-	return len(doc.Content) == 0
+	root := doc.Content[0]
+	return root.Kind == yaml.ScalarNode && isNullNode(root) && root.Value == "" && !hasComments(root)
 }
 
-func referencedObjects(dep *appsv1.Deployment) (configMaps, secrets []string) {
-	cmSet := map[string]bool{}
-	secretSet := map[string]bool{}
+func hasComments(node *yaml.Node) bool {
+	return node.HeadComment != "" || node.LineComment != "" || node.FootComment != ""
+}
 
-	for _, v := range dep.Spec.Template.Spec.Volumes {
-		if v.ConfigMap != nil {
-			cmSet[v.ConfigMap.Name] = true
-		}
-		if v.Secret != nil {
-			secretSet[v.Secret.SecretName] = true
+// fileConfigMap builds the ConfigMap a file would become when rendered, keyed
+// by the file's base name.
+func fileConfigMap(name, path string) (*corev1.ConfigMap, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file reference %s: %w", name, err)
+	}
+	cm := &corev1.ConfigMap{Data: map[string]string{filepath.Base(path): string(content)}}
+	cm.Name = name
+	return cm, nil
+}
+
+// hashConfigMap digests the ConfigMap's name and data, prefixed by the
+// configured salt. The name is included so that two distinct ConfigMaps with
+// identical (e.g. empty) data still get distinct checksums, making a swap
+// between them visible.
+func hashConfigMap(cm *corev1.ConfigMap, opts Options) string {
+	return hashConfigMapKeys(cm, sortedKeys(cm.Data), opts)
+}
+
+// SelfAnnotation is where AnnotateSources writes a source's own checksum.
+const SelfAnnotation = "checksum-injector.komailo.io/self"
+
+// annotateSelf writes sum to the SelfAnnotation of the source document doc,
+// if any.
+func annotateSelf(doc *yaml.Node, sum string) {
+	root := documentRoot(doc)
+	if root == nil {
+		return
+	}
+	if annotations := ensureMap(root, "metadata", "annotations"); annotations != nil {
+		setStringMapValue(annotations, SelfAnnotation, sum, "")
+	}
+}
+
+// ExcludeKeysAnnotation lists, comma-separated, the data keys of a ConfigMap
+// that are left out of its checksum, e.g. a volatile timestamp that should
+// not roll workloads.
+const ExcludeKeysAnnotation = "checksum-injector.komailo.io/exclude-keys"
+
+// excludedKeys returns the data keys ExcludeKeysAnnotation lists on cm.
+func excludedKeys(cm *corev1.ConfigMap) map[string]bool {
+	value, ok := cm.Annotations[ExcludeKeysAnnotation]
+	if !ok {
+		return nil
+	}
+	excluded := map[string]bool{}
+	for _, k := range strings.Split(value, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			excluded[k] = true
 		}
 	}
+	return excluded
+}
 
-	for _, c := range dep.Spec.Template.Spec.Containers {
-		for _, e := range c.EnvFrom {
-			if e.ConfigMapRef != nil {
-				cmSet[e.ConfigMapRef.Name] = true
+// hashConfigMapKeys is hashConfigMap with the data keys digested in the given
+// order instead of sorted. Keys listed in ExcludeKeysAnnotation are skipped.
+func hashConfigMapKeys(cm *corev1.ConfigMap, keys []string, opts Options) string {
+	excluded := excludedKeys(cm)
+	return digest(opts, cacheKey(KindConfigMap, cm.ObjectMeta, keys, opts), func(h io.Writer) {
+		writeString(h, opts.Salt)
+		writeName(h, cm.Name)
+		for _, k := range keys {
+			if excluded[k] {
+				continue
 			}
-			if e.SecretRef != nil {
-				secretSet[e.SecretRef.Name] = true
+			writeString(h, k)
+			value := cm.Data[k]
+			if opts.TrimValues {
+				value = strings.TrimRightFunc(value, unicode.IsSpace)
 			}
+			writeString(h, value)
 		}
-		for _, e := range c.Env {
-			if e.ValueFrom != nil {
-				if e.ValueFrom.ConfigMapKeyRef != nil {
-					cmSet[e.ValueFrom.ConfigMapKeyRef.Name] = true
-				}
-				if e.ValueFrom.SecretKeyRef != nil {
-					secretSet[e.ValueFrom.SecretKeyRef.Name] = true
-				}
-			}
+		if opts.IncludeMetadata {
+			writeMetadata(h, cm.Labels, cm.Annotations, opts)
 		}
+	})
+}
+
+// hashSecret digests the Secret's name and data, like hashConfigMap.
+// stringData entries are folded into data first, overriding it as the API
+// server does, so a Secret hashes the same however its values are authored.
+func hashSecret(s *corev1.Secret, opts Options) string {
+	data := effectiveSecretData(s)
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return hashSecretKeys(s, data, keys, opts)
+}
 
-	for k := range cmSet {
-		if k != "" {
-			configMaps = append(configMaps, k)
+// hashSecretKeys is hashSecret over the given keys of data, the Secret's
+// effective data.
+func hashSecretKeys(s *corev1.Secret, data map[string][]byte, keys []string, opts Options) string {
+	return digest(opts, cacheKey(KindSecret, s.ObjectMeta, keys, opts), func(h io.Writer) {
+		writeString(h, opts.Salt)
+		writeName(h, s.Name)
+		for _, k := range keys {
+			writeString(h, k)
+			value := data[k]
+			if opts.TrimValues {
+				value = bytes.TrimRightFunc(value, unicode.IsSpace)
+			}
+			h.Write(value)
 		}
-	}
-	for k := range secretSet {
-		if k != "" {
-			secrets = append(secrets, k)
+		if opts.IncludeMetadata {
+			writeMetadata(h, s.Labels, s.Annotations, opts)
+		}
+	})
+}
+
+// volatileAnnotations change without the source's meaning changing, so they
+// are never part of a metadata digest.
+var volatileAnnotations = map[string]bool{
+	"kubectl.kubernetes.io/last-applied-configuration": true,
+	"kubectl.kubernetes.io/restartedAt":                true,
+	SelfAnnotation:                                     true,
+}
+
+// writeMetadata adds the labels and annotations of a source to h, leaving out
+// volatile annotations and keys under the injector's own prefixes, which
+// would otherwise feed checksums back into themselves.
+func writeMetadata(h io.Writer, labels, annotations map[string]string, opts Options) {
+	prefixes := prunePrefixes(opts.targets())
+	for _, field := range []struct {
+		name   string
+		values map[string]string
+	}{{"labels", labels}, {"annotations", annotations}} {
+		writeName(h, field.name)
+		for _, k := range sortedKeys(field.values) {
+			if volatileAnnotations[k] || hasAnyPrefix(k, prefixes) {
+				continue
+			}
+			writeName(h, k)
+			writeName(h, field.values[k])
 		}
 	}
-	sort.Strings(configMaps)
-	sort.Strings(secrets)
-	return
 }
 
-func hashConfigMap(cm *corev1.ConfigMap) string {
-	h := sha256.New()
-	keys := make([]string, 0, len(cm.Data))
-	for k := range cm.Data {
-		keys = append(keys, k)
+// effectiveSecretData returns the data the API server stores for s, with
+// stringData merged over data.
+func effectiveSecretData(s *corev1.Secret) map[string][]byte {
+	if len(s.StringData) == 0 {
+		return s.Data
 	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		h.Write([]byte(k))
-		h.Write([]byte(cm.Data[k]))
+	data := make(map[string][]byte, len(s.Data)+len(s.StringData))
+	for k, v := range s.Data {
+		data[k] = v
 	}
-	return hex.EncodeToString(h.Sum(nil))[:12]
+	for k, v := range s.StringData {
+		data[k] = []byte(v)
+	}
+	return data
 }
 
-func hashSecret(s *corev1.Secret) string {
-	h := sha256.New()
-	keys := make([]string, 0, len(s.Data))
-	for k := range s.Data {
-		keys = append(keys, k)
+// digestLength is the default number of hex characters of a digest kept in
+// a checksum.
+const digestLength = 12
+
+// encodeDigest renders the checksum value for a finished hash.
+func encodeDigest(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))[:digestLength]
+}
+
+// skippedChecksum marks a source that resolves references but must not be
+// injected.
+const skippedChecksum = ""
+
+// emptyChecksum marks a source without data that resolves no references
+// under EmptyAsAbsent. It is never a hex digest.
+const emptyChecksum = "empty"
+
+// sourceChecksum returns the value recorded for a source in the hash maps.
+func sourceChecksum(sum string, immutable *bool, empty bool, opts Options) string {
+	if opts.EmptyAsAbsent && empty {
+		return emptyChecksum
 	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		h.Write([]byte(k))
-		h.Write(s.Data[k])
+	if opts.SkipImmutable && immutable != nil && *immutable {
+		return skippedChecksum
+	}
+	return sum
+}
+
+// configMapChecksum is the checksum references to cm resolve to, given its
+// digest sum.
+func configMapChecksum(cm *corev1.ConfigMap, sum string, opts Options) string {
+	return sourceChecksum(sum, cm.Immutable, len(cm.Data) == 0 && len(cm.BinaryData) == 0, opts)
+}
+
+// secretChecksum is the checksum references to s resolve to, given its
+// digest sum.
+func secretChecksum(s *corev1.Secret, sum string, opts Options) string {
+	return sourceChecksum(sum, s.Immutable, len(effectiveSecretData(s)) == 0, opts)
+}
+
+// contentOptions returns opts without Salt and with whole digests, for
+// digests that identify a source's content whatever the injected checksums
+// look like. separate reports whether they differ from the digests under
+// opts.
+func (o Options) contentOptions() (content Options, separate bool) {
+	separate = o.Salt != "" || o.hashLength() != 2*sha256.Size
+	o.Salt = ""
+	o.HashLength = 2 * sha256.Size
+	return o, separate
+}
+
+// sourceDigest is the whole, unsalted digest of one ConfigMap or Secret.
+type sourceDigest struct {
+	kind      string
+	namespace string
+	name      string
+	sum       string
+}
+
+// globalDigest combines the checksums of all sources, independent of their
+// order in the input.
+func globalDigest(sources []sourceDigest) string {
+	sorted := append([]sourceDigest(nil), sources...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.sum < b.sum
+	})
+	h := sha256.New()
+	for _, src := range sorted {
+		for _, field := range []string{src.kind, src.namespace, src.name, src.sum} {
+			writeName(h, field)
+		}
 	}
-	return hex.EncodeToString(h.Sum(nil))[:12]
+	return encodeDigest(h)
+}
+
+// writeName feeds an object name into h, terminated by a NUL byte (which
+// cannot appear in Kubernetes names) so it never runs into the data keys.
+func writeName(h io.Writer, name string) {
+	writeString(h, name)
+	h.Write([]byte{0})
+}
+
+// nameSuffix matches the content hash suffix kustomize's generators append
+// to ConfigMap and Secret names.
+var nameSuffix = regexp.MustCompile(`-[bcdfghkmt2456789]{10}$`)
+
+// stripNameSuffix returns name without a kustomize-style hash suffix.
+func stripNameSuffix(name string) string {
+	return nameSuffix.ReplaceAllString(name, "")
 }
 
 func sanitizeKey(name string) string {
 	return strings.ReplaceAll(name, ".", "-")
 }
+
+const (
+	// maxKeyNameLength is the Kubernetes limit for the name segment of a
+	// label or annotation key (the part after the optional prefix).
+	maxKeyNameLength = 63
+	// shortNameLength is how much of an overlong object name is kept
+	// readable when a key has to be shortened.
+	shortNameLength = 20
+)
+
+// keyName builds the name segment of the injected key for an object
+// referenced through the given infix (e.g. "configmap-"). Targets prepend
+// their prefix to it.
+func keyName(infix, name string) string {
+	return shortenKeyName(infix, sanitizeKey(name))
+}
+
+// shortenKeyName returns infix+name when it fits into a key name segment.
+// Longer names keep a readable prefix and are disambiguated by a short hash
+// of the full name so distinct objects still get distinct keys.
+func shortenKeyName(infix, name string) string {
+	if len(infix)+len(name) <= maxKeyNameLength {
+		return infix + name
+	}
+	sum := sha256.Sum256([]byte(name))
+	head := name
+	if len(head) > shortNameLength {
+		head = head[:shortNameLength]
+	}
+	head = strings.TrimRight(head, "-")
+	return infix + head + "-" + hex.EncodeToString(sum[:])[:6]
+}
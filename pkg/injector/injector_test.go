@@ -1,6 +1,12 @@
 package injector
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -8,92 +14,30 @@ import (
 	"gopkg.in/yaml.v3"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	sigyaml "sigs.k8s.io/yaml"
 )
 
-func TestReferencedObjects(t *testing.T) {
-	dep := &appsv1.Deployment{
-		Spec: appsv1.DeploymentSpec{
-			Template: corev1.PodTemplateSpec{
-				Spec: corev1.PodSpec{
-					Volumes: []corev1.Volume{
-						{
-							Name: "cfg",
-							VolumeSource: corev1.VolumeSource{
-								ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "vol-cm"}},
-							},
-						},
-						{
-							Name: "creds",
-							VolumeSource: corev1.VolumeSource{
-								Secret: &corev1.SecretVolumeSource{SecretName: "vol-secret"},
-							},
-						},
-					},
-					Containers: []corev1.Container{
-						{
-							EnvFrom: []corev1.EnvFromSource{
-								{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env-cm"}}},
-								{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env-secret"}}},
-							},
-							Env: []corev1.EnvVar{
-								{
-									Name: "FROM_CONFIG",
-									ValueFrom: &corev1.EnvVarSource{
-										ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "key-cm"}},
-									},
-								},
-								{
-									Name: "FROM_SECRET",
-									ValueFrom: &corev1.EnvVarSource{
-										SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "key-secret"}},
-									},
-								},
-								{
-									Name:  "NO_REF",
-									Value: "literal",
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	gotCMs, gotSecrets := referencedObjects(dep)
-
-	wantCMs := []string{"env-cm", "key-cm", "vol-cm"}
-	wantSecrets := []string{"env-secret", "key-secret", "vol-secret"}
-
-	if !reflect.DeepEqual(gotCMs, wantCMs) {
-		t.Fatalf("configmap refs mismatch\nwant: %v\ngot:  %v", wantCMs, gotCMs)
-	}
-	if !reflect.DeepEqual(gotSecrets, wantSecrets) {
-		t.Fatalf("secret refs mismatch\nwant: %v\ngot:  %v", wantSecrets, gotSecrets)
-	}
-}
-
 func TestHashConfigMapAndSecretDeterministic(t *testing.T) {
 	cm1 := &corev1.ConfigMap{Data: map[string]string{"b": "two", "a": "one"}}
 	cm2 := &corev1.ConfigMap{Data: map[string]string{"a": "one", "b": "two"}}
 
-	if got, want := hashConfigMap(cm1), hashConfigMap(cm2); got != want {
+	if got, want := hashConfigMap(cm1, Options{}), hashConfigMap(cm2, Options{}); got != want {
 		t.Fatalf("expected hashConfigMap to ignore key order\nwant: %s\ngot:  %s", want, got)
 	}
 
 	cm3 := &corev1.ConfigMap{Data: map[string]string{"a": "changed"}}
-	if got, want := hashConfigMap(cm1), hashConfigMap(cm3); got == want {
+	if got, want := hashConfigMap(cm1, Options{}), hashConfigMap(cm3, Options{}); got == want {
 		t.Fatalf("expected different data to produce different hashes, got %s", got)
 	}
 
 	s1 := &corev1.Secret{Data: map[string][]byte{"y": []byte("beta"), "x": []byte("alpha")}}
 	s2 := &corev1.Secret{Data: map[string][]byte{"x": []byte("alpha"), "y": []byte("beta")}}
-	if got, want := hashSecret(s1), hashSecret(s2); got != want {
+	if got, want := hashSecret(s1, Options{}), hashSecret(s2, Options{}); got != want {
 		t.Fatalf("expected hashSecret to ignore key order\nwant: %s\ngot:  %s", want, got)
 	}
 }
 
-func TestProcessDeploymentDocModes(t *testing.T) {
+func TestProcessWorkloadDocModes(t *testing.T) {
 	manifest := `apiVersion: apps/v1
 kind: Deployment
 metadata:
@@ -124,17 +68,17 @@ spec:
                   key: password
 `
 
-	doc, dep := decodeDeploymentManifest(t, manifest)
+	doc, w := decodeDeploymentManifest(t, manifest)
 
-	cmHashes := map[string]string{
+	cmHashes := nameHashes(map[string]string{
 		"app.config":    "111111111111",
 		"shared-config": "222222222222",
-	}
-	secretHashes := map[string]string{
+	})
+	secretHashes := nameHashes(map[string]string{
 		"top.secret": "333333333333",
-	}
+	})
 
-	processDeploymentDoc(deploymentDoc{node: doc, obj: dep}, cmHashes, secretHashes, ModeLabel)
+	processWorkloadDoc(w, cmHashes, secretHashes, nil, keyTemplates{}, Options{Mode: ModeLabel})
 
 	updated := &appsv1.Deployment{}
 	if err := decodeDocument(doc, updated); err != nil {
@@ -162,8 +106,8 @@ spec:
 	}
 
 	// Re-decode a fresh document for annotation mode to avoid cumulative mutations.
-	docAnn, depAnn := decodeDeploymentManifest(t, manifest)
-	processDeploymentDoc(deploymentDoc{node: docAnn, obj: depAnn}, cmHashes, secretHashes, ModeAnnotation)
+	docAnn, wAnn := decodeDeploymentManifest(t, manifest)
+	processWorkloadDoc(wAnn, cmHashes, secretHashes, nil, keyTemplates{}, Options{Mode: ModeAnnotation})
 
 	annotated := &appsv1.Deployment{}
 	if err := decodeDocument(docAnn, annotated); err != nil {
@@ -184,7 +128,7 @@ spec:
 	}
 }
 
-func TestProcessDeploymentDocWithoutMatches(t *testing.T) {
+func TestProcessWorkloadDocWithoutMatches(t *testing.T) {
 	manifest := `apiVersion: apps/v1
 kind: Deployment
 metadata:
@@ -197,9 +141,9 @@ spec:
         - name: app
           image: demo:latest
 `
-	doc, dep := decodeDeploymentManifest(t, manifest)
+	doc, w := decodeDeploymentManifest(t, manifest)
 
-	processDeploymentDoc(deploymentDoc{node: doc, obj: dep}, map[string]string{}, map[string]string{}, ModeLabel)
+	processWorkloadDoc(w, newSourceHashes(), newSourceHashes(), nil, keyTemplates{}, Options{Mode: ModeLabel})
 
 	updated := &appsv1.Deployment{}
 	if err := decodeDocument(doc, updated); err != nil {
@@ -270,16 +214,2249 @@ spec:
 	}
 }
 
-func decodeDeploymentManifest(t *testing.T, manifest string) (*yaml.Node, *appsv1.Deployment) {
+func decodeDeploymentManifest(t *testing.T, manifest string) (*yaml.Node, workloadDoc) {
 	t.Helper()
-	decoder := yaml.NewDecoder(strings.NewReader(manifest))
-	doc := &yaml.Node{}
-	if err := decoder.Decode(doc); err != nil {
-		t.Fatalf("failed to decode YAML: %v", err)
+	w := decodeWorkloadManifest(t, manifest)
+	return w.node, w
+}
+
+func TestInjectChecksumsStrictDecode(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+datas:
+  LOG_LEVEL: info
+`
+
+	if _, err := InjectChecksumsWithOptions(input, Options{Mode: ModeLabel}); err != nil {
+		t.Fatalf("expected lenient decode to succeed, got %v", err)
 	}
-	dep := &appsv1.Deployment{}
-	if err := decodeDocument(doc, dep); err != nil {
-		t.Fatalf("decodeDocument: %v", err)
+
+	_, err := InjectChecksumsWithOptions(input, Options{Mode: ModeLabel, StrictDecode: true})
+	if err == nil {
+		t.Fatalf("expected strict decode to reject unknown field")
+	}
+	if !strings.Contains(err.Error(), "datas") {
+		t.Fatalf("expected error to mention the unknown field, got %v", err)
+	}
+}
+
+func TestInjectReportsInvalidBase64SecretData(t *testing.T) {
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  token: dG9rZW4=
+  key: "not!base64"
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - secretRef:
+                name: app-secret
+`
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	res, err := Inject(input, Options{Mode: ModeLabel, Logger: logger})
+	if err != nil {
+		t.Fatalf("expected lenient decode to succeed, got %v", err)
+	}
+	if len(res.Keys) != 0 {
+		t.Fatalf("expected no checksum for the undecodable Secret, got %+v", res.Keys)
+	}
+	if want := `Secret/app-secret: data key \"key\" is not valid base64`; !strings.Contains(buf.String(), want) {
+		t.Fatalf("expected a warning naming the Secret and key, got:\n%s", buf.String())
+	}
+
+	_, err = Inject(input, Options{Mode: ModeLabel, StrictDecode: true})
+	if err == nil || !strings.Contains(err.Error(), `failed to decode Secret: Secret/app-secret: data key "key" is not valid base64`) {
+		t.Fatalf("expected a strict decode error naming the Secret and key, got %v", err)
+	}
+}
+
+func TestInjectChecksumsFileRefs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.properties")
+	if err := os.WriteFile(path, []byte("log.level=info\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: demo
+spec:
+  template:
+    spec:
+      volumes:
+        - name: cfg
+          configMap:
+            name: rendered-config
+      containers:
+        - name: app
+          image: demo:latest
+`
+
+	got, err := InjectChecksumsWithOptions(input, Options{
+		Mode:     ModeAnnotation,
+		FileRefs: map[string]string{"rendered-config": path},
+	})
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+
+	cm := &corev1.ConfigMap{Data: map[string]string{"app.properties": "log.level=info\n"}}
+	cm.Name = "rendered-config"
+	want := "checksum/configmap-rendered-config: " + hashConfigMap(cm, Options{})
+	if !strings.Contains(got, want) {
+		t.Fatalf("expected %q in output, got:\n%s", want, got)
+	}
+
+	_, err = InjectChecksumsWithOptions(input, Options{
+		Mode:     ModeAnnotation,
+		FileRefs: map[string]string{"rendered-config": filepath.Join(dir, "missing")},
+	})
+	if err == nil {
+		t.Fatalf("expected error for missing file reference")
+	}
+}
+
+func TestKeyNameShortensLongNames(t *testing.T) {
+	if got, want := keyName("configmap-", "app.config"), "configmap-app-config"; got != want {
+		t.Fatalf("keyName mismatch: want %q, got %q", want, got)
+	}
+
+	long := "a-very-long-configmap-name-that-is-generated-by-some-templating-tool"
+	other := long + "-v2"
+
+	got := keyName("configmap-", long)
+	if len(got) > maxKeyNameLength {
+		t.Fatalf("expected key name segment <= %d chars, got %d (%s)", maxKeyNameLength, len(got), got)
+	}
+	if !strings.HasPrefix(got, "configmap-a-very-long-configma-") {
+		t.Fatalf("expected readable prefix to be kept, got %s", got)
+	}
+	if got == keyName("configmap-", other) {
+		t.Fatalf("expected distinct long names to produce distinct keys, both got %s", got)
+	}
+	if again := keyName("configmap-", long); again != got {
+		t.Fatalf("expected shortening to be deterministic, got %s and %s", got, again)
+	}
+}
+
+func TestInjectReportsChangedWorkloads(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: unrelated
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	want := []WorkloadRef{{Kind: "Deployment", Namespace: "prod", Name: "app"}}
+	if !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("changed workloads mismatch\nwant: %v\ngot:  %v", want, res.Changed)
+	}
+
+	again, err := Inject(res.Output, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(again.Changed) != 0 {
+		t.Fatalf("expected re-run to report no changes, got %v", again.Changed)
+	}
+}
+
+func TestHashEmptySourcesIncludeName(t *testing.T) {
+	a := &corev1.ConfigMap{}
+	a.Name = "placeholder-a"
+	b := &corev1.ConfigMap{}
+	b.Name = "placeholder-b"
+
+	if hashConfigMap(a, Options{}) == hashConfigMap(b, Options{}) {
+		t.Fatalf("expected empty ConfigMaps with different names to hash differently, both got %s", hashConfigMap(a, Options{}))
+	}
+
+	sa := &corev1.Secret{}
+	sa.Name = "placeholder-a"
+	sb := &corev1.Secret{}
+	sb.Name = "placeholder-b"
+	if hashSecret(sa, Options{}) == hashSecret(sb, Options{}) {
+		t.Fatalf("expected empty Secrets with different names to hash differently, both got %s", hashSecret(sa, Options{}))
+	}
+}
+
+func TestInjectPruneCorrectsHandEditedChecksums(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        app: demo
+        checksum/configmap-app-config: hand-edited
+        checksum/configmap-removed-config: 000000000000
+      annotations:
+        checksum/secret-old-mode: 111111111111
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel, Prune: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Changed) != 1 {
+		t.Fatalf("expected the Deployment to be reported as changed, got %v", res.Changed)
+	}
+
+	docs := decodeDeployments(t, res.Output)
+	tmpl := docs[0].Spec.Template
+	cm := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "info"}}
+	cm.Name = "app-config"
+	want := map[string]string{
+		"app":                           "demo",
+		"checksum/configmap-app-config": hashConfigMap(cm, Options{}),
+	}
+	if !reflect.DeepEqual(tmpl.Labels, want) {
+		t.Fatalf("labels mismatch\nwant: %v\ngot:  %v", want, tmpl.Labels)
+	}
+	if len(tmpl.Annotations) != 0 {
+		t.Fatalf("expected stale checksum annotations to be pruned, got %v", tmpl.Annotations)
+	}
+
+	again, err := Inject(res.Output, Options{Mode: ModeLabel, Prune: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(again.Changed) != 0 || again.Output != res.Output {
+		t.Fatalf("expected stabilized output to be a fixed point, got changes %v", again.Changed)
+	}
+}
+
+func decodeDeployments(t *testing.T, manifests string) []*appsv1.Deployment {
+	t.Helper()
+	decoder := yaml.NewDecoder(strings.NewReader(manifests))
+	var deps []*appsv1.Deployment
+	for {
+		doc := &yaml.Node{}
+		if err := decoder.Decode(doc); err != nil {
+			break
+		}
+		if getKind(doc) != "Deployment" {
+			continue
+		}
+		dep := &appsv1.Deployment{}
+		if err := decodeDocument(doc, dep); err != nil {
+			t.Fatalf("decodeDocument: %v", err)
+		}
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+func TestHashSalt(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{"a": "one"}}
+	cm.Name = "app-config"
+	s := &corev1.Secret{Data: map[string][]byte{"a": []byte("one")}}
+	s.Name = "app-secret"
+
+	unsalted := hashConfigMap(cm, Options{})
+	staging := hashConfigMap(cm, Options{Salt: "staging"})
+	prod := hashConfigMap(cm, Options{Salt: "prod"})
+	if unsalted == staging || staging == prod {
+		t.Fatalf("expected salt to change the ConfigMap hash, got %s/%s/%s", unsalted, staging, prod)
+	}
+	if again := hashConfigMap(cm, Options{Salt: "prod"}); again != prod {
+		t.Fatalf("expected salted hash to be deterministic, got %s and %s", prod, again)
+	}
+
+	if hashSecret(s, Options{}) == hashSecret(s, Options{Salt: "prod"}) {
+		t.Fatalf("expected salt to change the Secret hash")
+	}
+}
+
+func TestHashTrimValues(t *testing.T) {
+	trimmed := &corev1.ConfigMap{Data: map[string]string{"config.yaml": "level: info"}}
+	trimmed.Name = "app-config"
+	untrimmed := &corev1.ConfigMap{Data: map[string]string{"config.yaml": "level: info\n \n"}}
+	untrimmed.Name = "app-config"
+
+	if hashConfigMap(trimmed, Options{}) == hashConfigMap(untrimmed, Options{}) {
+		t.Fatalf("expected trailing whitespace to change the hash by default")
+	}
+	opts := Options{TrimValues: true}
+	if a, b := hashConfigMap(trimmed, opts), hashConfigMap(untrimmed, opts); a != b {
+		t.Fatalf("expected equal ConfigMap hashes with TrimValues, got %s and %s", a, b)
+	}
+
+	s := &corev1.Secret{Data: map[string][]byte{"token": []byte("abc\n")}}
+	s.Name = "app-secret"
+	sTrimmed := &corev1.Secret{Data: map[string][]byte{"token": []byte("abc")}}
+	sTrimmed.Name = "app-secret"
+	if a, b := hashSecret(s, opts), hashSecret(sTrimmed, opts); a != b {
+		t.Fatalf("expected equal Secret hashes with TrimValues, got %s and %s", a, b)
+	}
+	if string(s.Data["token"]) != "abc\n" || untrimmed.Data["config.yaml"] != "level: info\n \n" {
+		t.Fatalf("expected TrimValues to leave the objects untouched")
+	}
+}
+
+func TestInjectBlockScalarChomping(t *testing.T) {
+	manifest := func(indicator string) string {
+		return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  app.conf: ` + indicator + `
+    level: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	}
+
+	// "|" keeps the final line break and "|-" strips it, so the values, and
+	// therefore the checksums, differ unless TrimValues is set.
+	clip := &corev1.ConfigMap{Data: map[string]string{"app.conf": "level: info\n"}}
+	clip.Name = "app-config"
+	strip := &corev1.ConfigMap{Data: map[string]string{"app.conf": "level: info"}}
+	strip.Name = "app-config"
+
+	tests := []struct {
+		indicator string
+		opts      Options
+		want      string
+	}{
+		{indicator: "|", opts: Options{Mode: ModeAnnotation}, want: hashConfigMap(clip, Options{})},
+		{indicator: "|-", opts: Options{Mode: ModeAnnotation}, want: hashConfigMap(strip, Options{})},
+		{indicator: "|", opts: Options{Mode: ModeAnnotation, TrimValues: true}, want: hashConfigMap(strip, Options{})},
+		{indicator: "|-", opts: Options{Mode: ModeAnnotation, TrimValues: true}, want: hashConfigMap(strip, Options{})},
+	}
+	for _, tt := range tests {
+		res, err := Inject(manifest(tt.indicator), tt.opts)
+		if err != nil {
+			t.Fatalf("%s: Inject: %v", tt.indicator, err)
+		}
+		if len(res.Keys) != 1 || res.Keys[0].Value != tt.want {
+			t.Fatalf("%s (trim %v): expected checksum %s, got %+v", tt.indicator, tt.opts.TrimValues, tt.want, res.Keys)
+		}
+		if !strings.Contains(res.Output, "app.conf: "+tt.indicator+"\n") {
+			t.Fatalf("%s: expected the block scalar to be written back unchanged, got:\n%s", tt.indicator, res.Output)
+		}
+	}
+	if hashConfigMap(clip, Options{}) == hashConfigMap(strip, Options{}) {
+		t.Fatalf("expected a trailing newline to change the checksum")
+	}
+}
+
+func TestInjectStrictReportsWrongKind(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: db-credentials
+data:
+  password: hunter2
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          env:
+            - name: PASSWORD
+              valueFrom:
+                secretKeyRef:
+                  name: db-credentials
+                  key: password
+            - name: TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: missing-secret
+                  key: token
+`
+
+	if _, err := Inject(input, Options{Mode: ModeLabel}); err != nil {
+		t.Fatalf("expected non-strict run to succeed, got %v", err)
+	}
+
+	_, err := Inject(input, Options{Mode: ModeLabel, Strict: true})
+	if err == nil {
+		t.Fatalf("expected strict run to fail")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, `Deployment/app: Secret reference "db-credentials" resolves to a ConfigMap`) {
+		t.Fatalf("expected targeted wrong-kind error, got %v", msg)
+	}
+	if !strings.Contains(msg, `Deployment/app: Secret "missing-secret" not found in input`) {
+		t.Fatalf("expected missing Secret to be reported too, got %v", msg)
+	}
+}
+
+func TestInjectGlobalDigest(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+stringData:
+  TOKEN: abc
+`
+	reordered := `apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+stringData:
+  TOKEN: abc
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+`
+
+	digest := func(in string) string {
+		t.Helper()
+		res, err := Inject(in, Options{Mode: ModeLabel})
+		if err != nil {
+			t.Fatalf("Inject: %v", err)
+		}
+		return res.GlobalDigest
+	}
+
+	base := digest(input)
+	if base == "" {
+		t.Fatalf("expected a global digest")
+	}
+	if got := digest(reordered); got != base {
+		t.Fatalf("expected digest to ignore document order, got %s and %s", base, got)
+	}
+	if got := digest(strings.Replace(input, "LOG_LEVEL: info", "LOG_LEVEL: debug", 1)); got == base {
+		t.Fatalf("expected ConfigMap change to change the global digest")
+	}
+	if got := digest(strings.Replace(input, "name: app-secret", "name: other-secret", 1)); got == base {
+		t.Fatalf("expected Secret change to change the global digest")
+	}
+
+	for _, opts := range []Options{
+		{Mode: ModeLabel, Salt: "staging"},
+		{Mode: ModeAnnotation, HashLength: 64},
+		{Mode: ModeLabel, HashLength: 8, Salt: "prod"},
+	} {
+		res, err := Inject(input, opts)
+		if err != nil {
+			t.Fatalf("Inject: %v", err)
+		}
+		if res.GlobalDigest != base {
+			t.Fatalf("expected salt %q and hash length %d not to change the global digest, got %s, want %s", opts.Salt, opts.HashLength, res.GlobalDigest, base)
+		}
+	}
+}
+
+func TestInjectStrictHonorsOptionalKeyRefs(t *testing.T) {
+	deployment := func(ref string, optional string) string {
+		return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          env:
+            - name: VALUE
+              valueFrom:
+                ` + ref + `:
+                  name: absent
+                  key: value` + optional + `
+`
+	}
+
+	cases := []struct {
+		name     string
+		ref      string
+		optional string
+		wantErr  bool
+	}{
+		{name: "required configMapKeyRef", ref: "configMapKeyRef", wantErr: true},
+		{name: "explicitly required configMapKeyRef", ref: "configMapKeyRef", optional: "\n                  optional: false", wantErr: true},
+		{name: "optional configMapKeyRef", ref: "configMapKeyRef", optional: "\n                  optional: true"},
+		{name: "required secretKeyRef", ref: "secretKeyRef", wantErr: true},
+		{name: "optional secretKeyRef", ref: "secretKeyRef", optional: "\n                  optional: true"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Inject(deployment(tc.ref, tc.optional), Options{Mode: ModeLabel, Strict: true})
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected strict error for missing required reference")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("expected optional missing reference to pass strict, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInjectStrictHonorsOptionalEnvFrom(t *testing.T) {
+	deployment := func(ref, optional string) string {
+		return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - ` + ref + `:
+                name: absent` + optional + `
+`
+	}
+
+	cases := []struct {
+		name     string
+		ref      string
+		optional string
+		wantErr  bool
+	}{
+		{name: "required secretRef", ref: "secretRef", wantErr: true},
+		{name: "explicitly required secretRef", ref: "secretRef", optional: "\n                optional: false", wantErr: true},
+		{name: "optional secretRef", ref: "secretRef", optional: "\n                optional: true"},
+		{name: "required configMapRef", ref: "configMapRef", wantErr: true},
+		{name: "optional configMapRef", ref: "configMapRef", optional: "\n                optional: true"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Inject(deployment(tc.ref, tc.optional), Options{Mode: ModeLabel, Strict: true})
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected strict error for missing required envFrom source")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("expected optional missing envFrom source to pass strict, got %v", err)
+			}
+
+			res, err := Inject(deployment(tc.ref, tc.optional), Options{Mode: ModeLabel})
+			if err != nil {
+				t.Fatalf("Inject: %v", err)
+			}
+			refs := res.References[0].References
+			if len(refs) != 1 || refs[0].Resolved || refs[0].Optional == tc.wantErr {
+				t.Fatalf("expected the reference to be reported unresolved with optional=%v, got %+v", !tc.wantErr, refs)
+			}
+		})
+	}
+}
+
+func TestInjectStrictHonorsOptionalVolumes(t *testing.T) {
+	deployment := func(volume string) string {
+		return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: config
+` + volume + `
+      containers:
+        - name: app
+`
+	}
+
+	cases := []struct {
+		name    string
+		volume  string
+		wantErr bool
+	}{
+		{name: "optional unset configMap", volume: "          configMap:\n            name: absent", wantErr: true},
+		{name: "explicitly required configMap", volume: "          configMap:\n            name: absent\n            optional: false", wantErr: true},
+		{name: "optional configMap", volume: "          configMap:\n            name: absent\n            optional: true"},
+		{name: "optional unset secret", volume: "          secret:\n            secretName: absent", wantErr: true},
+		{name: "optional secret", volume: "          secret:\n            secretName: absent\n            optional: true"},
+		{name: "optional unset projected configMap", volume: "          projected:\n            sources:\n              - configMap:\n                  name: absent", wantErr: true},
+		{name: "optional projected configMap", volume: "          projected:\n            sources:\n              - configMap:\n                  name: absent\n                  optional: true"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Inject(deployment(tc.volume), Options{Mode: ModeLabel, Strict: true})
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected strict error for missing required volume source")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("expected optional missing volume source to pass strict, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInjectChecksumsKustomizeOrdering(t *testing.T) {
+	// kustomize build emits Deployments before the generated ConfigMaps and
+	// Secrets they reference, with hash suffixes already applied to both the
+	// object names and the references.
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config-7g2kd9h8mt
+            - secretRef:
+                name: app-secret-b5f6c9ktd2
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret-b5f6c9ktd2
+data:
+  TOKEN: QVBJX1RPS0VO
+type: Opaque
+---
+apiVersion: v1
+data:
+  LOG_LEVEL: info
+kind: ConfigMap
+metadata:
+  name: app-config-7g2kd9h8mt
+---
+`
+
+	got, err := InjectChecksums(input, ModeLabel)
+	if err != nil {
+		t.Fatalf("InjectChecksums: %v", err)
+	}
+
+	deps := decodeDeployments(t, got)
+	if len(deps) != 1 {
+		t.Fatalf("expected one Deployment in output, got %d", len(deps))
+	}
+	labels := deps[0].Spec.Template.Labels
+	for _, key := range []string{"checksum/configmap-app-config-7g2kd9h8mt", "checksum/secret-app-secret-b5f6c9ktd2"} {
+		if labels[key] == "" {
+			t.Fatalf("expected %s to be injected, got %v", key, labels)
+		}
+	}
+	if !strings.HasPrefix(got, "apiVersion: apps/v1\nkind: Deployment") {
+		t.Fatalf("expected input document order to be preserved, got:\n%s", got)
+	}
+}
+
+func TestInjectSkipImmutable(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: frozen-config
+immutable: true
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: frozen-secret
+immutable: true
+data:
+  TOKEN: QVBJX1RPS0VO
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: live-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: frozen-config
+            - configMapRef:
+                name: live-config
+            - secretRef:
+                name: frozen-secret
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if labels := decodeDeployments(t, res.Output)[0].Spec.Template.Labels; len(labels) != 3 {
+		t.Fatalf("expected all three checksums without the flag, got %v", labels)
+	}
+
+	res, err = Inject(input, Options{Mode: ModeLabel, SkipImmutable: true, Strict: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	labels := decodeDeployments(t, res.Output)[0].Spec.Template.Labels
+	if len(labels) != 1 || labels["checksum/configmap-live-config"] == "" {
+		t.Fatalf("expected only the mutable ConfigMap checksum, got %v", labels)
+	}
+}
+
+func decodeSingleConfigMapHash(t *testing.T, manifest string) string {
+	t.Helper()
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(manifest), doc); err != nil {
+		t.Fatalf("failed to decode YAML: %v", err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := decodeDocument(doc, cm); err != nil {
+		t.Fatalf("decodeDocument: %v", err)
+	}
+	return hashConfigMap(cm, Options{})
+}
+
+func TestInjectChecksumsPreservesBinarySecretData(t *testing.T) {
+	binary := make([]byte, 512)
+	for i := range binary {
+		binary[i] = byte(255 - i%256)
+	}
+	encoded := base64.StdEncoding.EncodeToString(binary)
+
+	secret := `apiVersion: v1
+kind: Secret
+metadata:
+  name: tls-material
+type: Opaque
+data:
+  blob: ` + encoded + `
+  quoted: "` + base64.StdEncoding.EncodeToString([]byte{0xff, 0xfe, 0x00, 0x80}) + `"
+`
+	input := secret + `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: tls
+          secret:
+            secretName: tls-material
+`
+
+	for _, opts := range []Options{{Mode: ModeLabel}, {Mode: ModeLabel, Canonicalize: true}} {
+		got, err := InjectChecksumsWithOptions(input, opts)
+		if err != nil {
+			t.Fatalf("InjectChecksumsWithOptions: %v", err)
+		}
+		if !opts.Canonicalize && !strings.HasPrefix(got, secret+"---\n") {
+			t.Fatalf("expected Secret document to pass through byte-identical, got:\n%s", got)
+		}
+
+		doc := &yaml.Node{}
+		if err := yaml.NewDecoder(strings.NewReader(got)).Decode(doc); err != nil {
+			t.Fatalf("failed to decode output: %v", err)
+		}
+		decoded := &corev1.Secret{}
+		if err := decodeDocument(doc, decoded); err != nil {
+			t.Fatalf("decodeDocument: %v", err)
+		}
+		if !bytes.Equal(decoded.Data["blob"], binary) {
+			t.Fatalf("binary Secret data was altered (canonicalize=%v)", opts.Canonicalize)
+		}
+		if !bytes.Equal(decoded.Data["quoted"], []byte{0xff, 0xfe, 0x00, 0x80}) {
+			t.Fatalf("quoted Secret data was altered (canonicalize=%v)", opts.Canonicalize)
+		}
+	}
+}
+
+func TestInjectReportsResolvedReferences(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: absent
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	cm := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "info"}}
+	cm.Name = "app-config"
+	want := []WorkloadReferences{{
+		Workload: WorkloadRef{Kind: "Deployment", Name: "app"},
+		References: []ResolvedReference{
+			{Reference: Reference{Kind: KindConfigMap, Name: "app-config", Source: SourceEnvFrom}, Resolved: true, Checksum: hashConfigMap(cm, Options{})},
+			{Reference: Reference{Kind: KindSecret, Name: "absent", Source: SourceEnvFrom}},
+		},
+	}}
+	if !reflect.DeepEqual(res.References, want) {
+		t.Fatalf("references mismatch\nwant: %+v\ngot:  %+v", want, res.References)
+	}
+}
+
+func TestInjectStripNameSuffix(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config-g5h8k2m4t9
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  TOKEN: QVBJX1RPS0VO
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret-7b9f2k6m4d
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Changed) != 0 {
+		t.Fatalf("expected suffixed names not to match by default, got %v", res.Changed)
+	}
+
+	res, err = Inject(input, Options{Mode: ModeAnnotation, StripNameSuffix: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	cm := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "info"}}
+	cm.Name = "app-config-g5h8k2m4t9"
+	s := &corev1.Secret{Data: map[string][]byte{"TOKEN": []byte("API_TOKEN")}}
+	s.Name = "app-secret"
+	want := []InjectedKey{
+		{Workload: res.Changed[0], Field: "annotations", Key: "checksum/configmap-app-config", Value: hashConfigMap(cm, Options{})},
+		{Workload: res.Changed[0], Field: "annotations", Key: "checksum/secret-app-secret", Value: hashSecret(s, Options{})},
+	}
+	if !reflect.DeepEqual(res.Keys, want) {
+		t.Fatalf("keys mismatch\nwant: %+v\ngot:  %+v", want, res.Keys)
+	}
+}
+
+func TestInjectExtraAnnotations(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: standalone
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+`
+
+	extra := map[string]string{"example.com/build-id": "1234", "example.com/commit": "abc"}
+	res, err := Inject(input, Options{Mode: ModeAnnotation, ExtraAnnotations: extra})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Changed) != 2 {
+		t.Fatalf("expected both workloads to change, got %v", res.Changed)
+	}
+
+	deployments := decodeDeployments(t, res.Output)
+	for k, v := range extra {
+		for _, dep := range deployments {
+			if got := dep.Spec.Template.Annotations[k]; got != v {
+				t.Fatalf("%s: expected %s=%s, got %v", dep.Name, k, v, dep.Spec.Template.Annotations)
+			}
+		}
+	}
+	if _, ok := deployments[0].Spec.Template.Annotations["checksum/configmap-app-config"]; !ok {
+		t.Fatalf("expected the checksum next to the extra annotations, got %v", deployments[0].Spec.Template.Annotations)
+	}
+}
+
+func TestInjectExtraAnnotationsFollowTargets(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        checksum/configmap-stale: 0123456789ab
+      annotations: not-a-map
+    spec:
+      containers:
+        - name: app
+`
+	extra := map[string]string{"example.com/build-id": "42"}
+
+	res, err := Inject(input, Options{Mode: ModeLabel, ExtraAnnotations: extra, Prune: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	for _, want := range []string{"labels:\n        example.com/build-id: \"42\"\n", "annotations: not-a-map\n"} {
+		if !strings.Contains(res.Output, want) {
+			t.Fatalf("expected %q in label mode, got:\n%s", want, res.Output)
+		}
+	}
+	if strings.Contains(res.Output, "checksum/configmap-stale") {
+		t.Fatalf("expected the stale checksum to be pruned, got:\n%s", res.Output)
+	}
+
+	if _, err := Inject(input, Options{Mode: ModeAnnotation, ExtraAnnotations: extra}); err == nil || !strings.Contains(err.Error(), "not a mapping") {
+		t.Fatalf("expected the non-mapping annotations to be reported in annotation mode, got %v", err)
+	}
+
+	// Labels are still pruned when the annotations cannot be written.
+	update := processWorkloadDoc(decodeWorkloadManifest(t, input), newSourceHashes(), newSourceHashes(), nil, keyTemplates{}, Options{Mode: ModeAnnotation, ExtraAnnotations: extra, Prune: true})
+	if len(update.errs) != 1 || len(update.changes) != 1 || update.changes[0].Op != "remove" {
+		t.Fatalf("expected one error and the stale label pruned, got errors %v and changes %+v", update.errs, update.changes)
+	}
+}
+
+func TestHashSecretFoldsStringData(t *testing.T) {
+	stringData := &corev1.Secret{StringData: map[string]string{"password": "s3cr3t"}}
+	stringData.Name = "db"
+	data := &corev1.Secret{Data: map[string][]byte{"password": []byte("s3cr3t")}}
+	data.Name = "db"
+	if a, b := hashSecret(stringData, Options{}), hashSecret(data, Options{}); a != b {
+		t.Fatalf("expected stringData and data Secrets to hash equally, got %s and %s", a, b)
+	}
+
+	mixed := &corev1.Secret{
+		Data:       map[string][]byte{"password": []byte("old"), "user": []byte("admin")},
+		StringData: map[string]string{"password": "s3cr3t"},
+	}
+	mixed.Name = "db"
+	merged := &corev1.Secret{Data: map[string][]byte{"password": []byte("s3cr3t"), "user": []byte("admin")}}
+	merged.Name = "db"
+	if a, b := hashSecret(mixed, Options{}), hashSecret(merged, Options{}); a != b {
+		t.Fatalf("expected stringData to override data, got %s and %s", a, b)
+	}
+	if string(mixed.Data["password"]) != "old" {
+		t.Fatalf("expected hashing to leave the Secret untouched")
+	}
+}
+
+func TestEnsureMapReplacesNulls(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     string
+	}{
+		{
+			name:     "null template",
+			manifest: "spec:\n  template: null\n",
+			want:     "spec:\n  template:\n    metadata:\n      annotations:\n        example.com/build-id: \"42\"\n",
+		},
+		{
+			name:     "tilde metadata",
+			manifest: "spec:\n  template:\n    metadata: ~\n",
+			want:     "spec:\n  template:\n    metadata:\n      annotations:\n        example.com/build-id: \"42\"\n",
+		},
+		{
+			name:     "empty annotations",
+			manifest: "spec:\n  template:\n    metadata:\n      annotations:\n",
+			want:     "spec:\n  template:\n    metadata:\n      annotations:\n        example.com/build-id: \"42\"\n",
+		},
+		{
+			name:     "scalar template is left alone",
+			manifest: "spec:\n  template: unrendered\n",
+			want:     "spec:\n  template: unrendered\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &yaml.Node{}
+			if err := yaml.Unmarshal([]byte(tt.manifest), doc); err != nil {
+				t.Fatalf("failed to decode YAML: %v", err)
+			}
+			if m := ensureMap(documentRoot(doc), "spec", "template", "metadata", "annotations"); m != nil {
+				setStringMapValue(m, "example.com/build-id", "42", "")
+			}
+			var out strings.Builder
+			enc := yaml.NewEncoder(&out)
+			enc.SetIndent(2)
+			if err := enc.Encode(doc); err != nil {
+				t.Fatalf("failed to encode YAML: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Fatalf("output mismatch\nwant:\n%s\ngot:\n%s", tt.want, out.String())
+			}
+		})
+	}
+}
+
+func TestInjectNullTemplate(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template: null
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation, ExtraAnnotations: map[string]string{"example.com/build-id": "42"}})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	deps := decodeDeployments(t, res.Output)
+	if len(deps) != 1 || deps[0].Spec.Template.Annotations["example.com/build-id"] != "42" {
+		t.Fatalf("expected metadata to be injected into a null template, got:\n%s", res.Output)
+	}
+}
+
+func TestInjectNonMapTemplateMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		wantErr  string
+	}{
+		{
+			name:     "scalar",
+			metadata: "metadata: somestring",
+			wantErr:  `Deployment/app: cannot inject into spec.template.metadata.labels: spec.template.metadata is the scalar "somestring", not a mapping`,
+		},
+		{
+			name:     "sequence",
+			metadata: "metadata: [a, b]",
+			wantErr:  "Deployment/app: cannot inject into spec.template.metadata.labels: spec.template.metadata is a sequence, not a mapping",
+		},
+		{
+			name:     "scalar labels",
+			metadata: "metadata:\n      labels: somestring",
+			wantErr:  `Deployment/app: cannot inject into spec.template.metadata.labels: spec.template.metadata.labels is the scalar "somestring", not a mapping`,
+		},
+		{
+			name:     "null is converted",
+			metadata: "metadata: null",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    ` + tt.metadata + `
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+			res, err := Inject(input, Options{Mode: ModeLabel})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Inject: %v", err)
+			}
+			deps := decodeDeployments(t, res.Output)
+			if len(deps) != 1 || deps[0].Spec.Template.Labels["checksum/configmap-app-config"] == "" {
+				t.Fatalf("expected a well-formed labels mapping, got:\n%s", res.Output)
+			}
+		})
+	}
+}
+
+func TestInjectRequireAllReferenced(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    spec:
+      volumes:
+        - name: flags
+          configMap:
+            name: app-flags
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - configMapRef:
+                name: app-flags
+            - secretRef:
+                name: optional-secret
+                optional: true
+`
+
+	if _, err := Inject(input, Options{Mode: ModeLabel}); err != nil {
+		t.Fatalf("expected partial injection to succeed by default, got %v", err)
+	}
+
+	_, err := Inject(input, Options{Mode: ModeLabel, RequireAllReferenced: true})
+	want := "Deployment/prod/app: 1 of 2 required references have no checksum: ConfigMap app-flags"
+	if err == nil || err.Error() != want {
+		t.Fatalf("expected error %q, got %v", want, err)
+	}
+
+	complete := strings.Replace(input, "---\n", "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app-flags\n---\n", 1)
+	if _, err := Inject(complete, Options{Mode: ModeLabel, RequireAllReferenced: true}); err != nil {
+		t.Fatalf("expected complete injection to pass, got %v", err)
+	}
+}
+
+func TestInjectDedupesReferencesAcrossMechanisms(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: cfg
+          configMap:
+            name: app-config
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+          env:
+            - name: LOG_LEVEL
+              valueFrom:
+                configMapKeyRef:
+                  name: app-config
+                  key: LOG_LEVEL
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.References) != 1 || len(res.References[0].References) != 3 {
+		t.Fatalf("expected three references through different mechanisms, got %+v", res.References)
+	}
+	if len(res.Keys) != 1 || res.Keys[0].Key != "checksum/configmap-app-config" {
+		t.Fatalf("expected exactly one checksum key, got %+v", res.Keys)
+	}
+	labels := decodeDeployments(t, res.Output)[0].Spec.Template.Labels
+	if len(labels) != 1 {
+		t.Fatalf("expected exactly one checksum label, got %v", labels)
+	}
+}
+
+func TestInjectImagePullSecretsArePodLevel(t *testing.T) {
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: registry-a
+type: kubernetes.io/dockerconfigjson
+stringData:
+  .dockerconfigjson: '{"auths":{"a.example.com":{}}}'
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: registry-b
+type: kubernetes.io/dockerconfigjson
+stringData:
+  .dockerconfigjson: '{"auths":{"b.example.com":{}}}'
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      imagePullSecrets:
+        - name: registry-a
+        - name: registry-b
+        - name: registry-a
+      initContainers:
+        - name: migrate
+          image: a.example.com/migrate
+      containers:
+        - name: app
+          image: a.example.com/app
+        - name: sidecar
+          image: b.example.com/sidecar
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel, CredentialSecrets: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	refs := res.References[0].References
+	if len(refs) != 2 || refs[0].Source != SourceImagePullSecret || refs[1].Source != SourceImagePullSecret {
+		t.Fatalf("expected two image pull secret references, got %+v", refs)
+	}
+	labels := decodeDeployments(t, res.Output)[0].Spec.Template.Labels
+	if len(labels) != 2 || labels["checksum/secret-registry-a"] == "" || labels["checksum/secret-registry-b"] == "" {
+		t.Fatalf("expected one checksum label per image pull secret, got %v", labels)
+	}
+
+	workload := input[strings.Index(input, "apiVersion: apps/v1"):]
+	res, err = Inject(workload, Options{Mode: ModeLabel, Strict: true})
+	if err != nil {
+		t.Fatalf("expected image pull secrets to be untracked by default, got %v", err)
+	}
+	if len(res.Keys) != 0 {
+		t.Fatalf("expected no checksums for image pull secrets by default, got %+v", res.Keys)
+	}
+}
+
+func TestInjectStream(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+`
+
+	want, err := InjectChecksums(input, ModeAnnotation)
+	if err != nil {
+		t.Fatalf("InjectChecksums: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := InjectStream(bytes.NewBufferString(input), &out, Options{Mode: ModeAnnotation}); err != nil {
+		t.Fatalf("InjectStream: %v", err)
+	}
+	if out.String() != want {
+		t.Fatalf("stream output mismatch\nwant:\n%s\ngot:\n%s", want, out.String())
+	}
+	if !strings.Contains(out.String(), "checksum/configmap-app-config") {
+		t.Fatalf("expected a checksum for a source that follows its workload, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := InjectStream(bytes.NewBufferString(input), &out, Options{Mode: ModeAnnotation, FileRefs: map[string]string{"x": "/nonexistent"}}); err == nil {
+		t.Fatalf("expected an error for a missing file reference")
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected nothing to be written on error, got %q", out.String())
+	}
+}
+
+func TestInjectSkipZeroReplicas(t *testing.T) {
+	sources := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+`
+	workload := func(name, replicas string) string {
+		return "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: " + name + "\nspec:\n" + replicas +
+			"  template:\n    spec:\n      containers:\n        - name: app\n          envFrom:\n            - configMapRef:\n                name: app-config\n"
+	}
+	input := sources +
+		workload("scaled-down", "  replicas: 0\n") +
+		workload("defaulted", "") +
+		workload("null-replicas", "  replicas: null\n") +
+		workload("running", "  replicas: 3\n")
+
+	res, err := Inject(input, Options{Mode: ModeLabel, SkipZeroReplicas: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	want := []WorkloadRef{
+		{Kind: "Deployment", Name: "defaulted"},
+		{Kind: "Deployment", Name: "null-replicas"},
+		{Kind: "Deployment", Name: "running"},
+	}
+	if !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("changed mismatch\nwant: %v\ngot:  %v", want, res.Changed)
+	}
+	if labels := decodeDeployments(t, res.Output)[0].Spec.Template.Labels; labels != nil {
+		t.Fatalf("expected no injection into the zero-replica Deployment, got %v", labels)
+	}
+
+	res, err = Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Changed) != 4 {
+		t.Fatalf("expected every Deployment to change without the option, got %v", res.Changed)
+	}
+}
+
+func TestInjectSelector(t *testing.T) {
+	sources := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+`
+	workload := func(name, tier string) string {
+		return "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: " + name + "\n  labels:\n    tier: " + tier + "\nspec:\n" +
+			"  template:\n    spec:\n      containers:\n        - name: app\n          envFrom:\n            - configMapRef:\n                name: app-config\n"
+	}
+	input := sources + workload("api", "backend") + workload("web", "frontend")
+
+	res, err := Inject(input, Options{Mode: ModeLabel, Selector: "tier=backend"})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	want := []WorkloadRef{{Kind: "Deployment", Name: "api"}}
+	if !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("changed mismatch\nwant: %v\ngot:  %v", want, res.Changed)
+	}
+	deployments := decodeDeployments(t, res.Output)
+	if deployments[0].Spec.Template.Labels == nil {
+		t.Fatalf("expected injection into the matching Deployment")
+	}
+	if labels := deployments[1].Spec.Template.Labels; labels != nil {
+		t.Fatalf("expected the other Deployment to pass through untouched, got %v", labels)
+	}
+
+	if _, err := Inject(input, Options{Mode: ModeLabel, Selector: "tier in (backend"}); err == nil {
+		t.Fatalf("expected an error for an invalid selector")
+	}
+}
+
+func TestHashExcludeKeysAnnotation(t *testing.T) {
+	withTimestamp := func(timestamp string, annotations map[string]string) *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "info", "timestamp": timestamp, "build-time": timestamp}}
+		cm.Name = "app-config"
+		cm.Annotations = annotations
+		return cm
+	}
+	opts := Options{Mode: ModeLabel}
+	exclude := map[string]string{ExcludeKeysAnnotation: "timestamp, build-time"}
+
+	if hashConfigMap(withTimestamp("1", exclude), opts) != hashConfigMap(withTimestamp("2", exclude), opts) {
+		t.Fatalf("expected excluded keys not to change the hash")
+	}
+	if hashConfigMap(withTimestamp("1", nil), opts) == hashConfigMap(withTimestamp("2", nil), opts) {
+		t.Fatalf("expected every key to be hashed without the annotation")
+	}
+	changed := withTimestamp("1", exclude)
+	changed.Data["LOG_LEVEL"] = "debug"
+	if hashConfigMap(changed, opts) == hashConfigMap(withTimestamp("1", exclude), opts) {
+		t.Fatalf("expected keys that are not excluded to still change the hash")
+	}
+}
+
+func TestInjectAnnotateSources(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+  annotations:
+    team: payments
+stringData:
+  TOKEN: abc
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret
+`
+	opts := Options{Mode: ModeAnnotation, AnnotateSources: true, IncludeMetadata: true}
+	res, err := Inject(input, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	var cm corev1.ConfigMap
+	var secret corev1.Secret
+	docs := strings.Split(res.Output, "---\n")
+	if err := sigyaml.Unmarshal([]byte(docs[0]), &cm); err != nil {
+		t.Fatalf("failed to decode ConfigMap: %v", err)
+	}
+	if err := sigyaml.Unmarshal([]byte(docs[1]), &secret); err != nil {
+		t.Fatalf("failed to decode Secret: %v", err)
+	}
+	for _, k := range res.Keys {
+		self := cm.Annotations[SelfAnnotation]
+		if strings.Contains(k.Key, "secret-") {
+			self = secret.Annotations[SelfAnnotation]
+		}
+		if self != k.Value {
+			t.Fatalf("expected %s to match the source's own annotation, got %q", k, self)
+		}
+	}
+	if secret.Annotations["team"] != "payments" {
+		t.Fatalf("expected existing annotations to be kept, got %v", secret.Annotations)
+	}
+
+	again, err := Inject(res.Output, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if again.Output != res.Output {
+		t.Fatalf("expected the self annotation not to feed back into checksums\nfirst:\n%s\nsecond:\n%s", res.Output, again.Output)
+	}
+}
+
+func TestHashIncludeMetadata(t *testing.T) {
+	base := func() *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "info"}}
+		cm.Name = "app-config"
+		cm.Labels = map[string]string{"app": "demo"}
+		return cm
+	}
+	opts := Options{Mode: ModeAnnotation, IncludeMetadata: true}
+	want := hashConfigMap(base(), opts)
+
+	if hashConfigMap(base(), Options{Mode: ModeAnnotation}) == want {
+		t.Fatalf("expected metadata to change the hash when included")
+	}
+
+	relabeled := base()
+	relabeled.Labels["app"] = "other"
+	if hashConfigMap(relabeled, opts) == want {
+		t.Fatalf("expected a label change to change the hash")
+	}
+
+	volatile := base()
+	volatile.Annotations = map[string]string{
+		"kubectl.kubernetes.io/last-applied-configuration": `{"apiVersion":"v1"}`,
+		"kubectl.kubernetes.io/restartedAt":                "2024-01-01T00:00:00Z",
+		"checksum/configmap-other":                         "0123456789ab",
+	}
+	volatile.Labels["checksum/secret-other"] = "0123456789ab"
+	if got := hashConfigMap(volatile, opts); got != want {
+		t.Fatalf("expected volatile and injector-owned keys to be ignored, got %s, want %s", got, want)
+	}
+
+	custom := base()
+	custom.Annotations = map[string]string{"example.com/configmap-other": "0123456789ab"}
+	customOpts := opts
+	customOpts.Targets = []Target{{Mode: ModeAnnotation, Prefix: "example.com/"}}
+	if hashConfigMap(custom, customOpts) != hashConfigMap(base(), customOpts) {
+		t.Fatalf("expected keys under a custom target prefix to be ignored")
+	}
+
+	s := &corev1.Secret{Data: map[string][]byte{"TOKEN": []byte("x")}}
+	s.Name = "app-secret"
+	annotated := s.DeepCopy()
+	annotated.Annotations = map[string]string{"owner": "team-a"}
+	if hashSecret(s, opts) == hashSecret(annotated, opts) {
+		t.Fatalf("expected Secret annotations to change the hash when included")
+	}
+}
+
+func TestHashSecretTypeOmittedOrOpaque(t *testing.T) {
+	omitted := &corev1.Secret{Data: map[string][]byte{"TOKEN": []byte("x")}}
+	omitted.Name = "app-secret"
+	opaque := omitted.DeepCopy()
+	opaque.Type = corev1.SecretTypeOpaque
+
+	for _, opts := range []Options{{Mode: ModeAnnotation}, {Mode: ModeAnnotation, IncludeMetadata: true}} {
+		if got, want := hashSecret(opaque, opts), hashSecret(omitted, opts); got != want {
+			t.Fatalf("expected an explicit Opaque type to hash like an omitted one (IncludeMetadata=%v), got %s, want %s", opts.IncludeMetadata, got, want)
+		}
+	}
+}
+
+func TestInjectFailFast(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+datas:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - secretRef:
+                name: app-secret
+`
+	opts := Options{Mode: ModeLabel, StrictDecode: true, Strict: true}
+
+	_, err := Inject(input, opts)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, want := range []string{`unknown field "datas"`, `Secret "app-secret" not found`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected all problems to be reported, missing %q in %v", want, err)
+		}
+	}
+
+	opts.FailFast = true
+	_, err = Inject(input, opts)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "datas"`) || strings.Contains(err.Error(), "app-secret") {
+		t.Fatalf("expected only the first problem with FailFast, got %v", err)
+	}
+}
+
+func TestInjectSkipBadDocs(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata: {name: broken
+data:
+  key: [unterminated
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+	if _, err := Inject(input, Options{Mode: ModeAnnotation}); err == nil {
+		t.Fatalf("expected a parse error without SkipBadDocs")
+	}
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation, SkipBadDocs: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if !strings.Contains(res.Output, "checksum/configmap-app-config: c2cb39c0e655") {
+		t.Fatalf("expected the documents around the broken one to be processed, got:\n%s", res.Output)
+	}
+	broken := "---\napiVersion: v1\nkind: ConfigMap\nmetadata: {name: broken\ndata:\n  key: [unterminated\n---\n"
+	if !strings.Contains(res.Output, broken) {
+		t.Fatalf("expected the broken document to be passed through verbatim, got:\n%s", res.Output)
+	}
+	if got := strings.Count(res.Output, "---\n"); got != 2 {
+		t.Fatalf("expected three documents, got %d separators:\n%s", got, res.Output)
+	}
+
+	// Without a kind, the broken document sorts last.
+	res, err = Inject(input, Options{Mode: ModeAnnotation, SkipBadDocs: true, OutputOrder: OrderKind, SelfCheck: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if !strings.Contains(res.Output, "c2cb39c0e655\n---\napiVersion: v1\nkind: ConfigMap\nmetadata: {name: broken\n") {
+		t.Fatalf("expected the broken document to follow the rendered ones, got:\n%s", res.Output)
+	}
+}
+
+func TestSplitDocuments(t *testing.T) {
+	input := "a: 1\n---\nb: 2\n--- # comment\nc: 3\n---x: 4\n"
+	chunks, err := splitDocuments(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("splitDocuments: %v", err)
+	}
+	want := []string{"a: 1\n", "---\nb: 2\n", "--- # comment\nc: 3\n---x: 4\n"}
+	if len(chunks) != len(want) {
+		t.Fatalf("expected %d chunks, got %d: %q", len(want), len(chunks), chunks)
+	}
+	for i := range want {
+		if string(chunks[i]) != want[i] {
+			t.Fatalf("chunk %d: expected %q, got %q", i, want[i], chunks[i])
+		}
+	}
+}
+
+func TestInjectOrderSensitive(t *testing.T) {
+	manifest := func(data string) string {
+		return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+` + data + `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	}
+	sorted := manifest("  a.conf: one\n  b.conf: two\n")
+	reordered := manifest("  b.conf: two\n  a.conf: one\n")
+
+	checksum := func(input string, opts Options) string {
+		t.Helper()
+		res, err := Inject(input, opts)
+		if err != nil {
+			t.Fatalf("Inject: %v", err)
+		}
+		if len(res.Keys) != 1 {
+			t.Fatalf("expected one injected key, got %+v", res.Keys)
+		}
+		return res.Keys[0].Value
+	}
+
+	opts := Options{Mode: ModeAnnotation}
+	if a, b := checksum(sorted, opts), checksum(reordered, opts); a != b {
+		t.Fatalf("expected key order not to matter by default, got %s and %s", a, b)
+	}
+	ordered := Options{Mode: ModeAnnotation, OrderSensitive: true}
+	if a, b := checksum(sorted, ordered), checksum(reordered, ordered); a == b {
+		t.Fatalf("expected reordered keys to change the checksum with OrderSensitive")
+	}
+	if a, b := checksum(sorted, opts), checksum(sorted, ordered); a != b {
+		t.Fatalf("expected sorted keys to hash the same with and without OrderSensitive, got %s and %s", a, b)
+	}
+}
+
+func TestInjectBaseManifests(t *testing.T) {
+	base := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared-config
+data:
+  REGION: eu
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: base-app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: shared-config
+`
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: debug
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - configMapRef:
+                name: shared-config
+`
+
+	overlay := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "debug"}}
+	overlay.Name = "app-config"
+	shared := &corev1.ConfigMap{Data: map[string]string{"REGION": "eu"}}
+	shared.Name = "shared-config"
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation, BaseManifests: base})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	want := map[string]string{
+		"checksum/configmap-app-config":    hashConfigMap(overlay, Options{}),
+		"checksum/configmap-shared-config": hashConfigMap(shared, Options{}),
+	}
+	got := map[string]string{}
+	for _, k := range res.Keys {
+		got[k.Key] = k.Value
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if len(res.Changed) != 1 || strings.Contains(res.Output, "base-app") || strings.Contains(res.Output, "REGION") {
+		t.Fatalf("expected base documents to be neither processed nor written, got changed %v and output:\n%s", res.Changed, res.Output)
+	}
+}
+
+func TestInjectGenerationCounter(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: one
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	opts := Options{Mode: ModeAnnotation, GenerationCounter: true}
+	generation := func(t *testing.T, output string) string {
+		t.Helper()
+		deps := decodeDeployments(t, output)
+		if len(deps) != 1 {
+			t.Fatalf("expected 1 deployment, got %d", len(deps))
+		}
+		return deps[0].Spec.Template.Annotations[GenerationAnnotation]
+	}
+
+	first, err := Inject(input, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got := generation(t, first.Output); got != "1" {
+		t.Fatalf("expected generation 1 after the first injection, got %q", got)
+	}
+
+	noop, err := Inject(first.Output, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got := generation(t, noop.Output); got != "1" || len(noop.Changed) != 0 {
+		t.Fatalf("expected generation to hold at 1 on a no-op run, got %q (changed: %v)", got, noop.Changed)
+	}
+
+	changed, err := Inject(strings.Replace(noop.Output, "key: one", "key: two", 1), opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got := generation(t, changed.Output); got != "2" {
+		t.Fatalf("expected generation 2 after the checksum changed, got %q", got)
+	}
+
+	invalid := strings.Replace(changed.Output, GenerationAnnotation+`: "2"`, GenerationAnnotation+`: many`, 1)
+	if _, err := Inject(strings.Replace(invalid, "key: two", "key: three", 1), opts); err == nil || !strings.Contains(err.Error(), "must be a non-negative integer") {
+		t.Fatalf("expected an invalid counter to be reported, got %v", err)
+	}
+}
+
+func TestInjectAnnotationSizeLimit(t *testing.T) {
+	var input strings.Builder
+	var refs strings.Builder
+	// 2000 keys of 72 bytes with 64-byte checksums add up to 272000 bytes.
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("config-%04d-%s", i, strings.Repeat("x", 41))
+		fmt.Fprintf(&input, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\ndata:\n  key: value\n---\n", name)
+		fmt.Fprintf(&refs, "            - configMapRef:\n                name: %s\n", name)
+	}
+	input.WriteString(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+` + refs.String())
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	if _, err := Inject(input.String(), Options{Mode: ModeAnnotation, HashLength: 64, Logger: logger}); err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if !strings.Contains(buf.String(), "level=WARN") || !strings.Contains(buf.String(), "Deployment/app: Pod template annotations total") {
+		t.Fatalf("expected a warning about the annotation size, got:\n%s", buf.String())
+	}
+
+	_, err := Inject(input.String(), Options{Mode: ModeAnnotation, HashLength: 64, Strict: true})
+	if err == nil || !strings.Contains(err.Error(), "more than the 262144 bytes Kubernetes accepts") {
+		t.Fatalf("expected the annotation size to fail strict mode, got %v", err)
+	}
+
+	if _, err := Inject(input.String(), Options{Mode: ModeLabel, HashLength: 63, Strict: true}); err != nil {
+		t.Fatalf("expected labels not to count towards the annotation limit, got %v", err)
+	}
+}
+
+func TestInjectOnlyMissing(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: value
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+stringData:
+  token: x
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      annotations:
+        checksum/configmap-app-config: stale
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation, OnlyMissing: true, Prune: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	deps := decodeDeployments(t, res.Output)
+	if len(deps) != 1 {
+		t.Fatalf("expected 1 deployment, got %d", len(deps))
+	}
+	annotations := deps[0].Spec.Template.Annotations
+	if got := annotations["checksum/configmap-app-config"]; got != "stale" {
+		t.Fatalf("expected the existing checksum to be left untouched, got %q", got)
+	}
+	if got := annotations["checksum/secret-app-secret"]; got == "" || got == "stale" {
+		t.Fatalf("expected the missing checksum to be added, got %q", got)
+	}
+	if len(res.Keys) != 1 || res.Keys[0].Key != "checksum/secret-app-secret" {
+		t.Fatalf("expected only the added key to be reported, got %+v", res.Keys)
+	}
+}
+
+func TestInjectDefaultNamespace(t *testing.T) {
+	manifest := func(namespace string) string {
+		return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config` + namespace + `
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	}
+	explicit := manifest("\n  namespace: default")
+	omitted := manifest("")
+
+	opts := Options{Mode: ModeAnnotation, KeyTemplate: "checksum/{{.Namespace}}-{{.Name}}", DefaultNamespace: "default"}
+	want, err := Inject(explicit, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	got, err := Inject(omitted, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got.GlobalDigest != want.GlobalDigest {
+		t.Fatalf("expected an omitted namespace to digest like an explicit default, got %s, want %s", got.GlobalDigest, want.GlobalDigest)
+	}
+	for _, res := range []*Result{want, got} {
+		if len(res.Keys) != 1 || res.Keys[0].Key != "checksum/default-app-config" || res.Keys[0].Workload.Namespace != "default" {
+			t.Fatalf("expected the workload to be in the default namespace, got %+v", res.Keys)
+		}
+	}
+
+	opts.DefaultNamespace, opts.KeyTemplate = "", ""
+	plain, err := Inject(omitted, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if plain.GlobalDigest == want.GlobalDigest {
+		t.Fatalf("expected an omitted namespace to stay empty without DefaultNamespace")
+	}
+}
+
+func TestInjectResolvesByNamespace(t *testing.T) {
+	source := func(namespace, name, value string) string {
+		return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ` + name + namespace + `
+data:
+  key: ` + value + `
+---
+`
+	}
+	workload := func(namespace string) string {
+		return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app` + namespace + `
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app
+            - configMapRef:
+                name: shared
+---
+`
+	}
+	input := source("\n  namespace: prod", "app", "one") +
+		source("\n  namespace: dev", "app", "two") +
+		source("", "shared", "three") +
+		workload("\n  namespace: prod") +
+		workload("\n  namespace: dev") +
+		workload("\n  namespace: staging") +
+		workload("")
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	sums := map[string]map[string]string{}
+	for _, w := range res.References {
+		sums[w.Workload.Namespace] = map[string]string{}
+		for _, ref := range w.References {
+			if ref.Resolved {
+				sums[w.Workload.Namespace][ref.Name] = ref.Checksum
+			}
+		}
+	}
+	prod, dev, staging, none := sums["prod"], sums["dev"], sums["staging"], sums[""]
+	if prod["app"] == "" || dev["app"] == "" || prod["app"] == dev["app"] {
+		t.Fatalf("expected the ConfigMaps named app in prod and dev to resolve separately, got %v", sums)
+	}
+	if _, ok := staging["app"]; ok {
+		t.Fatalf("expected no ConfigMap app in staging, got %v", staging)
+	}
+	// A source without a namespace is applied alongside any workload, and
+	// a workload without one resolves by name as before.
+	for ns, got := range sums {
+		if got["shared"] == "" {
+			t.Fatalf("expected shared to resolve in namespace %q, got %v", ns, got)
+		}
+	}
+	if none["app"] != dev["app"] {
+		t.Fatalf("expected a workload without a namespace to resolve the last app, got %v", none)
+	}
+}
+
+func TestInjectPreservesQuotingOfUpdatedValues(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+stringData:
+  password: s3cret
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      annotations:
+        checksum/configmap-app-config: "stale"
+        checksum/secret-db: 'stale'
+        enabled: "true"
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: db
+`
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	cmSum, secretSum := res.Keys[0].Value, res.Keys[1].Value
+	want := strings.NewReplacer(
+		`checksum/configmap-app-config: "stale"`, `checksum/configmap-app-config: "`+cmSum+`"`,
+		`checksum/secret-db: 'stale'`, `checksum/secret-db: '`+secretSum+`'`,
+	).Replace(input)
+	if res.Output != want {
+		t.Fatalf("expected updated values to keep their quoting\nwant:\n%s\ngot:\n%s", want, res.Output)
+	}
+}
+
+func TestInjectEmptyAsAbsent(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: empty-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: empty-config
+            - configMapRef:
+                name: absent-config
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Keys) != 1 || res.Keys[0].Key != "checksum/configmap-empty-config" {
+		t.Fatalf("expected the empty ConfigMap to be injected by default, got %+v", res.Keys)
+	}
+
+	res, err = Inject(input, Options{Mode: ModeAnnotation, EmptyAsAbsent: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Keys) != 0 {
+		t.Fatalf("expected nothing to be injected for the empty ConfigMap, got %+v", res.Keys)
+	}
+	for _, ref := range res.References[0].References {
+		if ref.Resolved || ref.Empty != (ref.Name == "empty-config") {
+			t.Fatalf("expected only the empty ConfigMap to be reported as empty, got %+v", ref)
+		}
+	}
+
+	_, err = Inject(input, Options{Mode: ModeAnnotation, EmptyAsAbsent: true, Strict: true})
+	want := "Deployment/app: ConfigMap \"absent-config\" not found in input\nDeployment/app: ConfigMap \"empty-config\" is empty, which counts as absent"
+	if err == nil || err.Error() != want {
+		t.Fatalf("expected strict errors telling empty from missing\nwant: %s\ngot:  %v", want, err)
 	}
-	return doc, dep
 }
@@ -0,0 +1,100 @@
+package injector
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// KeyTemplateData is what Options.KeyTemplate is evaluated against, once
+// per referenced ConfigMap or Secret.
+type KeyTemplateData struct {
+	// Kind is KindConfigMap or KindSecret.
+	Kind string
+	// Name is the referenced object's name.
+	Name string
+	// SanitizedName is Name as used in default keys: without a kustomize
+	// hash suffix under StripNameSuffix, and with dots replaced by dashes.
+	SanitizedName string
+	// Namespace is the workload's namespace, empty if it does not set one.
+	Namespace string
+}
+
+// parseKeyTemplate parses a key template and checks that it renders a legal
+// key for a typical reference, so mistakes surface before any workload is
+// processed.
+func parseKeyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	sample := KeyTemplateData{Kind: KindConfigMap, Name: "app-config", SanitizedName: "app-config", Namespace: "default"}
+	if _, err := renderKey(tmpl, sample); err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderKey evaluates tmpl for data and validates the result as a label and
+// annotation key.
+func renderKey(tmpl *template.Template, data KeyTemplateData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	key := b.String()
+	if problems := validation.IsQualifiedName(key); len(problems) > 0 {
+		return "", fmt.Errorf("key %q for %s %s is not a legal key: %s", key, data.Kind, data.Name, strings.Join(problems, "; "))
+	}
+	return key, nil
+}
+
+// keyTemplates are the parsed Options.KeyTemplate and ExistingKeyFormat, if
+// they are templates. Both are parsed once per run; the zero value renders
+// the default keys.
+type keyTemplates struct {
+	key      *template.Template
+	existing *template.Template
+}
+
+// parseKeyTemplates parses the key templates of opts.
+func parseKeyTemplates(opts Options) (keyTemplates, error) {
+	var templates keyTemplates
+	if opts.KeyTemplate != "" {
+		tmpl, err := parseKeyTemplate(opts.KeyTemplate)
+		if err != nil {
+			return keyTemplates{}, err
+		}
+		templates.key = tmpl
+	}
+	existing, err := parseExistingKeyFormat(opts.ExistingKeyFormat)
+	if err != nil {
+		return keyTemplates{}, err
+	}
+	templates.existing = existing
+	return templates, nil
+}
+
+// parseExistingKeyFormat parses Options.ExistingKeyFormat. It returns nil for
+// an empty format or a plain key prefix.
+func parseExistingKeyFormat(format string) (*template.Template, error) {
+	if !strings.Contains(format, "{{") {
+		return nil, nil
+	}
+	tmpl, err := parseKeyTemplate(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid existing key format: %w", err)
+	}
+	return tmpl, nil
+}
+
+// existingKey returns the key an earlier run wrote the entry's checksum
+// under, given Options.ExistingKeyFormat and its parsed template, if any.
+func (e checksumEntry) existingKey(format string, tmpl *template.Template) (string, error) {
+	if tmpl == nil {
+		return format + e.name, nil
+	}
+	return renderKey(tmpl, e.data)
+}
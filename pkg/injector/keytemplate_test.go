@@ -0,0 +1,168 @@
+package injector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const keyTemplateManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app.config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+stringData:
+  TOKEN: abc
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app.config
+            - secretRef:
+                name: app-secret
+`
+
+func TestInjectKeyTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{
+			template: "cfg.example.com/{{.Kind}}-{{.SanitizedName}}",
+			want:     []string{"cfg.example.com/ConfigMap-app-config", "cfg.example.com/Secret-app-secret"},
+		},
+		{
+			template: "{{.Namespace}}.example.com/{{.Name}}",
+			want:     []string{"prod.example.com/app.config", "prod.example.com/app-secret"},
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := Inject(keyTemplateManifest, Options{Mode: ModeAnnotation, KeyTemplate: tt.template})
+		if err != nil {
+			t.Fatalf("%s: Inject: %v", tt.template, err)
+		}
+		var got []string
+		for _, k := range res.Keys {
+			got = append(got, k.Key)
+			if err := k.Validate(); err != nil {
+				t.Fatalf("%s: %v", tt.template, err)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: expected keys %v, got %v", tt.template, tt.want, got)
+		}
+		for _, key := range tt.want {
+			if !strings.Contains(res.Output, key+": ") {
+				t.Fatalf("%s: expected %s in output, got:\n%s", tt.template, key, res.Output)
+			}
+		}
+	}
+}
+
+func TestInjectKeyTemplateErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "checksum/{{.Kind", want: "invalid key template"},
+		{template: "checksum/{{.Missing}}", want: "invalid key template"},
+		{template: "checksum/{{.Kind}} {{.Name}}", want: "invalid key template"},
+		// Legal for the sample ConfigMap checked up front, but not for Secrets.
+		{template: `checksum/{{.Name}}{{if eq .Kind "Secret"}}-{{end}}`, want: `Deployment/prod/app: key "checksum/app-secret-" for Secret app-secret is not a legal key`},
+		// Without .Kind or .Name, both references render the same key.
+		{template: "checksum/{{.Namespace}}", want: `Deployment/prod/app: ConfigMap app.config and Secret app-secret both have the key "checksum/prod"`},
+	}
+
+	for _, tt := range tests {
+		_, err := Inject(keyTemplateManifest, Options{Mode: ModeAnnotation, KeyTemplate: tt.template})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("%s: expected an error containing %q, got %v", tt.template, tt.want, err)
+		}
+	}
+}
+
+func TestInjectExistingKeyFormat(t *testing.T) {
+	fresh, err := Inject(keyTemplateManifest, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	sums := map[string]string{}
+	for _, k := range fresh.Keys {
+		sums[strings.TrimPrefix(k.Key, "checksum/")] = k.Value
+	}
+	withAnnotations := func(annotations map[string]string) string {
+		var b strings.Builder
+		b.WriteString("  template:\n    metadata:\n      annotations:\n")
+		for _, key := range sortedKeys(annotations) {
+			b.WriteString("        " + key + ": " + annotations[key] + "\n")
+		}
+		return strings.Replace(keyTemplateManifest, "  template:\n", b.String(), 1)
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		// legacy renders the key an earlier run used for a default key name.
+		legacy func(name string) string
+	}{
+		{name: "prefix", format: "legacy/", legacy: func(name string) string { return "legacy/" + name }},
+		{name: "template", format: "legacy.example.com/{{.Name}}", legacy: func(name string) string {
+			if strings.HasPrefix(name, "secret-") {
+				return "legacy.example.com/app-secret"
+			}
+			return "legacy.example.com/app.config"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			legacy := map[string]string{}
+			for name, sum := range sums {
+				legacy[tt.legacy(name)] = sum
+			}
+			opts := Options{Mode: ModeAnnotation, ExistingKeyFormat: tt.format}
+			res, err := Inject(withAnnotations(legacy), opts)
+			if err != nil {
+				t.Fatalf("Inject: %v", err)
+			}
+			if len(res.Changed) != 0 {
+				t.Fatalf("expected no drift when the legacy checksums match, got %v", res.Changed)
+			}
+			if !strings.Contains(res.Output, "checksum/") {
+				t.Fatalf("expected checksums to be written in the current format, got:\n%s", res.Output)
+			}
+
+			for key := range legacy {
+				legacy[key] = "000000000000"
+				break
+			}
+			res, err = Inject(withAnnotations(legacy), opts)
+			if err != nil {
+				t.Fatalf("Inject: %v", err)
+			}
+			want := []WorkloadRef{{Kind: "Deployment", Namespace: "prod", Name: "app"}}
+			if !reflect.DeepEqual(res.Changed, want) {
+				t.Fatalf("expected drift for a stale legacy checksum, got %v", res.Changed)
+			}
+		})
+	}
+
+	if _, err := Inject(keyTemplateManifest, Options{Mode: ModeAnnotation, ExistingKeyFormat: "legacy/{{.Kind"}); err == nil || !strings.Contains(err.Error(), "invalid existing key format") {
+		t.Fatalf("expected an invalid existing key format to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package injector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	sigyaml "sigs.k8s.io/yaml"
+)
+
+// workloadKind describes a kind of object that carries a Pod template.
+type workloadKind struct {
+	kind string
+	// group restricts the kind to one API group, for kinds whose name is
+	// also used by other groups. Empty matches any apiVersion.
+	group string
+	// templatePath is the path from the document root to the Pod template,
+	// whose "spec" is scanned for references and whose "metadata" receives
+	// the checksums.
+	templatePath []string
+}
+
+// workloadKinds is the registry of kinds checksums are injected into.
+var workloadKinds = []workloadKind{
+	{kind: "Deployment", templatePath: []string{"spec", "template"}},
+	{kind: "StatefulSet", templatePath: []string{"spec", "template"}},
+	{kind: "DaemonSet", templatePath: []string{"spec", "template"}},
+	// Jobs are left out: their Pod template is immutable, so re-applying a
+	// Job with a new checksum fails. A CronJob's jobTemplate can change and
+	// only affects the Jobs it creates from then on.
+	{kind: "CronJob", templatePath: []string{"spec", "jobTemplate", "spec", "template"}},
+	// ReplicaSets (apps/v1) and ReplicationControllers (v1) are usually
+	// owned by a Deployment, but can be applied standalone.
+	{kind: "ReplicaSet", templatePath: []string{"spec", "template"}},
+	{kind: "ReplicationController", templatePath: []string{"spec", "template"}},
+	// DeploymentConfig is the OpenShift (apps.openshift.io/v1) predecessor
+	// of Deployment; there is no typed client for it, but its Pod template
+	// sits at the same path.
+	{kind: "DeploymentConfig", templatePath: []string{"spec", "template"}},
+	// PodTemplate (v1) has no spec of its own; the template sits at the root.
+	{kind: "PodTemplate", templatePath: []string{"template"}},
+	// A Knative Service (serving.knative.dev/v1) cuts a new Revision on
+	// every template change. Core v1 Services have no Pod template.
+	{kind: "Service", group: "serving.knative.dev", templatePath: []string{"spec", "template"}},
+}
+
+// KindInfo describes a supported workload kind.
+type KindInfo struct {
+	Kind string
+	// Group is the API group the kind has to belong to, e.g.
+	// "serving.knative.dev" for Knative Services. Empty means any.
+	Group string
+	// PodSpecPath is the dotted path from the document root to the Pod spec
+	// that is scanned for references, e.g. "spec.template.spec". Checksums
+	// go into the metadata next to it.
+	PodSpecPath string
+}
+
+// SupportedKinds lists the workload kinds checksums are injected into, in
+// registry order.
+func SupportedKinds() []KindInfo {
+	kinds := make([]KindInfo, 0, len(workloadKinds))
+	for _, k := range workloadKinds {
+		path := append(append([]string{}, k.templatePath...), "spec")
+		kinds = append(kinds, KindInfo{Kind: k.kind, Group: k.group, PodSpecPath: strings.Join(path, ".")})
+	}
+	return kinds
+}
+
+// lookupWorkloadKind returns the registered kind for a document's apiVersion
+// and kind.
+func lookupWorkloadKind(apiVersion, kind string) (workloadKind, bool) {
+	group := ""
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		group = apiVersion[:i]
+	}
+	for _, k := range workloadKinds {
+		if k.kind == kind && (k.group == "" || k.group == group) {
+			return k, true
+		}
+	}
+	return workloadKind{}, false
+}
+
+// genericWorkloadKind returns a kind for an unregistered document with a Pod
+// spec below the template at templatePath, as set by Options.PodTemplatePath.
+// Documents without one are not workloads.
+func genericWorkloadKind(doc *yaml.Node, kind string, templatePath []string) (workloadKind, bool) {
+	if kind == "" || len(templatePath) == 0 {
+		return workloadKind{}, false
+	}
+	spec := append(append([]string{}, templatePath...), "spec")
+	if findMap(documentRoot(doc), spec...) == nil {
+		return workloadKind{}, false
+	}
+	return workloadKind{kind: kind, templatePath: templatePath}, true
+}
+
+// parsePodTemplatePath splits a dotted path such as "spec.template".
+func parsePodTemplatePath(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	segments := strings.Split(path, ".")
+	for _, s := range segments {
+		if s == "" {
+			return nil, fmt.Errorf("invalid pod template path %q: empty path segment", path)
+		}
+	}
+	return segments, nil
+}
+
+// metadataPath returns the path to the Pod template metadata field (labels or
+// annotations).
+func (k workloadKind) metadataPath(field string) []string {
+	path := append([]string{}, k.templatePath...)
+	return append(path, "metadata", field)
+}
+
+// workloadDoc is a workload document together with its decoded Pod spec.
+type workloadDoc struct {
+	node *yaml.Node
+	kind workloadKind
+	ref  WorkloadRef
+	spec *corev1.PodSpec
+}
+
+// decodeWorkload decodes the Pod spec and identity of a workload document.
+func decodeWorkload(doc *yaml.Node, kind workloadKind) (workloadDoc, error) {
+	root := documentRoot(doc)
+	if root == nil || root.Kind != yaml.MappingNode {
+		return workloadDoc{}, fmt.Errorf("empty document")
+	}
+	spec, err := podSpecFromNode(root, kind.templatePath)
+	if err != nil {
+		return workloadDoc{}, err
+	}
+	return workloadDoc{
+		node: doc,
+		kind: kind,
+		ref: WorkloadRef{
+			Kind:      kind.kind,
+			Namespace: scalarAt(root, "metadata", "namespace"),
+			Name:      scalarAt(root, "metadata", "name"),
+		},
+		spec: spec,
+	}, nil
+}
+
+// podSpecFromNode decodes the Pod spec of the template found at templatePath
+// below node. A missing template yields an empty spec.
+func podSpecFromNode(node *yaml.Node, templatePath []string) (*corev1.PodSpec, error) {
+	spec := &corev1.PodSpec{}
+	path := append(append([]string{}, templatePath...), "spec")
+	specNode := findMap(node, path...)
+	if specNode == nil {
+		return spec, nil
+	}
+	data, err := yaml.Marshal(specNode)
+	if err != nil {
+		return nil, err
+	}
+	if err := sigyaml.Unmarshal(data, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// scaledToZero reports whether the workload explicitly sets spec.replicas to
+// 0. A missing or null field defaults to one replica.
+func (w workloadDoc) scaledToZero() bool {
+	replicas, err := strconv.Atoi(scalarAt(documentRoot(w.node), "spec", "replicas"))
+	return err == nil && replicas == 0
+}
+
+// labels returns the workload's own metadata.labels, ignoring non-string
+// values.
+func (w workloadDoc) labels() map[string]string {
+	labels := map[string]string{}
+	m := findMap(documentRoot(w.node), "metadata", "labels")
+	if m == nil {
+		return labels
+	}
+	for i := 0; i < len(m.Content)-1; i += 2 {
+		if m.Content[i+1].Kind == yaml.ScalarNode {
+			labels[m.Content[i].Value] = m.Content[i+1].Value
+		}
+	}
+	return labels
+}
+
+// scalarAt returns the scalar value at path below node, or "" if absent.
+func scalarAt(node *yaml.Node, path ...string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	parent := findMap(node, path[:len(path)-1]...)
+	if parent == nil {
+		return ""
+	}
+	last := path[len(path)-1]
+	for i := 0; i < len(parent.Content)-1; i += 2 {
+		if parent.Content[i].Value == last && parent.Content[i+1].Kind == yaml.ScalarNode {
+			return parent.Content[i+1].Value
+		}
+	}
+	return ""
+}
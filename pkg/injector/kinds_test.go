@@ -0,0 +1,550 @@
+package injector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	sigyaml "sigs.k8s.io/yaml"
+)
+
+const samplePodTemplate = `  template:
+    metadata:
+      labels:
+        app: demo
+    spec:
+      imagePullSecrets:
+        - name: registry
+      volumes:
+        - name: cfg
+          configMap:
+            name: app-config
+      containers:
+        - name: app
+          envFrom:
+            - secretRef:
+                name: app-secret
+`
+
+func decodeWorkloadManifest(t *testing.T, manifest string) workloadDoc {
+	t.Helper()
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(manifest), doc); err != nil {
+		t.Fatalf("failed to decode YAML: %v", err)
+	}
+	kind, ok := lookupWorkloadKind(scalarAt(documentRoot(doc), "apiVersion"), getKind(doc))
+	if !ok {
+		t.Fatalf("unsupported workload kind %q", getKind(doc))
+	}
+	w, err := decodeWorkload(doc, kind)
+	if err != nil {
+		t.Fatalf("decodeWorkload: %v", err)
+	}
+	return w
+}
+
+func TestReferencedObjectsIdenticalAcrossKinds(t *testing.T) {
+	deployment := decodeWorkloadManifest(t, "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n"+samplePodTemplate)
+	statefulSet := decodeWorkloadManifest(t, "apiVersion: apps/v1\nkind: StatefulSet\nmetadata:\n  name: db\n  namespace: data\nspec:\n  serviceName: db\n"+samplePodTemplate)
+
+	want := []Reference{
+		{Kind: KindConfigMap, Name: "app-config", Source: SourceVolume},
+		{Kind: KindSecret, Name: "app-secret", Source: SourceEnvFrom},
+		{Kind: KindSecret, Name: "registry", Source: SourceImagePullSecret},
+	}
+	if got := referencedObjects(deployment.spec, Options{CredentialSecrets: true}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Deployment references mismatch\nwant: %+v\ngot:  %+v", want, got)
+	}
+	if got := referencedObjects(statefulSet.spec, Options{CredentialSecrets: true}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("StatefulSet references mismatch\nwant: %+v\ngot:  %+v", want, got)
+	}
+
+	if want := (WorkloadRef{Kind: "StatefulSet", Namespace: "data", Name: "db"}); statefulSet.ref != want {
+		t.Fatalf("StatefulSet ref mismatch\nwant: %+v\ngot:  %+v", want, statefulSet.ref)
+	}
+}
+
+func TestInjectChecksumsAllWorkloadKinds(t *testing.T) {
+	sources := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  TOKEN: QVBJX1RPS0VO
+`
+
+	for _, kind := range []string{"Deployment", "StatefulSet", "DaemonSet"} {
+		t.Run(kind, func(t *testing.T) {
+			input := sources + "---\napiVersion: apps/v1\nkind: " + kind + "\nmetadata:\n  name: demo\nspec:\n" + samplePodTemplate
+			res, err := Inject(input, Options{Mode: ModeAnnotation})
+			if err != nil {
+				t.Fatalf("Inject: %v", err)
+			}
+			if len(res.Changed) != 1 || res.Changed[0].Kind != kind {
+				t.Fatalf("expected %s to be reported as changed, got %v", kind, res.Changed)
+			}
+			for _, key := range []string{"checksum/configmap-app-config", "checksum/secret-app-secret"} {
+				if !strings.Contains(res.Output, key) {
+					t.Fatalf("expected %s in output, got:\n%s", key, res.Output)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectSkipsJobs(t *testing.T) {
+	input := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app-config\ndata:\n  LOG_LEVEL: info\n---\n" +
+		"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: migrate\nspec:\n" + samplePodTemplate
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if res.Output != input || len(res.Changed) != 0 {
+		t.Fatalf("expected the Job to be passed through unchanged, got changed %v and:\n%s", res.Changed, res.Output)
+	}
+}
+
+func TestInjectChecksumsReplicaSetAndReplicationController(t *testing.T) {
+	tests := []struct {
+		name     string
+		workload string
+		want     string
+	}{
+		{
+			name: "ReplicaSet referencing a ConfigMap",
+			workload: `apiVersion: apps/v1
+kind: ReplicaSet
+metadata:
+  name: standalone
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: standalone
+  template:
+    metadata:
+      labels:
+        app: standalone
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`,
+			want: "checksum/configmap-app-config",
+		},
+		{
+			name: "ReplicationController referencing a Secret",
+			workload: `apiVersion: v1
+kind: ReplicationController
+metadata:
+  name: legacy
+spec:
+  replicas: 1
+  selector:
+    app: legacy
+  template:
+    metadata:
+      labels:
+        app: legacy
+    spec:
+      volumes:
+        - name: creds
+          secret:
+            secretName: app-secret
+      containers:
+        - name: app
+`,
+			want: "checksum/secret-app-secret",
+		},
+	}
+	sources := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  TOKEN: QVBJX1RPS0VO
+---
+`
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Inject(sources+tt.workload, Options{Mode: ModeAnnotation})
+			if err != nil {
+				t.Fatalf("Inject: %v", err)
+			}
+			if len(res.Keys) != 1 || res.Keys[0].Key != tt.want {
+				t.Fatalf("expected only %s to be injected, got %+v", tt.want, res.Keys)
+			}
+			docs := strings.Split(res.Output, "---\n")
+			doc := &yaml.Node{}
+			if err := yaml.Unmarshal([]byte(docs[len(docs)-1]), doc); err != nil {
+				t.Fatalf("failed to decode output: %v", err)
+			}
+			if got := scalarAt(documentRoot(doc), "spec", "template", "metadata", "annotations", tt.want); got != res.Keys[0].Value {
+				t.Fatalf("expected %s on spec.template.metadata, got:\n%s", tt.want, res.Output)
+			}
+		})
+	}
+}
+
+func TestInjectChecksumsDeploymentConfig(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps.openshift.io/v1
+kind: DeploymentConfig
+metadata:
+  name: legacy
+spec:
+  replicas: 1
+  triggers:
+    - type: ConfigChange
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if want := []WorkloadRef{{Kind: "DeploymentConfig", Name: "legacy"}}; !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("changed mismatch\nwant: %v\ngot:  %v", want, res.Changed)
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(strings.SplitN(res.Output, "---\n", 2)[1]), doc); err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	annotations := findMap(documentRoot(doc), "spec", "template", "metadata", "annotations")
+	if annotations == nil || len(annotations.Content) != 2 || annotations.Content[0].Value != "checksum/configmap-app-config" {
+		t.Fatalf("expected checksum annotation on spec.template.metadata, got:\n%s", res.Output)
+	}
+}
+
+func TestInjectChecksumsKnativeService(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: serving.knative.dev/v1
+kind: Service
+metadata:
+  name: hello
+spec:
+  template:
+    metadata:
+      annotations:
+        autoscaling.knative.dev/min-scale: "1"
+    spec:
+      containers:
+        - image: example.com/hello
+          envFrom:
+            - configMapRef:
+                name: app-config
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: hello-core
+spec:
+  selector:
+    app: hello
+  template:
+    spec:
+      containers:
+        - envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if want := []WorkloadRef{{Kind: "Service", Name: "hello"}}; !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("expected only the Knative Service to change\nwant: %v\ngot:  %v", want, res.Changed)
+	}
+
+	docs := strings.Split(res.Output, "---\n")
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(docs[1]), doc); err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	annotations := findMap(documentRoot(doc), "spec", "template", "metadata", "annotations")
+	if annotations == nil || len(annotations.Content) != 4 || annotations.Content[2].Value != "checksum/configmap-app-config" {
+		t.Fatalf("expected checksum annotation on spec.template.metadata, got:\n%s", res.Output)
+	}
+	if strings.Contains(docs[2], "checksum/") {
+		t.Fatalf("expected the core Service to be left alone, got:\n%s", docs[2])
+	}
+}
+
+func TestInjectChecksumsPodTemplate(t *testing.T) {
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  TOKEN: QVBJX1RPS0VO
+---
+apiVersion: v1
+kind: PodTemplate
+metadata:
+  name: worker
+template:
+  metadata:
+    labels:
+      app: worker
+  spec:
+    containers:
+      - name: worker
+        env:
+          - name: TOKEN
+            valueFrom:
+              secretKeyRef:
+                name: app-secret
+                key: TOKEN
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if want := []WorkloadRef{{Kind: "PodTemplate", Name: "worker"}}; !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("changed mismatch\nwant: %v\ngot:  %v", want, res.Changed)
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(strings.SplitN(res.Output, "---\n", 2)[1]), doc); err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	labels := findMap(documentRoot(doc), "template", "metadata", "labels")
+	if labels == nil || len(labels.Content) != 4 || labels.Content[2].Value != "checksum/secret-app-secret" {
+		t.Fatalf("expected checksum label on template.metadata, got:\n%s", res.Output)
+	}
+}
+
+func TestInjectChecksumsCronJob(t *testing.T) {
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: backup-credentials
+data:
+  TOKEN: QVBJX1RPS0VO
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  schedule: "0 3 * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          restartPolicy: OnFailure
+          volumes:
+            - name: creds
+              secret:
+                secretName: backup-credentials
+          containers:
+            - name: backup
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	cronJob := &batchv1.CronJob{}
+	if err := sigyaml.Unmarshal([]byte(strings.SplitN(res.Output, "---\n", 2)[1]), cronJob); err != nil {
+		t.Fatalf("failed to decode CronJob: %v", err)
+	}
+	s := &corev1.Secret{Data: map[string][]byte{"TOKEN": []byte("API_TOKEN")}}
+	s.Name = "backup-credentials"
+	want := map[string]string{"checksum/secret-backup-credentials": hashSecret(s, Options{})}
+	if got := cronJob.Spec.JobTemplate.Spec.Template.Annotations; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Pod template annotations mismatch\nwant: %v\ngot:  %v\noutput:\n%s", want, got, res.Output)
+	}
+	if cronJob.Spec.JobTemplate.Annotations != nil || cronJob.Annotations != nil {
+		t.Fatalf("expected only the Pod template to be annotated, got:\n%s", res.Output)
+	}
+}
+
+func TestInjectLabelsCronJob(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: report-config
+data:
+  FORMAT: csv
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: report
+  labels:
+    team: data
+spec:
+  schedule: "*/15 * * * *"
+  jobTemplate:
+    metadata:
+      labels:
+        team: data
+    spec:
+      template:
+        metadata:
+          labels:
+            app: report
+        spec:
+          restartPolicy: Never
+          containers:
+            - name: report
+              envFrom:
+                - configMapRef:
+                    name: report-config
+`
+
+	opts := Options{Mode: ModeLabel}
+	res, err := Inject(input, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	cronJob := &batchv1.CronJob{}
+	if err := sigyaml.Unmarshal([]byte(strings.SplitN(res.Output, "---\n", 2)[1]), cronJob); err != nil {
+		t.Fatalf("failed to decode CronJob: %v", err)
+	}
+	cm := &corev1.ConfigMap{Data: map[string]string{"FORMAT": "csv"}}
+	cm.Name = "report-config"
+	want := map[string]string{"app": "report", "checksum/configmap-report-config": hashConfigMap(cm, opts)}
+	if got := cronJob.Spec.JobTemplate.Spec.Template.Labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Pod template labels mismatch\nwant: %v\ngot:  %v\noutput:\n%s", want, got, res.Output)
+	}
+	unchanged := map[string]string{"team": "data"}
+	if !reflect.DeepEqual(cronJob.Labels, unchanged) || !reflect.DeepEqual(cronJob.Spec.JobTemplate.Labels, unchanged) {
+		t.Fatalf("expected only the Pod template to be labelled, got:\n%s", res.Output)
+	}
+	if cronJob.Spec.JobTemplate.Spec.Template.Annotations != nil {
+		t.Fatalf("expected no annotations in label mode, got:\n%s", res.Output)
+	}
+}
+
+func TestInjectUnknownAPIVersion(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v2
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	res, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	want := []WorkloadRef{{Kind: "Deployment", Name: "web"}}
+	if !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("expected a Deployment of an unknown apiVersion to be processed, got %v", res.Changed)
+	}
+	if !strings.Contains(res.Output, "apiVersion: apps/v2") {
+		t.Fatalf("expected the apiVersion to be preserved, got:\n%s", res.Output)
+	}
+}
+
+func TestInjectPodTemplatePath(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+spec:
+  runner:
+    template:
+      spec:
+        containers:
+          - name: app
+            envFrom:
+              - configMapRef:
+                  name: app-config
+---
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: gadget
+spec:
+  size: 3
+`
+	res, err := Inject(input, Options{Mode: ModeLabel, PodTemplatePath: "spec.runner.template", ExtraAnnotations: map[string]string{"example.com/build": "1"}})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	want := []WorkloadRef{{Kind: "Widget", Name: "widget"}}
+	if !reflect.DeepEqual(res.Changed, want) {
+		t.Fatalf("expected only the object with a Pod template to change, got %v", res.Changed)
+	}
+	if !strings.Contains(res.Output, "  runner:\n    template:\n      spec:") || !strings.Contains(res.Output, "checksum/configmap-app-config:") {
+		t.Fatalf("expected a checksum in the Widget's Pod template, got:\n%s", res.Output)
+	}
+
+	res, err = Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Changed) != 0 {
+		t.Fatalf("expected unregistered kinds to be left alone by default, got %v", res.Changed)
+	}
+
+	if _, err := Inject(input, Options{Mode: ModeLabel, PodTemplatePath: "spec..template"}); err == nil || !strings.Contains(err.Error(), "invalid pod template path") {
+		t.Fatalf("expected an invalid path to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package injector
+
+import (
+	"log/slog"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// warnIdenticalSources logs every group of differently named ConfigMaps, or
+// Secrets, whose data is identical. Checksums include the object name, so
+// such copies never collide, but they often point at a copy-paste mistake.
+// Sources without data are not reported.
+func warnIdenticalSources(log *slog.Logger, configMaps []*corev1.ConfigMap, secrets []*corev1.Secret, opts Options) {
+	// Hash the content alone: the same options minus the name and salt.
+	contentOpts := Options{TrimValues: opts.TrimValues}
+
+	var cmNames, cmDigests []string
+	for _, cm := range configMaps {
+		if len(cm.Data) == 0 {
+			continue
+		}
+		anonymous := *cm
+		anonymous.Name = ""
+		cmNames = append(cmNames, cm.Name)
+		cmDigests = append(cmDigests, hashConfigMap(&anonymous, contentOpts))
+	}
+	logIdentical(log, KindConfigMap, cmNames, cmDigests)
+
+	var secretNames, secretDigests []string
+	for _, s := range secrets {
+		if len(effectiveSecretData(s)) == 0 {
+			continue
+		}
+		anonymous := *s
+		anonymous.Name = ""
+		secretNames = append(secretNames, s.Name)
+		secretDigests = append(secretDigests, hashSecret(&anonymous, contentOpts))
+	}
+	logIdentical(log, KindSecret, secretNames, secretDigests)
+}
+
+// logIdentical warns once per digest shared by more than one distinct name,
+// listing the names in input order.
+func logIdentical(log *slog.Logger, kind string, names, digests []string) {
+	groups := map[string][]string{}
+	var order []string
+	for i, digest := range digests {
+		group := groups[digest]
+		if len(group) == 0 {
+			order = append(order, digest)
+		}
+		duplicate := false
+		for _, name := range group {
+			duplicate = duplicate || name == names[i]
+		}
+		if !duplicate {
+			groups[digest] = append(group, names[i])
+		}
+	}
+	for _, digest := range order {
+		if group := groups[digest]; len(group) > 1 {
+			log.Warn("sources have identical content", "kind", kind, "names", strings.Join(group, ","))
+		}
+	}
+}
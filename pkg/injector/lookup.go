@@ -0,0 +1,91 @@
+package injector
+
+import (
+	"context"
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SourceLookup fetches ConfigMaps and Secrets that workloads reference but
+// the input does not contain, typically from a live cluster. Implementations
+// return a nil object and nil error when the object does not exist.
+type SourceLookup interface {
+	ConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error)
+	Secret(ctx context.Context, namespace, name string) (*corev1.Secret, error)
+}
+
+// lookupMissing resolves references that are absent from cmHashes and
+// secretHashes through opts.Lookup and records the checksums of the objects
+// it finds under the namespace of the workload they were fetched for, so
+// they resolve for that namespace only. Failed or timed-out lookups are logged and leave
+// the reference unresolved, so Strict reports it like any other missing
+// source.
+func lookupMissing(workloads []workloadDoc, cmHashes, secretHashes sourceHashes, opts Options) {
+	log := opts.logger()
+	type object struct{ kind, namespace, name string }
+	tried := map[object]bool{}
+	for _, w := range workloads {
+		for _, ref := range referencedObjects(w.spec, opts) {
+			key := object{kind: ref.Kind, namespace: w.ref.Namespace, name: ref.Name}
+			if tried[key] {
+				continue
+			}
+			tried[key] = true
+
+			hashes := cmHashes
+			if ref.Kind == KindSecret {
+				hashes = secretHashes
+			}
+			if _, _, ok := hashes.resolve(w.ref.Namespace, ref.Name); ok {
+				continue
+			}
+			if _, _, ok := hashes.resolve(w.ref.Namespace, stripNameSuffix(ref.Name)); opts.StripNameSuffix && ok {
+				continue
+			}
+
+			sum, found, err := lookupSource(w.ref.Namespace, ref, opts)
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				log.Warn("lookup timed out", "kind", ref.Kind, "namespace", w.ref.Namespace, "name", ref.Name, "timeout", opts.Timeout)
+			case err != nil:
+				log.Warn("lookup failed", "kind", ref.Kind, "namespace", w.ref.Namespace, "name", ref.Name, "error", err)
+			case found:
+				log.Info("resolved reference by lookup", "kind", ref.Kind, "namespace", w.ref.Namespace, "name", ref.Name)
+				hashes.sums[sourceID{w.ref.Namespace, ref.Name}] = sum
+			}
+		}
+	}
+}
+
+// lookupSource fetches and hashes one referenced object, bounding the call by
+// opts.Timeout when it is set.
+func lookupSource(namespace string, ref Reference, opts Options) (string, bool, error) {
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	if ref.Kind == KindSecret {
+		s, err := opts.Lookup.Secret(ctx, namespace, ref.Name)
+		if err != nil || s == nil {
+			return "", false, err
+		}
+		sum := hashSecret(s, opts)
+		if opts.UseResourceVersion && s.ResourceVersion != "" {
+			sum = s.ResourceVersion
+		}
+		return sourceChecksum(sum, s.Immutable, len(effectiveSecretData(s)) == 0, opts), true, nil
+	}
+	cm, err := opts.Lookup.ConfigMap(ctx, namespace, ref.Name)
+	if err != nil || cm == nil {
+		return "", false, err
+	}
+	sum := hashConfigMap(cm, opts)
+	if opts.UseResourceVersion && cm.ResourceVersion != "" {
+		sum = cm.ResourceVersion
+	}
+	return sourceChecksum(sum, cm.Immutable, len(cm.Data) == 0 && len(cm.BinaryData) == 0, opts), true, nil
+}
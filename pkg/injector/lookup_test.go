@@ -0,0 +1,156 @@
+package injector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeLookup serves ConfigMaps from a map after an optional delay.
+type fakeLookup struct {
+	configMaps map[string]*corev1.ConfigMap
+	delay      time.Duration
+	calls      int
+}
+
+func (f *fakeLookup) ConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	f.calls++
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return f.configMaps[namespace+"/"+name], nil
+}
+
+func (f *fakeLookup) Secret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	f.calls++
+	return nil, nil
+}
+
+const lookupManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    spec:
+      volumes:
+        - name: cfg
+          configMap:
+            name: remote-config
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: remote-config
+`
+
+func TestInjectLookupResolvesMissingSources(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "debug"}}
+	cm.Name = "remote-config"
+	lookup := &fakeLookup{configMaps: map[string]*corev1.ConfigMap{"prod/remote-config": cm}}
+
+	res, err := Inject(lookupManifest, Options{Mode: ModeAnnotation, Lookup: lookup, Strict: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if lookup.calls != 1 {
+		t.Fatalf("expected one lookup, got %d", lookup.calls)
+	}
+	want := "checksum/configmap-remote-config: " + hashConfigMap(cm, Options{})
+	if !strings.Contains(res.Output, want) {
+		t.Fatalf("expected %q in output, got:\n%s", want, res.Output)
+	}
+}
+
+func TestInjectLookupTimeout(t *testing.T) {
+	cm := &corev1.ConfigMap{}
+	cm.Name = "remote-config"
+	lookup := &fakeLookup{configMaps: map[string]*corev1.ConfigMap{"prod/remote-config": cm}, delay: time.Second}
+	opts := Options{Mode: ModeAnnotation, Lookup: lookup, Timeout: 10 * time.Millisecond}
+
+	start := time.Now()
+	res, err := Inject(lookupManifest, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the lookup to be cut off by the timeout, took %s", elapsed)
+	}
+	if len(res.Changed) != 0 {
+		t.Fatalf("expected the timed-out reference to stay unresolved, got changes %v", res.Changed)
+	}
+
+	opts.Strict = true
+	_, err = Inject(lookupManifest, opts)
+	if err == nil || !strings.Contains(err.Error(), `ConfigMap "remote-config" not found`) {
+		t.Fatalf("expected strict mode to report the timed-out reference, got %v", err)
+	}
+}
+
+func TestInjectOfflineSkipsLookup(t *testing.T) {
+	lookup := &fakeLookup{}
+
+	res, err := Inject(lookupManifest, Options{Mode: ModeAnnotation, Lookup: lookup, Offline: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if lookup.calls != 0 {
+		t.Fatalf("expected no lookups in offline mode, got %d", lookup.calls)
+	}
+	if len(res.Changed) != 0 {
+		t.Fatalf("expected no changes, got %v", res.Changed)
+	}
+}
+
+func TestInjectLookupUseResourceVersion(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "debug"}}
+	cm.Name = "remote-config"
+	cm.ResourceVersion = "48213"
+	lookup := &fakeLookup{configMaps: map[string]*corev1.ConfigMap{"prod/remote-config": cm}}
+
+	res, err := Inject(lookupManifest, Options{Mode: ModeLabel, Lookup: lookup, UseResourceVersion: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Keys) != 1 || res.Keys[0].Value != "48213" {
+		t.Fatalf("expected the resourceVersion as checksum, got %+v", res.Keys)
+	}
+
+	res, err = Inject(lookupManifest, Options{Mode: ModeLabel, Lookup: lookup})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Keys) != 1 || res.Keys[0].Value != hashConfigMap(cm, Options{}) {
+		t.Fatalf("expected a content hash by default, got %+v", res.Keys)
+	}
+}
+
+func TestInjectLookupKeyedByNamespace(t *testing.T) {
+	prod := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "info"}}
+	prod.Name, prod.Namespace = "remote-config", "prod"
+	staging := &corev1.ConfigMap{Data: map[string]string{"LOG_LEVEL": "debug"}}
+	staging.Name, staging.Namespace = "remote-config", "staging"
+	lookup := &fakeLookup{configMaps: map[string]*corev1.ConfigMap{"prod/remote-config": prod, "staging/remote-config": staging}}
+
+	input := lookupManifest + "---\n" + strings.Replace(lookupManifest, "namespace: prod", "namespace: staging", 1)
+	res, err := Inject(input, Options{Mode: ModeLabel, Lookup: lookup, Strict: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if lookup.calls != 2 {
+		t.Fatalf("expected one lookup per namespace, got %d", lookup.calls)
+	}
+	want := []string{hashConfigMap(prod, Options{}), hashConfigMap(staging, Options{})}
+	if want[0] == want[1] {
+		t.Fatalf("test needs distinct checksums per namespace")
+	}
+	if len(res.Keys) != 2 || res.Keys[0].Value != want[0] || res.Keys[1].Value != want[1] {
+		t.Fatalf("expected each workload to get the checksum of its own namespace's ConfigMap %v, got %+v", want, res.Keys)
+	}
+}
@@ -0,0 +1,96 @@
+package injector
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Metrics counts what the injector did across runs that share it through
+// Options.Metrics. It is safe for concurrent use and serves its counters in
+// the Prometheus text exposition format, so a long-running process can
+// mount it as its /metrics handler. The zero value is ready to use.
+type Metrics struct {
+	mu         sync.Mutex
+	workloads  uint64
+	changed    uint64
+	checksums  uint64
+	unresolved uint64
+}
+
+// observe records one processed workload. A nil Metrics records nothing.
+func (m *Metrics) observe(update workloadUpdate) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workloads++
+	if update.changed {
+		m.changed++
+	}
+	for _, c := range update.changes {
+		if c.Op != "remove" {
+			m.checksums++
+		}
+	}
+	for _, r := range update.references {
+		if !r.Resolved && !r.Ignored && !r.Unrendered {
+			m.unresolved++
+		}
+	}
+}
+
+// MetricCounts is a snapshot of the counters of a Metrics.
+type MetricCounts struct {
+	// Workloads is the number of workloads whose Pod templates were
+	// processed.
+	Workloads uint64
+	// Changed is the number of workloads whose Pod template metadata was
+	// changed.
+	Changed uint64
+	// Checksums is the number of checksum keys added to or updated in Pod
+	// templates. Keys that already hold their checksum are not counted.
+	Checksums uint64
+	// Unresolved is the number of references without a source, excluding
+	// ignored sources.
+	Unresolved uint64
+}
+
+// Counts returns the current counters.
+func (m *Metrics) Counts() MetricCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MetricCounts{Workloads: m.workloads, Changed: m.changed, Checksums: m.checksums, Unresolved: m.unresolved}
+}
+
+// WriteTo writes the counters in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	c := m.Counts()
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"checksum_injector_workloads_processed_total", "Workloads whose Pod templates were processed.", c.Workloads},
+		{"checksum_injector_workloads_changed_total", "Workloads whose Pod template metadata was changed.", c.Changed},
+		{"checksum_injector_checksums_injected_total", "Checksum keys added to or updated in Pod templates.", c.Checksums},
+		{"checksum_injector_references_unresolved_total", "ConfigMap and Secret references without a source, excluding ignored sources.", c.Unresolved},
+	}
+
+	var written int64
+	for _, c := range counters {
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ServeHTTP serves the counters in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
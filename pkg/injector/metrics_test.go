@@ -0,0 +1,95 @@
+package injector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: ca
+          configMap:
+            name: kube-root-ca.crt
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: missing-secret
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: static
+spec:
+  template:
+    spec:
+      containers:
+        - name: static
+`
+
+	metrics := &Metrics{}
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := Inject(input, Options{Mode: ModeLabel, Metrics: metrics}); err != nil {
+			t.Fatalf("Inject: %v", err)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("expected a text/plain response, got %q", ct)
+	}
+
+	for _, want := range []string{
+		"# TYPE checksum_injector_workloads_processed_total counter\nchecksum_injector_workloads_processed_total 4\n",
+		"checksum_injector_workloads_changed_total 2\n",
+		"checksum_injector_checksums_injected_total 2\n",
+		"checksum_injector_references_unresolved_total 2\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+
+	// Checksums that are already in place are not counted again.
+	res, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	rerun := &Metrics{}
+	if _, err := Inject(res.Output, Options{Mode: ModeLabel, Metrics: rerun}); err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if c := rerun.Counts(); c.Workloads != 2 || c.Changed != 0 || c.Checksums != 0 {
+		t.Fatalf("expected no checksums counted for unchanged workloads, got %+v", c)
+	}
+}
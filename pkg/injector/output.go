@@ -0,0 +1,213 @@
+package injector
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// OutputOrder selects the order documents are written in.
+type OutputOrder string
+
+const (
+	// OrderPreserve keeps the input order.
+	OrderPreserve OutputOrder = "preserve"
+	// OrderKind groups documents by kind in the order they should be
+	// applied, so Namespaces, ConfigMaps and Secrets precede the workloads
+	// that need them. Documents of the same kind keep their input order, and
+	// kinds without a known priority come last.
+	OrderKind OutputOrder = "kind"
+)
+
+// applyOrder lists kinds in the order they are applied, following Helm's
+// install order.
+var applyOrder = []string{
+	"Namespace",
+	"NetworkPolicy",
+	"ResourceQuota",
+	"LimitRange",
+	"PodDisruptionBudget",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"CustomResourceDefinition",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"PodTemplate",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"DeploymentConfig",
+	"HorizontalPodAutoscaler",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"IngressClass",
+	"Ingress",
+	"APIService",
+}
+
+func validateOutputOrder(order OutputOrder) error {
+	switch order {
+	case "", OrderPreserve, OrderKind:
+		return nil
+	}
+	return fmt.Errorf("invalid output order: %s (must be 'preserve' or 'kind')", order)
+}
+
+// orderDocuments returns docs in the given order. The slice is only copied
+// when it is reordered.
+func orderDocuments(docs []*yaml.Node, order OutputOrder) []*yaml.Node {
+	if order != OrderKind {
+		return docs
+	}
+	priority := make(map[string]int, len(applyOrder))
+	for i, kind := range applyOrder {
+		priority[kind] = i
+	}
+	rank := func(doc *yaml.Node) int {
+		if p, ok := priority[getKind(doc)]; ok {
+			return p
+		}
+		return len(applyOrder)
+	}
+	sorted := append([]*yaml.Node(nil), docs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]) < rank(sorted[j]) })
+	return sorted
+}
+
+// writeDocuments renders docs as a multi-document YAML stream to w. Raw
+// documents are copied verbatim between the rendered ones.
+func writeDocuments(w io.Writer, docs []*yaml.Node, opts Options) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	docs = orderDocuments(docs, opts.OutputOrder)
+	// A leading empty document only survives a round trip if it is
+	// introduced by a marker of its own.
+	if opts.DocStart || isEmptyDocument(docs[0]) {
+		// yaml.v3 only separates documents, so the first marker is ours.
+		if _, err := io.WriteString(w, "---\n"); err != nil {
+			return fmt.Errorf("failed to render YAML: %w", err)
+		}
+	}
+	// A raw document ends the encoder's stream; the next rendered document
+	// starts a new one, which needs a marker of its own.
+	var encoder *yaml.Encoder
+	written := false
+	closeEncoder := func() error {
+		if encoder == nil {
+			return nil
+		}
+		err := encoder.Close()
+		encoder = nil
+		if err != nil {
+			return fmt.Errorf("failed to finalize YAML output: %w", err)
+		}
+		return nil
+	}
+	for _, doc := range docs {
+		if isRawDocument(doc) {
+			if err := closeEncoder(); err != nil {
+				return err
+			}
+			if err := writeRawDocument(w, doc.Value, written); err != nil {
+				return err
+			}
+			written = true
+			continue
+		}
+		if encoder == nil {
+			if written {
+				if _, err := io.WriteString(w, "---\n"); err != nil {
+					return fmt.Errorf("failed to render YAML: %w", err)
+				}
+			}
+			encoder = yaml.NewEncoder(w)
+			encoder.SetIndent(2)
+		}
+		if opts.Canonicalize {
+			canonicalizeNode(doc)
+		}
+		if opts.Compact {
+			if root := documentRoot(doc); root != nil {
+				for _, child := range root.Content {
+					compactNode(child)
+				}
+			}
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return fmt.Errorf("failed to render YAML: %w", err)
+		}
+		written = true
+	}
+	return closeEncoder()
+}
+
+// writeRawDocument copies text to w, preceded by a document marker if it
+// follows another document and has none of its own.
+func writeRawDocument(w io.Writer, text string, separate bool) error {
+	firstLine, _, _ := strings.Cut(text, "\n")
+	if separate && !isDocumentSeparator(firstLine) {
+		text = "---\n" + text
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	if _, err := io.WriteString(w, text); err != nil {
+		return fmt.Errorf("failed to render YAML: %w", err)
+	}
+	return nil
+}
+
+// compactNode switches node and the collections below it to flow style,
+// except those holding comments. It reports whether node's subtree is free
+// of comments.
+func compactNode(node *yaml.Node) bool {
+	clean := !hasComments(node)
+	for _, child := range node.Content {
+		if !compactNode(child) {
+			clean = false
+		}
+	}
+	if clean && (node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode) {
+		node.Style |= yaml.FlowStyle
+	}
+	return clean
+}
+
+// canonicalizeNode normalizes the style of node and its descendants in
+// place: mapping keys are sorted and every node falls back to the encoder's
+// default style. Comments stay attached to their nodes.
+func canonicalizeNode(node *yaml.Node) {
+	if node == nil {
+		return
+	}
+	node.Style = 0
+	if node.Kind == yaml.MappingNode {
+		type entry struct{ key, value *yaml.Node }
+		entries := make([]entry, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			entries = append(entries, entry{node.Content[i], node.Content[i+1]})
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].key.Value < entries[j].key.Value })
+		node.Content = node.Content[:0]
+		for _, e := range entries {
+			node.Content = append(node.Content, e.key, e.value)
+		}
+	}
+	for _, child := range node.Content {
+		canonicalizeNode(child)
+	}
+}
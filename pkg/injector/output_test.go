@@ -0,0 +1,412 @@
+package injector
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestInjectCanonicalize(t *testing.T) {
+	input := `kind: ConfigMap
+apiVersion: v1
+metadata: {name: app-config, labels: {tier: "backend", app: 'demo'}}
+data:
+  LOG_LEVEL: "info"
+  FEATURE_FLAG: "true"
+---
+kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers: [{name: app, image: "app:1", envFrom: [{configMapRef: {name: app-config}}]}]
+`
+
+	want := `apiVersion: v1
+data:
+  FEATURE_FLAG: "true"
+  LOG_LEVEL: info
+kind: ConfigMap
+metadata:
+  labels:
+    app: demo
+    tier: backend
+  name: app-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        checksum/configmap-app-config: 5984ee0ab1d9
+    spec:
+      containers:
+        - envFrom:
+            - configMapRef:
+                name: app-config
+          image: app:1
+          name: app
+`
+
+	got, err := InjectChecksumsWithOptions(input, Options{Mode: ModeLabel, Canonicalize: true})
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+	if got != want {
+		t.Fatalf("canonical output mismatch\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	again, err := InjectChecksumsWithOptions(got, Options{Mode: ModeLabel, Canonicalize: true})
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+	if again != got {
+		t.Fatalf("expected canonical output to be stable\nfirst:\n%s\nsecond:\n%s", got, again)
+	}
+}
+
+func TestInjectAnnotateSource(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        checksum/configmap-app-config: stale # hand-written
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+	want := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        checksum/configmap-app-config: c2cb39c0e655 # from ConfigMap app-config
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+	opts := Options{Mode: ModeLabel, AnnotateSource: true}
+	got, err := InjectChecksumsWithOptions(input, opts)
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+	if got != want {
+		t.Fatalf("annotated output mismatch\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	again, err := InjectChecksumsWithOptions(got, opts)
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+	if again != got {
+		t.Fatalf("expected annotated output to be stable\nfirst:\n%s\nsecond:\n%s", got, again)
+	}
+}
+
+func TestInjectDocStart(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`
+
+	want := "---\n" + input
+	got, err := InjectChecksumsWithOptions(input, Options{Mode: ModeLabel, DocStart: true})
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+	if got != want {
+		t.Fatalf("output mismatch\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	got, err = InjectChecksumsWithOptions("---\n"+input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+	if got != input {
+		t.Fatalf("expected no leading marker by default\nwant:\n%s\ngot:\n%s", input, got)
+	}
+
+	empty, err := InjectChecksumsWithOptions("", Options{Mode: ModeLabel, DocStart: true})
+	if err != nil {
+		t.Fatalf("InjectChecksumsWithOptions: %v", err)
+	}
+	if empty != "" {
+		t.Fatalf("expected empty output for empty input, got %q", empty)
+	}
+}
+
+func TestInjectPreserveEmptyDocs(t *testing.T) {
+	input := `---
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+---
+`
+
+	countDocs := func(s string) int {
+		t.Helper()
+		decoder := yaml.NewDecoder(strings.NewReader(s))
+		n := 0
+		for {
+			var doc yaml.Node
+			err := decoder.Decode(&doc)
+			if err == io.EOF {
+				return n
+			}
+			if err != nil {
+				t.Fatalf("failed to parse output: %v", err)
+			}
+			n++
+		}
+	}
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation, PreserveEmptyDocs: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got, want := countDocs(res.Output), countDocs(input); got != want {
+		t.Fatalf("expected %d documents, got %d:\n%s", want, got, res.Output)
+	}
+	if !strings.HasPrefix(res.Output, "---\n") || !strings.HasSuffix(res.Output, "---\n\n") {
+		t.Fatalf("expected the leading and trailing empty documents to survive, got:\n%s", res.Output)
+	}
+	if !strings.Contains(res.Output, "checksum/configmap-app-config:") {
+		t.Fatalf("expected the other documents to be processed, got:\n%s", res.Output)
+	}
+
+	res, err = Inject(input, Options{Mode: ModeAnnotation})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got := countDocs(res.Output); got != 2 {
+		t.Fatalf("expected empty documents to be dropped by default, got %d documents:\n%s", got, res.Output)
+	}
+}
+
+func TestInjectOutputOrderKind(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-config
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: prod
+`
+
+	kinds := func(output string) []string {
+		t.Helper()
+		var kinds []string
+		decoder := yaml.NewDecoder(strings.NewReader(output))
+		for {
+			doc := &yaml.Node{}
+			err := decoder.Decode(doc)
+			if err == io.EOF {
+				return kinds
+			}
+			if err != nil {
+				t.Fatalf("failed to parse output: %v", err)
+			}
+			kinds = append(kinds, getKind(doc)+"/"+scalarAt(documentRoot(doc), "metadata", "name"))
+		}
+	}
+
+	tests := []struct {
+		order OutputOrder
+		want  []string
+	}{
+		{order: "", want: []string{"Deployment/app", "Widget/widget", "ConfigMap/app-config", "Service/app", "ConfigMap/other-config", "Namespace/prod"}},
+		{order: OrderPreserve, want: []string{"Deployment/app", "Widget/widget", "ConfigMap/app-config", "Service/app", "ConfigMap/other-config", "Namespace/prod"}},
+		{order: OrderKind, want: []string{"Namespace/prod", "ConfigMap/app-config", "ConfigMap/other-config", "Service/app", "Deployment/app", "Widget/widget"}},
+	}
+	for _, tt := range tests {
+		res, err := Inject(input, Options{Mode: ModeLabel, OutputOrder: tt.order})
+		if err != nil {
+			t.Fatalf("order %q: Inject: %v", tt.order, err)
+		}
+		if got := kinds(res.Output); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Fatalf("order %q: expected %v, got %v", tt.order, tt.want, got)
+		}
+		if !strings.Contains(res.Output, "checksum/configmap-app-config:") {
+			t.Fatalf("order %q: expected the workload to be injected, got:\n%s", tt.order, res.Output)
+		}
+	}
+
+	if _, err := Inject(input, Options{Mode: ModeLabel, OutputOrder: "alphabetical"}); err == nil || !strings.Contains(err.Error(), "invalid output order") {
+		t.Fatalf("expected an invalid output order error, got %v", err)
+	}
+}
+
+func TestInjectCompact(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+  script: |
+    echo hi
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: demo # owner
+spec:
+  replicas: 2
+  template:
+    metadata:
+      labels:
+        app: demo
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	want := `apiVersion: v1
+kind: ConfigMap
+metadata: {name: app-config}
+data: {LOG_LEVEL: info, script: "echo hi\n"}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: demo # owner
+spec: {replicas: 2, template: {metadata: {labels: {app: demo, checksum/configmap-app-config: 506e5a191678}}, spec: {containers: [{name: app, envFrom: [{configMapRef: {name: app-config}}]}]}}}
+`
+
+	compact, err := Inject(input, Options{Mode: ModeLabel, Compact: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if compact.Output != want {
+		t.Fatalf("compact output mismatch\nwant:\n%s\ngot:\n%s", want, compact.Output)
+	}
+
+	block, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if strings.Contains(block.Output, "{") {
+		t.Fatalf("expected block style by default, got:\n%s", block.Output)
+	}
+	compactDocs, blockDocs := decodeAll(t, compact.Output), decodeAll(t, block.Output)
+	if !reflect.DeepEqual(compactDocs, blockDocs) {
+		t.Fatalf("expected compact and block output to hold the same data\ncompact: %v\nblock:   %v", compactDocs, blockDocs)
+	}
+}
+
+func decodeAll(t *testing.T, stream string) []interface{} {
+	t.Helper()
+	var docs []interface{}
+	dec := yaml.NewDecoder(strings.NewReader(stream))
+	for {
+		var doc interface{}
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return docs
+		}
+		if err != nil {
+			t.Fatalf("failed to parse output: %v", err)
+		}
+		docs = append(docs, doc)
+	}
+}
@@ -0,0 +1,42 @@
+package injector
+
+import (
+	"runtime"
+	"sync"
+)
+
+// forEach calls fn for every index in [0, n) on a pool of workers
+// goroutines and returns once all calls finished. A workers value below one
+// means GOMAXPROCS; one runs every call sequentially on the calling
+// goroutine.
+func forEach(n, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,187 @@
+package injector
+
+import (
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// PatchOperation is one RFC 6902 JSON Patch operation.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// WorkloadPatch is the JSON Patch that turns a workload in the input into
+// its injected form.
+type WorkloadPatch struct {
+	Workload   WorkloadRef
+	Operations []PatchOperation
+	// ApplyConfiguration is the same change for server-side apply: a partial
+	// object with the workload's identity and only the Pod template labels
+	// and annotations the injector writes, so a field manager applying it
+	// owns exactly those fields.
+	ApplyConfiguration map[string]interface{}
+}
+
+// metadataSnapshot records the Pod template labels and annotations of a
+// workload before injection.
+type metadataSnapshot struct {
+	kind workloadKind
+	// depth is the number of leading metadata path elements that exist as
+	// mappings, per field.
+	depth map[string]int
+	// values holds the string entries of each field that exists.
+	values map[string]map[string]string
+}
+
+// snapshotMetadata captures the labels and annotations of w so the changes
+// made by processWorkloadDoc can be expressed as a patch afterwards.
+func snapshotMetadata(w workloadDoc) metadataSnapshot {
+	snap := metadataSnapshot{kind: w.kind, depth: map[string]int{}, values: map[string]map[string]string{}}
+	root := documentRoot(w.node)
+	for _, mode := range []Mode{ModeLabel, ModeAnnotation} {
+		field := metadataField(mode)
+		path := w.kind.metadataPath(field)
+		depth := 0
+		for depth < len(path) && findMap(root, path[:depth+1]...) != nil {
+			depth++
+		}
+		snap.depth[field] = depth
+		if depth == len(path) {
+			snap.values[field] = stringMap(findMap(root, path...))
+		}
+	}
+	return snap
+}
+
+// patch compares the snapshot with the current state of w and returns the
+// operations that reproduce the difference. Missing parent objects are
+// created with a single "add" carrying the whole subtree.
+func (snap metadataSnapshot) patch(w workloadDoc) []PatchOperation {
+	root := documentRoot(w.node)
+	var ops []PatchOperation
+	created := 0
+	for _, mode := range []Mode{ModeLabel, ModeAnnotation} {
+		field := metadataField(mode)
+		path := snap.kind.metadataPath(field)
+		after := stringMap(findMap(root, path...))
+
+		depth := snap.depth[field]
+		if depth < created {
+			// An earlier operation created this parent for the other field.
+			depth = created
+		}
+		if depth < len(path) {
+			if len(after) == 0 {
+				continue
+			}
+			var value interface{} = after
+			for i := len(path) - 1; i > depth; i-- {
+				value = map[string]interface{}{path[i]: value}
+			}
+			ops = append(ops, PatchOperation{Op: "add", Path: jsonPointer(path[:depth+1]...), Value: value})
+			if depth+1 < len(path) {
+				created = depth + 1
+			}
+			continue
+		}
+
+		before := snap.values[field]
+		keys := make([]string, 0, len(before)+len(after))
+		for k := range before {
+			keys = append(keys, k)
+		}
+		for k := range after {
+			if _, ok := before[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			old, hadOld := before[k]
+			value, hasNew := after[k]
+			keyPath := jsonPointer(append(path, k)...)
+			switch {
+			case !hadOld && hasNew:
+				ops = append(ops, PatchOperation{Op: "add", Path: keyPath, Value: value})
+			case hadOld && !hasNew:
+				ops = append(ops, PatchOperation{Op: "remove", Path: keyPath})
+			case old != value:
+				ops = append(ops, PatchOperation{Op: "replace", Path: keyPath, Value: value})
+			}
+		}
+	}
+	return ops
+}
+
+// applyConfiguration builds the server-side apply configuration for the
+// keys and the extra entries, by metadata field, written to w.
+func applyConfiguration(w workloadDoc, keys []InjectedKey, extra map[string]map[string]string) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for _, k := range keys {
+		m, _ := fields[k.Field].(map[string]interface{})
+		if m == nil {
+			m = map[string]interface{}{}
+			fields[k.Field] = m
+		}
+		m[k.Key] = k.Value
+	}
+	for field, entries := range extra {
+		if len(entries) == 0 {
+			continue
+		}
+		m, _ := fields[field].(map[string]interface{})
+		if m == nil {
+			m = map[string]interface{}{}
+			fields[field] = m
+		}
+		for k, v := range entries {
+			m[k] = v
+		}
+	}
+
+	var template interface{} = map[string]interface{}{"metadata": fields}
+	for i := len(w.kind.templatePath) - 1; i > 0; i-- {
+		template = map[string]interface{}{w.kind.templatePath[i]: template}
+	}
+
+	root := documentRoot(w.node)
+	metadata := map[string]interface{}{"name": w.ref.Name}
+	if w.ref.Namespace != "" {
+		metadata["namespace"] = w.ref.Namespace
+	}
+	return map[string]interface{}{
+		"apiVersion":           scalarAt(root, "apiVersion"),
+		"kind":                 w.ref.Kind,
+		"metadata":             metadata,
+		w.kind.templatePath[0]: template,
+	}
+}
+
+// stringMap returns the scalar entries of a mapping node.
+func stringMap(node *yaml.Node) map[string]string {
+	if node == nil {
+		return nil
+	}
+	m := make(map[string]string, len(node.Content)/2)
+	for i := 0; i < len(node.Content)-1; i += 2 {
+		if v := node.Content[i+1]; v.Kind == yaml.ScalarNode {
+			m[node.Content[i].Value] = v.Value
+		}
+	}
+	return m
+}
+
+// jsonPointer renders path as an RFC 6901 JSON Pointer.
+func jsonPointer(path ...string) string {
+	escape := strings.NewReplacer("~", "~0", "/", "~1")
+	var b strings.Builder
+	for _, p := range path {
+		b.WriteString("/")
+		b.WriteString(escape.Replace(p))
+	}
+	return b.String()
+}
@@ -0,0 +1,208 @@
+package injector
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	sigyaml "sigs.k8s.io/yaml"
+)
+
+// applyPatch applies add, replace and remove operations to a decoded JSON
+// document.
+func applyPatch(t *testing.T, doc map[string]interface{}, ops []PatchOperation) {
+	t.Helper()
+	for _, op := range ops {
+		parts := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		for i, p := range parts {
+			parts[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(p)
+		}
+		parent := doc
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := parent[p].(map[string]interface{})
+			if !ok {
+				t.Fatalf("%s %s: parent %q does not exist", op.Op, op.Path, p)
+			}
+			parent = next
+		}
+		last := parts[len(parts)-1]
+		switch op.Op {
+		case "add":
+			parent[last] = op.Value
+		case "replace", "remove":
+			if _, ok := parent[last]; !ok {
+				t.Fatalf("%s %s: target does not exist", op.Op, op.Path)
+			}
+			if op.Op == "remove" {
+				delete(parent, last)
+			} else {
+				parent[last] = op.Value
+			}
+		default:
+			t.Fatalf("unexpected op %q", op.Op)
+		}
+	}
+}
+
+// decodeJSONDocuments decodes every YAML document in stream into generic
+// JSON values.
+func decodeJSONDocuments(t *testing.T, stream string) []map[string]interface{} {
+	t.Helper()
+	var docs []map[string]interface{}
+	for _, part := range strings.Split(stream, "\n---\n") {
+		data, err := sigyaml.YAMLToJSON([]byte(part))
+		if err != nil {
+			t.Fatalf("YAMLToJSON: %v", err)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestInjectPatchesApplyToInput(t *testing.T) {
+	sources := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  TOKEN: QVBJX1RPS0VO
+`
+	tests := []struct {
+		name     string
+		workload string
+		opts     Options
+	}{
+		{
+			name: "missing template metadata",
+			workload: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret
+`,
+			opts: Options{Targets: []Target{{Mode: ModeLabel, Prefix: "checksum/"}, {Mode: ModeAnnotation, Prefix: "example.com/"}}},
+		},
+		{
+			name: "existing and stale keys",
+			workload: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    metadata:
+      annotations:
+        team: payments
+        checksum/configmap-app-config: stale
+        checksum/configmap-removed: stale
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret
+`,
+			opts: Options{Mode: ModeAnnotation, Prune: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := sources + "---\n" + tt.workload
+			res, err := Inject(input, tt.opts)
+			if err != nil {
+				t.Fatalf("Inject: %v", err)
+			}
+			if len(res.Patches) != 1 || res.Patches[0].Workload != res.Changed[0] {
+				t.Fatalf("expected one patch for the changed workload, got %+v", res.Patches)
+			}
+
+			// Round-trip the operations through JSON as a consumer would.
+			data, err := json.Marshal(res.Patches[0].Operations)
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			var ops []PatchOperation
+			if err := json.Unmarshal(data, &ops); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+
+			original := decodeJSONDocuments(t, tt.workload)[0]
+			applyPatch(t, original, ops)
+			injected := decodeJSONDocuments(t, res.Output)[2]
+			if !reflect.DeepEqual(original, injected) {
+				t.Fatalf("patched input does not match output\npatch: %s\ngot:  %v\nwant: %v", data, original, injected)
+			}
+		})
+	}
+}
+
+func TestJSONPointerEscapes(t *testing.T) {
+	got := jsonPointer("metadata", "annotations", "checksum/a~b")
+	if want := "/metadata/annotations/checksum~1a~0b"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestInjectApplyConfiguration(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: report
+  namespace: jobs
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: report
+              envFrom:
+                - configMapRef:
+                    name: app-config
+`
+
+	res, err := Inject(input, Options{Mode: ModeAnnotation, ExtraAnnotations: map[string]string{"example.com/build-id": "42"}})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	got, err := json.Marshal(res.Patches[0].ApplyConfiguration)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	want := `{"apiVersion":"batch/v1","kind":"CronJob","metadata":{"name":"report","namespace":"jobs"},"spec":{"jobTemplate":{"spec":{"template":{"metadata":{"annotations":{"checksum/configmap-app-config":"` +
+		res.Keys[0].Value + `","example.com/build-id":"42"}}}}}}}`
+	if string(got) != want {
+		t.Fatalf("apply configuration mismatch\nwant: %s\ngot:  %s", want, got)
+	}
+}
@@ -0,0 +1,158 @@
+package injector
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// preciseSources digests only the data keys a workload references, for
+// Options.PreciseKeys. It knows the ConfigMaps and Secrets of the input;
+// FileRefs and Lookup sources are not in it and are hashed whole.
+type preciseSources struct {
+	configMaps map[sourceID]*corev1.ConfigMap
+	secrets    map[sourceID]*corev1.Secret
+	// keyOrders are the ConfigMaps' keys in document order, for
+	// OrderSensitive.
+	keyOrders map[*corev1.ConfigMap][]string
+	opts      Options
+}
+
+// newPreciseSources indexes sources by namespace and name, under the same
+// IDs the hash maps resolve references to. Later sources win, as they do in
+// the hash maps, and FileRefs shadow ConfigMaps of the same name.
+// cmKeyOrders parallels configMaps as in process.
+func newPreciseSources(configMaps []*corev1.ConfigMap, cmKeyOrders [][]string, secrets []*corev1.Secret, opts Options) *preciseSources {
+	p := &preciseSources{
+		configMaps: make(map[sourceID]*corev1.ConfigMap, len(configMaps)),
+		secrets:    make(map[sourceID]*corev1.Secret, len(secrets)),
+		keyOrders:  make(map[*corev1.ConfigMap][]string, len(configMaps)),
+		opts:       opts,
+	}
+	for i, cm := range configMaps {
+		if cm.Name != "" {
+			p.configMaps[sourceID{cm.Namespace, cm.Name}] = cm
+		}
+		if opts.OrderSensitive {
+			p.keyOrders[cm] = cmKeyOrders[i]
+		}
+	}
+	for id := range p.configMaps {
+		if _, shadowed := opts.FileRefs[id.name]; shadowed {
+			delete(p.configMaps, id)
+		}
+	}
+	for _, s := range secrets {
+		if s.Name != "" {
+			p.secrets[sourceID{s.Namespace, s.Name}] = s
+		}
+	}
+	if opts.StripNameSuffix {
+		for _, cm := range configMaps {
+			alias := sourceID{cm.Namespace, stripNameSuffix(cm.Name)}
+			if alias.name != cm.Name && alias.name != "" && p.configMaps[alias] == nil {
+				p.configMaps[alias] = cm
+			}
+		}
+		for _, s := range secrets {
+			alias := sourceID{s.Namespace, stripNameSuffix(s.Name)}
+			if alias.name != s.Name && alias.name != "" && p.secrets[alias] == nil {
+				p.secrets[alias] = s
+			}
+		}
+	}
+	return p
+}
+
+// sum digests the given keys of the object id, leaving out keys it does
+// not have and ConfigMap keys listed in ExcludeKeysAnnotation, and returns
+// the keys digested. Under OrderSensitive, ConfigMap keys are digested in
+// document order, as whole ConfigMaps are. ok is false when the object is
+// not known, in which case its whole-object checksum applies.
+func (p *preciseSources) sum(kind string, id sourceID, keys []string) (sum string, hashed []string, ok bool) {
+	if p == nil {
+		return "", nil, false
+	}
+	// hashed is never nil for a known object, so no keys present is told
+	// apart from the whole object.
+	hashed = []string{}
+	if kind == KindSecret {
+		s := p.secrets[id]
+		if s == nil {
+			return "", nil, false
+		}
+		data := effectiveSecretData(s)
+		for _, k := range keys {
+			if _, present := data[k]; present {
+				hashed = append(hashed, k)
+			}
+		}
+		return hashSecretKeys(s, data, hashed, p.opts), hashed, true
+	}
+	cm := p.configMaps[id]
+	if cm == nil {
+		return "", nil, false
+	}
+	if order, ok := p.keyOrders[cm]; ok {
+		keys = inOrder(keys, order)
+	}
+	excluded := excludedKeys(cm)
+	for _, k := range keys {
+		if _, present := cm.Data[k]; present && !excluded[k] {
+			hashed = append(hashed, k)
+		}
+	}
+	return hashConfigMapKeys(cm, hashed, p.opts), hashed, true
+}
+
+// inOrder returns the keys in the order they appear in order.
+func inOrder(keys, order []string) []string {
+	wanted := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		wanted[k] = true
+	}
+	var ordered []string
+	for _, k := range order {
+		if wanted[k] {
+			ordered = append(ordered, k)
+		}
+	}
+	return ordered
+}
+
+// objectScopes merges the keys of every reference to the same object: any
+// whole-object reference makes the object whole, shown by a nil entry, and
+// key references are otherwise combined, sorted.
+func objectScopes(refs []scopedReference) map[Reference][]string {
+	whole := map[Reference]bool{}
+	keys := map[Reference]map[string]bool{}
+	for _, r := range refs {
+		obj := Reference{Kind: r.Kind, Name: r.Name}
+		if r.keys == nil {
+			whole[obj] = true
+			continue
+		}
+		if keys[obj] == nil {
+			keys[obj] = map[string]bool{}
+		}
+		for _, k := range r.keys {
+			keys[obj][k] = true
+		}
+	}
+	scopes := make(map[Reference][]string, len(keys)+len(whole))
+	for obj := range whole {
+		scopes[obj] = nil
+	}
+	for obj, set := range keys {
+		if whole[obj] {
+			continue
+		}
+		list := make([]string, 0, len(set))
+		for k := range set {
+			list = append(list, k)
+		}
+		sort.Strings(list)
+		scopes[obj] = list
+	}
+	return scopes
+}
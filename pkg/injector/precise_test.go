@@ -0,0 +1,157 @@
+package injector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestObjectScopes(t *testing.T) {
+	cm := func(source ReferenceSource, keys ...string) scopedReference {
+		return scopedReference{Reference: Reference{Kind: KindConfigMap, Name: "app-config", Source: source}, keys: keys}
+	}
+	obj := Reference{Kind: KindConfigMap, Name: "app-config"}
+
+	tests := []struct {
+		name string
+		refs []scopedReference
+		want []string
+	}{
+		{name: "keys only", refs: []scopedReference{cm(SourceEnvValueFrom, "b"), cm(SourceVolume, "a", "b")}, want: []string{"a", "b"}},
+		{name: "whole only", refs: []scopedReference{cm(SourceEnvFrom)}, want: nil},
+		{name: "whole before keys", refs: []scopedReference{cm(SourceEnvFrom), cm(SourceEnvValueFrom, "a")}, want: nil},
+		{name: "keys before whole", refs: []scopedReference{cm(SourceEnvValueFrom, "a"), cm(SourceVolume)}, want: nil},
+	}
+	for _, tt := range tests {
+		scopes := objectScopes(tt.refs)
+		got, ok := scopes[obj]
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: expected scope %v, got %v (present: %v)", tt.name, tt.want, got, ok)
+		}
+	}
+}
+
+func TestInjectPreciseKeysWholeObjectWins(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+  PORT: "8080"
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+          env:
+            - name: LOG_LEVEL
+              valueFrom:
+                configMapKeyRef:
+                  name: app-config
+                  key: LOG_LEVEL
+`
+	whole, err := Inject(input, Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	res, err := Inject(input, Options{Mode: ModeLabel, PreciseKeys: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Keys) != 1 {
+		t.Fatalf("expected exactly one checksum for the ConfigMap, got %+v", res.Keys)
+	}
+	if !reflect.DeepEqual(res.Keys, whole.Keys) {
+		t.Fatalf("expected the whole-object checksum\nwant: %+v\ngot:  %+v", whole.Keys, res.Keys)
+	}
+	for _, ref := range res.References[0].References {
+		if ref.HashedKeys != nil {
+			t.Fatalf("expected no reference to be reported as key-scoped, got %+v", ref)
+		}
+	}
+}
+
+func TestInjectPreciseKeysExcludedAndOrdered(t *testing.T) {
+	manifest := func(build string) string {
+		return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+  annotations:
+    checksum-injector.komailo.io/exclude-keys: BUILD
+data:
+  PORT: "8080"
+  LOG_LEVEL: info
+  BUILD: "` + build + `"
+  UNUSED: x
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          env:
+            - name: BUILD
+              valueFrom:
+                configMapKeyRef:
+                  name: app-config
+                  key: BUILD
+            - name: PORT
+              valueFrom:
+                configMapKeyRef:
+                  name: app-config
+                  key: PORT
+            - name: LOG_LEVEL
+              valueFrom:
+                configMapKeyRef:
+                  name: app-config
+                  key: LOG_LEVEL
+`
+	}
+
+	for _, tt := range []struct {
+		orderSensitive bool
+		want           []string
+	}{
+		{false, []string{"LOG_LEVEL", "PORT"}},
+		{true, []string{"PORT", "LOG_LEVEL"}},
+	} {
+		opts := Options{Mode: ModeLabel, PreciseKeys: true, OrderSensitive: tt.orderSensitive}
+		res, err := Inject(manifest("1"), opts)
+		if err != nil {
+			t.Fatalf("Inject: %v", err)
+		}
+		ref := res.References[0].References[0]
+		if !reflect.DeepEqual(ref.HashedKeys, tt.want) {
+			t.Fatalf("order sensitive %v: expected hashed keys %v, got %v", tt.orderSensitive, tt.want, ref.HashedKeys)
+		}
+		cm := &corev1.ConfigMap{Data: map[string]string{"PORT": "8080", "LOG_LEVEL": "info"}}
+		cm.Name = "app-config"
+		if want := hashConfigMapKeys(cm, tt.want, opts); ref.Checksum != want {
+			t.Fatalf("order sensitive %v: expected checksum %s over %v, got %s", tt.orderSensitive, want, tt.want, ref.Checksum)
+		}
+
+		rebuilt, err := Inject(manifest("2"), opts)
+		if err != nil {
+			t.Fatalf("Inject: %v", err)
+		}
+		if rebuilt.Output != strings.Replace(res.Output, `BUILD: "1"`, `BUILD: "2"`, 1) {
+			t.Fatalf("order sensitive %v: expected an excluded key not to change the checksum, got:\n%s", tt.orderSensitive, rebuilt.Output)
+		}
+	}
+}
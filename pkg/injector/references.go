@@ -0,0 +1,368 @@
+package injector
+
+import (
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Kinds of objects a workload can reference.
+const (
+	KindConfigMap = "ConfigMap"
+	KindSecret    = "Secret"
+)
+
+// ReferenceSource describes where in a Pod spec a reference was found.
+type ReferenceSource string
+
+const (
+	SourceVolume          ReferenceSource = "volume"
+	SourceEnvFrom         ReferenceSource = "envFrom"
+	SourceEnvValueFrom    ReferenceSource = "envValueFrom"
+	SourceImagePullSecret ReferenceSource = "imagePullSecret"
+	SourceProjected       ReferenceSource = "projected"
+	SourceCSI             ReferenceSource = "csi"
+)
+
+// Reference is a ConfigMap or Secret referenced from a Pod spec.
+type Reference struct {
+	// Kind is KindConfigMap or KindSecret.
+	Kind string
+	// Name is the referenced object's name.
+	Name string
+	// Optional reports whether the Pod tolerates the object being absent.
+	Optional bool
+	// Source is the Pod spec construct the reference was found in.
+	Source ReferenceSource
+}
+
+// scopedReference is a Reference with the data keys it is limited to, such
+// as the key of an env var's keyRef or the items of a volume, sorted. Nil
+// keys mean the whole object, which wins over keys from the same source.
+type scopedReference struct {
+	Reference
+	keys []string
+}
+
+// DefaultIgnoredSources are the sources ignored when Options.IgnoredSources
+// is nil: ConfigMaps that service meshes and the cluster itself create in
+// every namespace and that sidecars injected by a mutating webhook mount.
+var DefaultIgnoredSources = []string{
+	// Istio's root certificate, mounted by istio-proxy.
+	"istio-ca-root-cert",
+	// Linkerd's trust anchors, mounted by linkerd-proxy.
+	"linkerd-identity-trust-roots",
+	// The API server CA published by the root CA cert publisher.
+	"kube-root-ca.crt",
+}
+
+// ignored reports whether references to name are exempt from being reported
+// as unresolved.
+func (o Options) ignored(name string) bool {
+	sources := o.IgnoredSources
+	if sources == nil {
+		sources = DefaultIgnoredSources
+	}
+	for _, s := range sources {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// unrenderedMarkers are the template delimiters of envsubst, Helm and
+// similar tools, which never appear in a valid object name.
+var unrenderedMarkers = []string{"${", "{{", "}}"}
+
+// unrendered reports whether name contains an unrendered template marker.
+func unrendered(name string) bool {
+	for _, marker := range unrenderedMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedObjects returns the ConfigMaps and Secrets referenced by spec,
+// one entry per kind, name and source, sorted in that order. A reference that
+// is required anywhere within the same source is reported as required.
+// imagePullSecrets and CSI node publish Secrets are only included under
+// Options.CredentialSecrets.
+func referencedObjects(spec *corev1.PodSpec, opts Options) []Reference {
+	scoped := scopedReferences(spec, opts)
+	refs := make([]Reference, len(scoped))
+	for i, r := range scoped {
+		refs[i] = r.Reference
+	}
+	return refs
+}
+
+// scopedReferences is referencedObjects with the keys each reference is
+// limited to.
+func scopedReferences(spec *corev1.PodSpec, opts Options) []scopedReference {
+	type refKey struct {
+		kind   string
+		name   string
+		source ReferenceSource
+	}
+	optional := map[refKey]bool{}
+	// keys holds the keys a reference is limited to; a nil entry means the
+	// whole object.
+	keys := map[refKey]map[string]bool{}
+	addKeys := func(kind, name string, source ReferenceSource, opt *bool, limit []string) {
+		if name == "" {
+			return
+		}
+		k := refKey{kind: kind, name: name, source: source}
+		isOptional := opt != nil && *opt
+		prev, seen := optional[k]
+		if seen {
+			isOptional = prev && isOptional
+		}
+		optional[k] = isOptional
+		if len(limit) == 0 || (seen && keys[k] == nil) {
+			keys[k] = nil
+			return
+		}
+		if keys[k] == nil {
+			keys[k] = map[string]bool{}
+		}
+		for _, key := range limit {
+			keys[k][key] = true
+		}
+	}
+	add := func(kind, name string, source ReferenceSource, opt *bool) {
+		addKeys(kind, name, source, opt, nil)
+	}
+
+	for _, v := range spec.Volumes {
+		if v.ConfigMap != nil {
+			addKeys(KindConfigMap, v.ConfigMap.Name, SourceVolume, v.ConfigMap.Optional, subPathKeys(spec, v.Name, v.ConfigMap.Items))
+		}
+		if v.Secret != nil {
+			addKeys(KindSecret, v.Secret.SecretName, SourceVolume, v.Secret.Optional, subPathKeys(spec, v.Name, v.Secret.Items))
+		}
+		if v.Projected != nil {
+			for _, p := range v.Projected.Sources {
+				if p.ConfigMap != nil {
+					addKeys(KindConfigMap, p.ConfigMap.Name, SourceProjected, p.ConfigMap.Optional, itemKeys(p.ConfigMap.Items))
+				}
+				if p.Secret != nil {
+					addKeys(KindSecret, p.Secret.Name, SourceProjected, p.Secret.Optional, itemKeys(p.Secret.Items))
+				}
+			}
+		}
+		if opts.CredentialSecrets && v.CSI != nil && v.CSI.NodePublishSecretRef != nil {
+			add(KindSecret, v.CSI.NodePublishSecretRef.Name, SourceCSI, nil)
+		}
+	}
+
+	if opts.CredentialSecrets {
+		for _, s := range spec.ImagePullSecrets {
+			add(KindSecret, s.Name, SourceImagePullSecret, nil)
+		}
+	}
+
+	for _, c := range spec.Containers {
+		for _, e := range c.EnvFrom {
+			if e.ConfigMapRef != nil {
+				add(KindConfigMap, e.ConfigMapRef.Name, SourceEnvFrom, e.ConfigMapRef.Optional)
+			}
+			if e.SecretRef != nil {
+				add(KindSecret, e.SecretRef.Name, SourceEnvFrom, e.SecretRef.Optional)
+			}
+		}
+		for _, e := range c.Env {
+			if e.ValueFrom != nil {
+				if r := e.ValueFrom.ConfigMapKeyRef; r != nil {
+					addKeys(KindConfigMap, r.Name, SourceEnvValueFrom, r.Optional, nonEmpty(r.Key))
+				}
+				if r := e.ValueFrom.SecretKeyRef; r != nil {
+					addKeys(KindSecret, r.Name, SourceEnvValueFrom, r.Optional, nonEmpty(r.Key))
+				}
+			}
+		}
+	}
+
+	refs := make([]scopedReference, 0, len(optional))
+	for k, opt := range optional {
+		var limit []string
+		for key := range keys[k] {
+			limit = append(limit, key)
+		}
+		sort.Strings(limit)
+		refs = append(refs, scopedReference{Reference: Reference{Kind: k.kind, Name: k.name, Optional: opt, Source: k.source}, keys: limit})
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Kind != refs[j].Kind {
+			return refs[i].Kind < refs[j].Kind
+		}
+		if refs[i].Name != refs[j].Name {
+			return refs[i].Name < refs[j].Name
+		}
+		return refs[i].Source < refs[j].Source
+	})
+	return refs
+}
+
+// itemKeys returns the keys projected by a volume's items. No items means
+// every key.
+func itemKeys(items []corev1.KeyToPath) []string {
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Key == "" {
+			// An item without a key cannot be resolved; stay conservative.
+			return nil
+		}
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
+
+// subPathKeys returns the keys a ConfigMap or Secret volume exposes to its
+// containers. When every mount of the volume selects a file with subPath,
+// that is only the keys behind those files: the key itself, or the items
+// whose path is the subPath or lies below it. Otherwise, including mounts
+// through subPathExpr, it is every key of items.
+func subPathKeys(spec *corev1.PodSpec, volume string, items []corev1.KeyToPath) []string {
+	all := itemKeys(items)
+	var mounts []corev1.VolumeMount
+	for _, c := range spec.InitContainers {
+		mounts = append(mounts, c.VolumeMounts...)
+	}
+	for _, c := range spec.Containers {
+		mounts = append(mounts, c.VolumeMounts...)
+	}
+	for _, c := range spec.EphemeralContainers {
+		mounts = append(mounts, c.VolumeMounts...)
+	}
+
+	var keys []string
+	for _, m := range mounts {
+		if m.Name != volume {
+			continue
+		}
+		if m.SubPath == "" || m.SubPathExpr != "" {
+			return all
+		}
+		if len(items) == 0 {
+			if strings.Contains(m.SubPath, "/") {
+				return all
+			}
+			keys = append(keys, m.SubPath)
+			continue
+		}
+		matched := false
+		for _, item := range items {
+			if item.Path == m.SubPath || strings.HasPrefix(item.Path, m.SubPath+"/") {
+				if item.Key == "" {
+					return all
+				}
+				keys = append(keys, item.Key)
+				matched = true
+			}
+		}
+		if !matched {
+			return all
+		}
+	}
+	if len(keys) == 0 {
+		return all
+	}
+	return keys
+}
+
+// nonEmpty returns key as a one-element list, or nil for an empty key so a
+// malformed keyRef counts as a reference to the whole object.
+func nonEmpty(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return []string{key}
+}
+
+// unnamedVolumes returns the names of ConfigMap and Secret volumes in spec
+// that do not name their object. The API server rejects them, but they are
+// easy to miss in hand-written manifests because they resolve to nothing.
+func unnamedVolumes(spec *corev1.PodSpec) []string {
+	var volumes []string
+	for _, v := range spec.Volumes {
+		if (v.ConfigMap != nil && v.ConfigMap.Name == "") || (v.Secret != nil && v.Secret.SecretName == "") {
+			volumes = append(volumes, v.Name)
+		}
+	}
+	return volumes
+}
+
+// unnamedKeyRef is an env var whose configMapKeyRef or secretKeyRef does not
+// name its object.
+type unnamedKeyRef struct {
+	container string
+	env       string
+}
+
+// unnamedKeyRefs returns the env vars in spec, in init, regular and
+// ephemeral containers, whose configMapKeyRef or secretKeyRef has an empty
+// name. Like unnamed volumes they resolve to nothing, and usually mean a
+// template rendered an empty value.
+func unnamedKeyRefs(spec *corev1.PodSpec) []unnamedKeyRef {
+	var refs []unnamedKeyRef
+	check := func(container string, env []corev1.EnvVar) {
+		for _, e := range env {
+			if e.ValueFrom == nil {
+				continue
+			}
+			if (e.ValueFrom.ConfigMapKeyRef != nil && e.ValueFrom.ConfigMapKeyRef.Name == "") ||
+				(e.ValueFrom.SecretKeyRef != nil && e.ValueFrom.SecretKeyRef.Name == "") {
+				refs = append(refs, unnamedKeyRef{container: container, env: e.Name})
+			}
+		}
+	}
+	for _, c := range spec.InitContainers {
+		check(c.Name, c.Env)
+	}
+	for _, c := range spec.Containers {
+		check(c.Name, c.Env)
+	}
+	for _, c := range spec.EphemeralContainers {
+		check(c.Name, c.Env)
+	}
+	return refs
+}
+
+// onlyReferenced filters configMaps, with their parallel key orders, and
+// secrets down to those referenced by at least one workload, taking
+// StripNameSuffix matching into account.
+func onlyReferenced(workloads []workloadDoc, configMaps []*corev1.ConfigMap, cmKeyOrders [][]string, secrets []*corev1.Secret, opts Options) ([]*corev1.ConfigMap, [][]string, []*corev1.Secret) {
+	referenced := map[string]map[string]bool{KindConfigMap: {}, KindSecret: {}}
+	for _, w := range workloads {
+		for _, ref := range referencedObjects(w.spec, opts) {
+			referenced[ref.Kind][ref.Name] = true
+			if opts.StripNameSuffix {
+				referenced[ref.Kind][stripNameSuffix(ref.Name)] = true
+			}
+		}
+	}
+	needed := func(kind, name string) bool {
+		return referenced[kind][name] || (opts.StripNameSuffix && referenced[kind][stripNameSuffix(name)])
+	}
+
+	var keptConfigMaps []*corev1.ConfigMap
+	var keptOrders [][]string
+	for i, cm := range configMaps {
+		if needed(KindConfigMap, cm.Name) {
+			keptConfigMaps = append(keptConfigMaps, cm)
+			keptOrders = append(keptOrders, cmKeyOrders[i])
+		}
+	}
+	var keptSecrets []*corev1.Secret
+	for _, s := range secrets {
+		if needed(KindSecret, s.Name) {
+			keptSecrets = append(keptSecrets, s)
+		}
+	}
+	return keptConfigMaps, keptOrders, keptSecrets
+}
@@ -0,0 +1,574 @@
+package injector
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestReferencedObjects(t *testing.T) {
+	optional := true
+	spec := &corev1.PodSpec{
+		Volumes: []corev1.Volume{
+			{
+				Name: "cfg",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "vol-cm"}},
+				},
+			},
+			{
+				Name: "creds",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: "vol-secret"},
+				},
+			},
+			{
+				Name: "bundle",
+				VolumeSource: corev1.VolumeSource{
+					Projected: &corev1.ProjectedVolumeSource{
+						Sources: []corev1.VolumeProjection{
+							{ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "proj-cm"}}},
+							{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "proj-secret"}, Optional: &optional}},
+						},
+					},
+				},
+			},
+			{
+				Name: "csi",
+				VolumeSource: corev1.VolumeSource{
+					CSI: &corev1.CSIVolumeSource{
+						Driver:               "secrets-store.csi.k8s.io",
+						NodePublishSecretRef: &corev1.LocalObjectReference{Name: "csi-secret"},
+					},
+				},
+			},
+		},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+		Containers: []corev1.Container{
+			{
+				EnvFrom: []corev1.EnvFromSource{
+					{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env-cm"}, Optional: &optional}},
+					{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env-secret"}}},
+				},
+				Env: []corev1.EnvVar{
+					{
+						Name: "FROM_CONFIG",
+						ValueFrom: &corev1.EnvVarSource{
+							ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "key-cm"}},
+						},
+					},
+					{
+						Name: "FROM_SECRET",
+						ValueFrom: &corev1.EnvVarSource{
+							SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "key-secret"}},
+						},
+					},
+					{
+						Name:  "NO_REF",
+						Value: "literal",
+					},
+				},
+			},
+		},
+	}
+
+	want := []Reference{
+		{Kind: KindConfigMap, Name: "env-cm", Optional: true, Source: SourceEnvFrom},
+		{Kind: KindConfigMap, Name: "key-cm", Source: SourceEnvValueFrom},
+		{Kind: KindConfigMap, Name: "proj-cm", Source: SourceProjected},
+		{Kind: KindConfigMap, Name: "vol-cm", Source: SourceVolume},
+		{Kind: KindSecret, Name: "csi-secret", Source: SourceCSI},
+		{Kind: KindSecret, Name: "env-secret", Source: SourceEnvFrom},
+		{Kind: KindSecret, Name: "key-secret", Source: SourceEnvValueFrom},
+		{Kind: KindSecret, Name: "proj-secret", Optional: true, Source: SourceProjected},
+		{Kind: KindSecret, Name: "registry", Source: SourceImagePullSecret},
+		{Kind: KindSecret, Name: "vol-secret", Source: SourceVolume},
+	}
+
+	if got := referencedObjects(spec, Options{CredentialSecrets: true}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("references mismatch\nwant: %+v\ngot:  %+v", want, got)
+	}
+
+	var withoutCredentials []Reference
+	for _, ref := range want {
+		if ref.Source != SourceCSI && ref.Source != SourceImagePullSecret {
+			withoutCredentials = append(withoutCredentials, ref)
+		}
+	}
+	if got := referencedObjects(spec, Options{}); !reflect.DeepEqual(got, withoutCredentials) {
+		t.Fatalf("expected credential Secrets to be left out by default\nwant: %+v\ngot:  %+v", withoutCredentials, got)
+	}
+}
+
+func TestReferencedObjectsRequiredWinsWithinSource(t *testing.T) {
+	optional := true
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{EnvFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "shared"}, Optional: &optional}},
+			}},
+			{EnvFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "shared"}}},
+			}},
+		},
+	}
+
+	want := []Reference{{Kind: KindConfigMap, Name: "shared", Source: SourceEnvFrom}}
+	if got := referencedObjects(spec, Options{}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("references mismatch\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
+func TestInjectLogsUnnamedVolumes(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: cfg
+          configMap: {}
+        - name: creds
+          secret:
+            secretName: app-secret
+      containers:
+        - name: app
+`
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if _, err := Inject(input, Options{Mode: ModeLabel, Logger: logger}); err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	logs := buf.String()
+	if !strings.Contains(logs, `msg="ignoring ConfigMap or Secret volume without a name" workload=Deployment/app volume=cfg`) {
+		t.Fatalf("expected a message for the nameless volume, got:\n%s", logs)
+	}
+	if strings.Contains(logs, "volume=creds") {
+		t.Fatalf("expected no message for the named volume, got:\n%s", logs)
+	}
+}
+
+func TestInjectLogsUnnamedKeyRefs(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          env:
+            - name: DB_URL
+              valueFrom:
+                secretKeyRef:
+                  name: ""
+                  key: url
+      ephemeralContainers:
+        - name: debug
+          env:
+            - name: DEBUG
+              valueFrom:
+                configMapKeyRef:
+                  key: debug
+      containers:
+        - name: app
+          env:
+            - name: LOG_LEVEL
+              valueFrom:
+                configMapKeyRef:
+                  name: ""
+                  key: level
+            - name: TOKEN
+              valueFrom:
+                secretKeyRef:
+                  key: token
+            - name: POD_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.name
+            - name: PASSWORD
+              valueFrom:
+                secretKeyRef:
+                  name: app-secret
+                  key: password
+`
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	res, err := Inject(input, Options{Mode: ModeLabel, Logger: logger})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	logs := buf.String()
+	for _, ref := range []unnamedKeyRef{{"migrate", "DB_URL"}, {"app", "LOG_LEVEL"}, {"app", "TOKEN"}, {"debug", "DEBUG"}} {
+		want := `msg="ignoring env var whose key reference has no name" workload=Deployment/app container=` + ref.container + ` env=` + ref.env
+		if !strings.Contains(logs, want) {
+			t.Fatalf("expected a message for %s in %s, got:\n%s", ref.env, ref.container, logs)
+		}
+	}
+	for _, env := range []string{"POD_NAME", "PASSWORD"} {
+		if strings.Contains(logs, "env="+env) {
+			t.Fatalf("expected no message for %s, got:\n%s", env, logs)
+		}
+	}
+	if refs := res.References[0].References; len(refs) != 1 || refs[0].Name != "app-secret" {
+		t.Fatalf("expected only the named reference to be collected, got %+v", refs)
+	}
+}
+
+func TestInjectIgnoresMeshSourcesByDefault(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: istiod-ca-cert
+          configMap:
+            name: istio-ca-root-cert
+      containers:
+        - name: app
+        - name: istio-proxy
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel, Strict: true, RequireAllReferenced: true})
+	if err != nil {
+		t.Fatalf("expected istio-ca-root-cert to be ignored by default, got %v", err)
+	}
+	if refs := res.References[0].References; len(refs) != 1 || !refs[0].Ignored || refs[0].Resolved {
+		t.Fatalf("expected one ignored, unresolved reference, got %+v", refs)
+	}
+
+	_, err = Inject(input, Options{Mode: ModeLabel, Strict: true, IgnoredSources: []string{}})
+	if err == nil || !strings.Contains(err.Error(), `ConfigMap "istio-ca-root-cert" not found`) {
+		t.Fatalf("expected an error with an empty ignore list, got %v", err)
+	}
+
+	withSource := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: istio-ca-root-cert\ndata:\n  root-cert.pem: cert\n---\n" + input
+	res, err = Inject(withSource, Options{Mode: ModeLabel, Strict: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Keys) != 1 || res.Keys[0].Key != "checksum/configmap-istio-ca-root-cert" {
+		t.Fatalf("expected an ignored source in the input to be injected, got %+v", res.Keys)
+	}
+}
+
+// unreferencedBundle returns a manifest with one referenced ConfigMap, one
+// referenced hash-suffixed Secret and n unreferenced ConfigMaps.
+func unreferencedBundle(n int, withUnreferenced bool) string {
+	var b strings.Builder
+	b.WriteString(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret-5h7k2bm9tc
+stringData:
+  TOKEN: abc
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+            - secretRef:
+                name: app-secret
+`)
+	if !withUnreferenced {
+		return b.String()
+	}
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: unused-%d\ndata:\n  payload: %s\n", i, strings.Repeat("x", 1024))
+	}
+	return b.String()
+}
+
+func TestInjectOnlyIfReferenced(t *testing.T) {
+	input := unreferencedBundle(50, true)
+
+	full, err := Inject(input, Options{Mode: ModeLabel, StripNameSuffix: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	res, err := Inject(input, Options{Mode: ModeLabel, StripNameSuffix: true, OnlyIfReferenced: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if res.Output != full.Output {
+		t.Fatalf("expected identical output\nwant:\n%s\ngot:\n%s", full.Output, res.Output)
+	}
+	if len(res.Keys) != 2 {
+		t.Fatalf("expected checksums for both referenced sources, got %+v", res.Keys)
+	}
+
+	// The global digest covers exactly the sources that were hashed.
+	referencedOnly, err := Inject(unreferencedBundle(0, false), Options{Mode: ModeLabel, StripNameSuffix: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if res.GlobalDigest != referencedOnly.GlobalDigest {
+		t.Fatalf("expected unreferenced sources not to be hashed, got digest %s, want %s", res.GlobalDigest, referencedOnly.GlobalDigest)
+	}
+	if full.GlobalDigest == referencedOnly.GlobalDigest {
+		t.Fatalf("expected unreferenced sources to be hashed by default")
+	}
+}
+
+func BenchmarkInjectOnlyIfReferenced(b *testing.B) {
+	input := unreferencedBundle(500, true)
+	for _, only := range []bool{false, true} {
+		b.Run(fmt.Sprintf("only-if-referenced=%v", only), func(b *testing.B) {
+			opts := Options{Mode: ModeLabel, OnlyIfReferenced: only, Workers: 1}
+			for i := 0; i < b.N; i++ {
+				if _, err := Inject(input, opts); err != nil {
+					b.Fatalf("Inject: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectPreciseKeys(t *testing.T) {
+	bundle := func(other string) string {
+		return fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  used: "1"
+  other: %q
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: keyed
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          env:
+            - name: USED
+              valueFrom:
+                configMapKeyRef:
+                  name: app-config
+                  key: used
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: whole
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          env:
+            - name: USED
+              valueFrom:
+                configMapKeyRef:
+                  name: app-config
+                  key: used
+          envFrom:
+            - configMapRef:
+                name: app-config
+`, other)
+	}
+	opts := Options{Mode: ModeLabel, PreciseKeys: true}
+	before, err := Inject(bundle("a"), opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	after, err := Inject(bundle("b"), opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	keyed := before.References[0].References[0]
+	if len(keyed.HashedKeys) != 1 || keyed.HashedKeys[0] != "used" {
+		t.Fatalf("expected only the referenced key to be hashed, got %+v", keyed)
+	}
+	if got := after.References[0].References[0].Checksum; got != keyed.Checksum {
+		t.Fatalf("expected an unreferenced key not to change the checksum, got %s, want %s", got, keyed.Checksum)
+	}
+	for _, ref := range before.References[1].References {
+		if ref.HashedKeys != nil {
+			t.Fatalf("expected a whole-object reference to win over a key reference, got %+v", ref)
+		}
+	}
+	if before.References[1].References[0].Checksum == after.References[1].References[0].Checksum {
+		t.Fatalf("expected a whole-object reference to see every key")
+	}
+
+	plain, err := Inject(bundle("a"), Options{Mode: ModeLabel})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if got := plain.References[0].References[0]; got.HashedKeys != nil || got.Checksum == keyed.Checksum {
+		t.Fatalf("expected whole-object hashing without PreciseKeys, got %+v", got)
+	}
+}
+
+func TestInjectWarnsUnrenderedReferences(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: ${CONFIG_NAME}
+            - secretRef:
+                name: missing-secret
+`
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	_, err := Inject(input, Options{Mode: ModeLabel, Strict: true, Logger: logger})
+	want := "Deployment/app: ConfigMap \"${CONFIG_NAME}\": reference name contains template markers; the input appears unrendered\n" +
+		`Deployment/app: Secret "missing-secret" not found in input`
+	if err == nil || err.Error() != want {
+		t.Fatalf("expected the unrendered reference to be called out, got %v", err)
+	}
+
+	_, err = Inject(input, Options{Mode: ModeLabel, RequireAllReferenced: true})
+	if err == nil || !strings.Contains(err.Error(), "2 of 2 required references have no checksum: ConfigMap ${CONFIG_NAME} (name contains template markers; the input appears unrendered), Secret missing-secret") {
+		t.Fatalf("expected -require-all-referenced to fail on the unrendered reference, got %v", err)
+	}
+
+	if _, err := Inject(input, Options{Mode: ModeLabel, Logger: logger}); err != nil {
+		t.Fatalf("expected unrendered references to only be warned about without -strict, got %v", err)
+	}
+
+	logs := buf.String()
+	if !strings.Contains(logs, `level=WARN msg="reference name contains template markers; the input appears unrendered" workload=Deployment/app kind=ConfigMap name=${CONFIG_NAME}`) {
+		t.Fatalf("expected a warning about the unrendered reference, got:\n%s", logs)
+	}
+	if strings.Contains(logs, "missing-secret") {
+		t.Fatalf("expected no unrendered warning for a plain name, got:\n%s", logs)
+	}
+}
+
+func TestSubPathKeys(t *testing.T) {
+	mount := func(subPath string) corev1.VolumeMount {
+		return corev1.VolumeMount{Name: "config", MountPath: "/etc/app", SubPath: subPath}
+	}
+	items := []corev1.KeyToPath{{Key: "a", Path: "conf/a.yaml"}, {Key: "b", Path: "conf/b.yaml"}, {Key: "c", Path: "c.yaml"}}
+
+	tests := []struct {
+		name   string
+		mounts []corev1.VolumeMount
+		items  []corev1.KeyToPath
+		want   []string
+	}{
+		{name: "whole mount", mounts: []corev1.VolumeMount{mount("")}},
+		{name: "not mounted"},
+		{name: "subPath key", mounts: []corev1.VolumeMount{mount("a")}, want: []string{"a"}},
+		{name: "subPath keys of several mounts", mounts: []corev1.VolumeMount{mount("a"), mount("b")}, want: []string{"a", "b"}},
+		{name: "subPath and whole mount", mounts: []corev1.VolumeMount{mount("a"), mount("")}},
+		{name: "subPathExpr", mounts: []corev1.VolumeMount{{Name: "config", SubPathExpr: "$(POD_NAME)"}}},
+		{name: "nested subPath without items", mounts: []corev1.VolumeMount{mount("conf/a")}},
+		{name: "subPath item", mounts: []corev1.VolumeMount{mount("c.yaml")}, items: items, want: []string{"c"}},
+		{name: "subPath item directory", mounts: []corev1.VolumeMount{mount("conf")}, items: items, want: []string{"a", "b"}},
+		{name: "subPath outside items", mounts: []corev1.VolumeMount{mount("other.yaml")}, items: items, want: []string{"a", "b", "c"}},
+		{name: "whole mount with items", mounts: []corev1.VolumeMount{mount("")}, items: items, want: []string{"a", "b", "c"}},
+		{name: "other volume", mounts: []corev1.VolumeMount{{Name: "data", SubPath: "a"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "app", VolumeMounts: tt.mounts}}}
+			got := subPathKeys(spec, "config", tt.items)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected keys %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestInjectPreciseKeysSubPath(t *testing.T) {
+	bundle := func(used, other string) string {
+		return fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  app.conf: %q
+  other.conf: %q
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      volumes:
+        - name: config
+          configMap:
+            name: app-config
+      containers:
+        - name: app
+          volumeMounts:
+            - name: config
+              mountPath: /etc/app/app.conf
+              subPath: app.conf
+`, used, other)
+	}
+	checksum := func(t *testing.T, input string) ResolvedReference {
+		t.Helper()
+		res, err := Inject(input, Options{Mode: ModeLabel, PreciseKeys: true})
+		if err != nil {
+			t.Fatalf("Inject: %v", err)
+		}
+		refs := res.References[0].References
+		if len(refs) != 1 {
+			t.Fatalf("expected one reference, got %+v", refs)
+		}
+		return refs[0]
+	}
+
+	base := checksum(t, bundle("1", "1"))
+	if !reflect.DeepEqual(base.HashedKeys, []string{"app.conf"}) {
+		t.Fatalf("expected only the subPath key to be hashed, got %v", base.HashedKeys)
+	}
+	if got := checksum(t, bundle("1", "2")); got.Checksum != base.Checksum {
+		t.Fatalf("expected a change to a key that is not mounted to keep the checksum")
+	}
+	if got := checksum(t, bundle("2", "1")); got.Checksum == base.Checksum {
+		t.Fatalf("expected a change to the mounted key to change the checksum")
+	}
+}
@@ -0,0 +1,67 @@
+package injector
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// selfCheck re-decodes the rendered output and verifies that every key in
+// keys is in the Pod template of its workload with the injected value, for
+// Options.SelfCheck. It guards against node manipulation producing output
+// that no longer parses or has lost checksums.
+func selfCheck(output string, keys []InjectedKey, opts Options) error {
+	// Documents passed through under SkipBadDocs have already been
+	// reported; they are raw again here and not checked.
+	decodeOpts := Options{SkipBadDocs: opts.SkipBadDocs}
+	docs, err := decodeDocuments(strings.NewReader(output), decodeOpts, slog.New(slog.DiscardHandler))
+	if err != nil {
+		return fmt.Errorf("self-check: output does not parse: %w", err)
+	}
+	templatePath, err := parsePodTemplatePath(opts.PodTemplatePath)
+	if err != nil {
+		return err
+	}
+
+	type renderedWorkload struct {
+		root *yaml.Node
+		kind workloadKind
+	}
+	workloads := map[WorkloadRef][]renderedWorkload{}
+	for i, doc := range docs {
+		if isRawDocument(doc) {
+			continue
+		}
+		var obj map[string]interface{}
+		if err := decodeDocument(doc, &obj); err != nil {
+			return fmt.Errorf("self-check: output document %d does not decode: %w", i+1, err)
+		}
+		root := documentRoot(doc)
+		kind := getKind(doc)
+		wk, ok := lookupWorkloadKind(scalarAt(root, "apiVersion"), kind)
+		if !ok {
+			wk, ok = genericWorkloadKind(doc, kind, templatePath)
+		}
+		if !ok {
+			continue
+		}
+		ref := WorkloadRef{Kind: wk.kind, Namespace: opts.namespace(scalarAt(root, "metadata", "namespace")), Name: scalarAt(root, "metadata", "name")}
+		workloads[ref] = append(workloads[ref], renderedWorkload{root: root, kind: wk})
+	}
+
+	for _, k := range keys {
+		found := false
+		for _, w := range workloads[k.Workload] {
+			if m := findMap(w.root, w.kind.metadataPath(k.Field)...); m != nil && hasKey(m, k.Key) && scalarAt(m, k.Key) == k.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("self-check: %s: %s %s is not %q in the output", k.Workload, k.Field, k.Key, k.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package injector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelfCheck(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+	opts := Options{Mode: ModeAnnotation, SelfCheck: true}
+	res, err := Inject(input, opts)
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	if len(res.Keys) != 1 {
+		t.Fatalf("expected 1 injected key, got %+v", res.Keys)
+	}
+	key := res.Keys[0]
+
+	tests := []struct {
+		name    string
+		corrupt func(string) string
+		wantErr string
+	}{
+		{
+			name:    "intact",
+			corrupt: func(s string) string { return s },
+		},
+		{
+			name:    "unparsable",
+			corrupt: func(s string) string { return s + "  broken: [\n" },
+			wantErr: "self-check: output does not parse",
+		},
+		{
+			name:    "dropped key",
+			corrupt: func(s string) string { return strings.Replace(s, key.Key+": ", "example.com/other: ", 1) },
+			wantErr: `self-check: Deployment/prod/app: annotations checksum/configmap-app-config is not "` + key.Value + `" in the output`,
+		},
+		{
+			name:    "wrong value",
+			corrupt: func(s string) string { return strings.Replace(s, key.Value, "000000000000", 1) },
+			wantErr: "self-check: Deployment/prod/app: annotations checksum/configmap-app-config",
+		},
+		{
+			name:    "moved to labels",
+			corrupt: func(s string) string { return strings.Replace(s, "annotations:", "labels:", 1) },
+			wantErr: "self-check: Deployment/prod/app: annotations checksum/configmap-app-config",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := selfCheck(tt.corrupt(res.Output), res.Keys, opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected the output to pass, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
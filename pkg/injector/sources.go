@@ -0,0 +1,89 @@
+package injector
+
+// sourceID identifies a ConfigMap or Secret by namespace and name.
+type sourceID struct {
+	namespace, name string
+}
+
+// sourceHashes maps the sources of one kind to the checksums references to
+// them resolve to.
+type sourceHashes struct {
+	sums map[sourceID]string
+	// latest maps each name to the last source recorded under it in any
+	// namespace, for workloads without a namespace.
+	latest map[string]sourceID
+}
+
+func newSourceHashes() sourceHashes {
+	return sourceHashes{sums: map[sourceID]string{}, latest: map[string]sourceID{}}
+}
+
+// nameHashes returns hashes keyed by name alone, as sources without a
+// namespace, so they resolve references from any namespace.
+func nameHashes(m map[string]string) sourceHashes {
+	h := newSourceHashes()
+	for name, sum := range m {
+		h.set("", name, sum)
+	}
+	return h
+}
+
+// set records the checksum of the source called name in namespace. Later
+// sources replace earlier ones of the same namespace and name.
+func (h sourceHashes) set(namespace, name, sum string) {
+	id := sourceID{namespace, name}
+	h.sums[id] = sum
+	h.latest[name] = id
+}
+
+// override records sum for every reference to name, whatever the
+// namespace, replacing the sources of that name.
+func (h sourceHashes) override(name, sum string) {
+	for id := range h.sums {
+		if id.name == name {
+			delete(h.sums, id)
+		}
+	}
+	h.set("", name, sum)
+}
+
+// resolve returns the source a reference to name from a workload in
+// namespace resolves to and its checksum: the source of that namespace, or
+// else one without a namespace, which is applied alongside the workload.
+// A workload without a namespace is applied wherever it is sent, so it
+// resolves to the last source of that name in any namespace.
+func (h sourceHashes) resolve(namespace, name string) (sourceID, string, bool) {
+	id := sourceID{namespace, name}
+	if sum, ok := h.sums[id]; ok {
+		return id, sum, true
+	}
+	if namespace == "" {
+		id, ok := h.latest[name]
+		if !ok {
+			return sourceID{}, "", false
+		}
+		sum, ok := h.sums[id]
+		return id, sum, ok
+	}
+	id = sourceID{"", name}
+	sum, ok := h.sums[id]
+	return id, sum, ok
+}
+
+// addSuffixAlias makes the source id also resolve under its name without a
+// kustomize-style hash suffix, unless a source of that namespace already
+// uses that name.
+func (h sourceHashes) addSuffixAlias(id sourceID) {
+	base := stripNameSuffix(id.name)
+	if base == id.name || base == "" {
+		return
+	}
+	alias := sourceID{id.namespace, base}
+	if _, exists := h.sums[alias]; exists {
+		return
+	}
+	h.sums[alias] = h.sums[id]
+	if _, exists := h.latest[base]; !exists {
+		h.latest[base] = alias
+	}
+}
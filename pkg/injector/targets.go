@@ -0,0 +1,165 @@
+package injector
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Target is one place checksums are written to: the Pod template labels or
+// annotations, with keys under Prefix.
+type Target struct {
+	Mode   Mode
+	Prefix string
+}
+
+// ParseTarget parses a target specification of comma separated key=value
+// pairs, e.g. "target=annotation,prefix=example.com/". The target key is
+// required; prefix defaults to "checksum/" and must end with "/".
+func ParseTarget(spec string) (Target, error) {
+	t := Target{Prefix: checksumKeyPrefix}
+	for _, field := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return Target{}, fmt.Errorf("invalid target %q: expected key=value, got %q", spec, field)
+		}
+		switch strings.TrimSpace(k) {
+		case "target":
+			t.Mode = Mode(strings.TrimSpace(v))
+		case "prefix":
+			t.Prefix = strings.TrimSpace(v)
+		default:
+			return Target{}, fmt.Errorf("invalid target %q: unknown key %q", spec, k)
+		}
+	}
+	if t.Mode == "" {
+		return Target{}, fmt.Errorf("invalid target %q: missing target=label|annotation", spec)
+	}
+	return t, validateTarget(t)
+}
+
+func validateTarget(t Target) error {
+	if t.Mode != ModeLabel && t.Mode != ModeAnnotation {
+		return fmt.Errorf("invalid mode: %s (must be 'label' or 'annotation')", t.Mode)
+	}
+	if t.Prefix == "" {
+		return fmt.Errorf("invalid target: prefix must not be empty")
+	}
+	// Prune removes every key starting with the prefix, so it must end a
+	// key's prefix segment; "app" would also match "app.kubernetes.io/name".
+	if !strings.HasSuffix(t.Prefix, "/") {
+		return fmt.Errorf("invalid target: prefix %q must end with '/'", t.Prefix)
+	}
+	return nil
+}
+
+// targets returns the configured targets, falling back to Mode with the
+// default prefix.
+func (o Options) targets() []Target {
+	if len(o.Targets) > 0 {
+		return o.Targets
+	}
+	return []Target{{Mode: o.Mode, Prefix: checksumKeyPrefix}}
+}
+
+// Default infixes that tell ConfigMap and Secret keys apart.
+const (
+	defaultConfigMapInfix = "configmap-"
+	defaultSecretInfix    = "secret-"
+)
+
+// infixes returns the ConfigMap and Secret key infixes, falling back to the
+// defaults.
+func (o Options) infixes() (configMap, secret string) {
+	configMap, secret = o.ConfigMapInfix, o.SecretInfix
+	if configMap == "" {
+		configMap = defaultConfigMapInfix
+	}
+	if secret == "" {
+		secret = defaultSecretInfix
+	}
+	return configMap, secret
+}
+
+// validateInfixes checks that keys built from the infixes can be legal
+// label and annotation names and cannot collide between kinds.
+func validateInfixes(o Options) error {
+	configMap, secret := o.infixes()
+	if configMap == secret {
+		return fmt.Errorf("invalid infixes: ConfigMap and Secret infix must differ, both are %q", configMap)
+	}
+	if infixesOverlap(configMap, secret) {
+		return fmt.Errorf("invalid infixes: ConfigMap infix %q and Secret infix %q overlap, so keys of the two kinds could collide", configMap, secret)
+	}
+	for _, infix := range []struct{ kind, value string }{{KindConfigMap, configMap}, {KindSecret, secret}} {
+		// The infix starts the name segment of the key, so it must be a
+		// legal name start when followed by an object name.
+		if strings.Contains(infix.value, "/") {
+			return fmt.Errorf("invalid %s infix %q: must not contain '/'", infix.kind, infix.value)
+		}
+		if problems := validation.IsQualifiedName(infix.value + "x"); len(problems) > 0 {
+			return fmt.Errorf("invalid %s infix %q: %s", infix.kind, infix.value, strings.Join(problems, "; "))
+		}
+	}
+	return nil
+}
+
+// infixesOverlap reports whether keys built from the infixes a and b can
+// be mistaken for each other: one is a prefix of the other (so "cm" + "x-app"
+// and "cmx-" + "app" are the same key), or the segments of one, split at
+// '-', '.' and '_', appear in order within the other's (as in "cm-" and
+// "app.cm-").
+func infixesOverlap(a, b string) bool {
+	if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+		return true
+	}
+	as, bs := infixSegments(a), infixSegments(b)
+	if len(as) > len(bs) {
+		as, bs = bs, as
+	}
+	if len(as) == 0 {
+		return false
+	}
+	for i := 0; i+len(as) <= len(bs); i++ {
+		if slices.Equal(as, bs[i:i+len(as)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// infixSegments splits an infix at its separators, dropping empty segments.
+func infixSegments(infix string) []string {
+	return strings.FieldsFunc(infix, func(r rune) bool {
+		return r == '-' || r == '.' || r == '_'
+	})
+}
+
+// hashLength returns the number of hex characters kept per checksum.
+func (o Options) hashLength() int {
+	if o.HashLength == 0 {
+		return digestLength
+	}
+	return o.HashLength
+}
+
+// validateHashLength checks that checksums of the configured length can be
+// written to every target. Label values are limited to 63 characters.
+func validateHashLength(o Options) error {
+	n := o.hashLength()
+	if n < 1 || n > 2*sha256.Size {
+		return fmt.Errorf("invalid hash length %d: must be between 1 and %d", n, 2*sha256.Size)
+	}
+	for _, t := range o.targets() {
+		if t.Mode != ModeLabel {
+			continue
+		}
+		if problems := validation.IsValidLabelValue(strings.Repeat("f", n)); len(problems) > 0 {
+			return fmt.Errorf("invalid hash length %d: checksums for label target %q would not be legal label values: %s", n, t.Prefix, strings.Join(problems, "; "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package injector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    Target
+		wantErr bool
+	}{
+		{spec: "target=label", want: Target{Mode: ModeLabel, Prefix: "checksum/"}},
+		{spec: "target=annotation,prefix=example.com/", want: Target{Mode: ModeAnnotation, Prefix: "example.com/"}},
+		{spec: "prefix=foo/, target=label", want: Target{Mode: ModeLabel, Prefix: "foo/"}},
+		{spec: "prefix=foo/", wantErr: true},
+		{spec: "target=both", wantErr: true},
+		{spec: "target=label,prefix=", wantErr: true},
+		{spec: "target=label,prefix=app", wantErr: true},
+		{spec: "target=annotation,prefix=example.com", wantErr: true},
+		{spec: "target=label,color=blue", wantErr: true},
+		{spec: "label", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		got, err := ParseTarget(tc.spec)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("ParseTarget(%q): expected error, got %+v", tc.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ParseTarget(%q): %v", tc.spec, err)
+		}
+		if got != tc.want {
+			t.Fatalf("ParseTarget(%q) mismatch\nwant: %+v\ngot:  %+v", tc.spec, tc.want, got)
+		}
+	}
+}
+
+func TestInjectMultipleTargets(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        app: demo
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app-config
+`
+
+	res, err := Inject(input, Options{Targets: []Target{
+		{Mode: ModeLabel, Prefix: "select.example.com/"},
+		{Mode: ModeAnnotation, Prefix: "controller.example.com/"},
+	}})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	tmpl := decodeDeployments(t, res.Output)[0].Spec.Template
+	cm := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  LOG_LEVEL: info
+`
+	sum := decodeSingleConfigMapHash(t, cm)
+
+	wantLabels := map[string]string{"app": "demo", "select.example.com/configmap-app-config": sum}
+	if !reflect.DeepEqual(tmpl.Labels, wantLabels) {
+		t.Fatalf("labels mismatch\nwant: %v\ngot:  %v", wantLabels, tmpl.Labels)
+	}
+	wantAnnotations := map[string]string{"controller.example.com/configmap-app-config": sum}
+	if !reflect.DeepEqual(tmpl.Annotations, wantAnnotations) {
+		t.Fatalf("annotations mismatch\nwant: %v\ngot:  %v", wantAnnotations, tmpl.Annotations)
+	}
+
+	if _, err := Inject(input, Options{Targets: []Target{{Mode: "both", Prefix: "x/"}}}); err == nil {
+		t.Fatalf("expected invalid target mode to be rejected")
+	}
+}
+
+func TestInjectPruneKeepsKeysSharingPrefixText(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        app: demo
+        app.kubernetes.io/name: demo
+        app/configmap-stale: 0123456789ab
+    spec:
+      containers:
+        - name: app
+`
+
+	if _, err := Inject(input, Options{Targets: []Target{{Mode: ModeLabel, Prefix: "app"}}, Prune: true}); err == nil || !strings.Contains(err.Error(), "must end with '/'") {
+		t.Fatalf("expected a prefix without a trailing '/' to be rejected, got %v", err)
+	}
+
+	res, err := Inject(input, Options{Targets: []Target{{Mode: ModeLabel, Prefix: "app/"}}, Prune: true})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	want := map[string]string{"app": "demo", "app.kubernetes.io/name": "demo"}
+	if got := decodeDeployments(t, res.Output)[0].Spec.Template.Labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected only keys under app/ to be pruned\nwant: %v\ngot:  %v", want, got)
+	}
+}
+
+func TestInjectCustomInfixes(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  LOG_LEVEL: info
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+data:
+  TOKEN: QVBJX1RPS0VO
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app
+            - secretRef:
+                name: app
+`
+
+	res, err := Inject(input, Options{Mode: ModeLabel, ConfigMapInfix: "cm_", SecretInfix: "secret."})
+	if err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	var keys []string
+	for _, k := range res.Keys {
+		if err := k.Validate(); err != nil {
+			t.Fatalf("expected a legal key: %v", err)
+		}
+		keys = append(keys, k.Key)
+	}
+	if want := []string{"checksum/cm_app", "checksum/secret.app"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys mismatch\nwant: %v\ngot:  %v", want, keys)
+	}
+
+	for _, opts := range []Options{
+		{Mode: ModeLabel, ConfigMapInfix: "-cm-"},
+		{Mode: ModeLabel, SecretInfix: "secret/"},
+		{Mode: ModeLabel, ConfigMapInfix: "x-", SecretInfix: "x-"},
+		{Mode: ModeLabel, ConfigMapInfix: "cm", SecretInfix: "cmx-"},
+		{Mode: ModeLabel, ConfigMapInfix: "cm-", SecretInfix: "cm-secret-"},
+		{Mode: ModeLabel, ConfigMapInfix: "cm-", SecretInfix: "app.cm-"},
+		{Mode: ModeLabel, ConfigMapInfix: "cm_", SecretInfix: "x.cm-"},
+	} {
+		if _, err := Inject(input, opts); err == nil || !strings.Contains(err.Error(), "infix") {
+			t.Fatalf("expected an infix error for %+v, got %v", opts, err)
+		}
+	}
+}
+
+func TestInfixesOverlap(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"configmap-", "secret-", false},
+		{"cm_", "secret.", false},
+		{"cm-", "cms-", false},
+		{"cm-", "cm.", true},
+		{"cm", "cmx-", true},
+		{"cm-", "cm-secret-", true},
+		{"cm-", "app.cm-", true},
+		{"app-cm-", "cm_", true},
+		{"a-b-", "b-a-", false},
+	}
+	for _, tc := range cases {
+		if got := infixesOverlap(tc.a, tc.b); got != tc.want {
+			t.Fatalf("infixesOverlap(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+		if got := infixesOverlap(tc.b, tc.a); got != tc.want {
+			t.Fatalf("infixesOverlap(%q, %q) = %v, want %v", tc.b, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestInjectHashLength(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  LOG_LEVEL: info
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          envFrom:
+            - configMapRef:
+                name: app
+`
+
+	tests := []struct {
+		opts    Options
+		wantLen int
+		wantErr string
+	}{
+		{opts: Options{Mode: ModeLabel}, wantLen: 12},
+		{opts: Options{Mode: ModeLabel, HashLength: 63}, wantLen: 63},
+		{opts: Options{Mode: ModeAnnotation, HashLength: 64}, wantLen: 64},
+		{opts: Options{Mode: ModeLabel, HashLength: 64}, wantErr: `checksums for label target "checksum/" would not be legal label values`},
+		{opts: Options{Targets: []Target{{Mode: ModeAnnotation, Prefix: "a/"}, {Mode: ModeLabel, Prefix: "l/"}}, HashLength: 64}, wantErr: `label target "l/"`},
+		{opts: Options{Mode: ModeAnnotation, HashLength: 65}, wantErr: "must be between 1 and 64"},
+		{opts: Options{Mode: ModeAnnotation, HashLength: -1}, wantErr: "must be between 1 and 64"},
+	}
+	for _, tt := range tests {
+		res, err := Inject(input, tt.opts)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("%+v: expected an error containing %q, got %v", tt.opts, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: Inject: %v", tt.opts, err)
+		}
+		if got := len(res.Keys[0].Value); got != tt.wantLen {
+			t.Fatalf("%+v: expected a %d character checksum, got %q", tt.opts, tt.wantLen, res.Keys[0].Value)
+		}
+		if err := res.Keys[0].Validate(); err != nil {
+			t.Fatalf("%+v: expected a legal checksum: %v", tt.opts, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package injector
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// InjectIntoDeployment writes checksums for the Deployment's references
+// directly into the labels or annotations of its Pod template, without a
+// YAML round trip. cmHashes and secretHashes map object names to the
+// checksums to inject, as computed for the manifests passed to Inject; they
+// resolve references whatever the Deployment's namespace. It
+// honours the targets, ExtraAnnotations, Prune and StripNameSuffix settings
+// of opts and reports whether the Pod template changed. References whose
+// KeyTemplate renders an illegal or duplicate key are skipped, and an
+// invalid KeyTemplate injects nothing.
+func InjectIntoDeployment(dep *appsv1.Deployment, cmHashes, secretHashes map[string]string, opts Options) bool {
+	templates, err := parseKeyTemplates(opts)
+	if err != nil {
+		return false
+	}
+	updates, _, _ := resolveChecksums(&dep.Spec.Template.Spec, opts.namespace(dep.Namespace), nameHashes(cmHashes), nameHashes(secretHashes), nil, templates.key, opts)
+	meta := &dep.Spec.Template.ObjectMeta
+
+	targets := opts.targets()
+	changed := false
+	keep := map[string]bool{}
+	for _, t := range targets {
+		if len(updates) == 0 {
+			break
+		}
+		m := &meta.Labels
+		if t.Mode == ModeAnnotation {
+			m = &meta.Annotations
+		}
+		if *m == nil {
+			*m = map[string]string{}
+		}
+		field := metadataField(t.Mode)
+		for _, update := range updates {
+			key := update.keyFor(t.Prefix)
+			keep[field+"/"+key] = true
+			if old, ok := (*m)[key]; !ok || old != update.value {
+				(*m)[key] = update.value
+				changed = true
+			}
+		}
+	}
+
+	for _, field := range opts.extraFields() {
+		m := &meta.Labels
+		if field == "annotations" {
+			m = &meta.Annotations
+		}
+		if *m == nil {
+			*m = map[string]string{}
+		}
+		for key, value := range opts.ExtraAnnotations {
+			keep[field+"/"+key] = true
+			if old, ok := (*m)[key]; !ok || old != value {
+				(*m)[key] = value
+				changed = true
+			}
+		}
+	}
+
+	if opts.Prune {
+		prefixes := prunePrefixes(targets)
+		for field, m := range map[string]map[string]string{"labels": meta.Labels, "annotations": meta.Annotations} {
+			for key := range m {
+				if hasAnyPrefix(key, prefixes) && !keep[field+"/"+key] {
+					delete(m, key)
+					changed = true
+				}
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,60 @@
+package injector
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestInjectIntoDeployment(t *testing.T) {
+	dep := &appsv1.Deployment{}
+	dep.Name = "app"
+	dep.Spec.Template.Labels = map[string]string{"app": "demo"}
+	dep.Spec.Template.Spec = corev1.PodSpec{
+		Volumes: []corev1.Volume{{
+			Name:         "cfg",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app.config"}}},
+		}},
+		Containers: []corev1.Container{{
+			Name: "app",
+			EnvFrom: []corev1.EnvFromSource{
+				{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-secret"}}},
+				{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "absent"}}},
+			},
+		}},
+	}
+	cmHashes := map[string]string{"app.config": "aaaaaaaaaaaa"}
+	secretHashes := map[string]string{"app-secret": "bbbbbbbbbbbb"}
+
+	if !InjectIntoDeployment(dep, cmHashes, secretHashes, Options{Mode: ModeLabel}) {
+		t.Fatalf("expected the first injection to report a change")
+	}
+	wantLabels := map[string]string{
+		"app":                           "demo",
+		"checksum/configmap-app-config": "aaaaaaaaaaaa",
+		"checksum/secret-app-secret":    "bbbbbbbbbbbb",
+	}
+	if !reflect.DeepEqual(dep.Spec.Template.Labels, wantLabels) {
+		t.Fatalf("labels mismatch\nwant: %v\ngot:  %v", wantLabels, dep.Spec.Template.Labels)
+	}
+	if dep.Spec.Template.Annotations != nil {
+		t.Fatalf("expected annotations to stay nil, got %v", dep.Spec.Template.Annotations)
+	}
+
+	if InjectIntoDeployment(dep, cmHashes, secretHashes, Options{Mode: ModeLabel}) {
+		t.Fatalf("expected a repeated injection to be a no-op")
+	}
+
+	delete(secretHashes, "app-secret")
+	if !InjectIntoDeployment(dep, cmHashes, secretHashes, Options{Mode: ModeAnnotation, Prune: true}) {
+		t.Fatalf("expected moving to annotations to report a change")
+	}
+	if want := map[string]string{"app": "demo"}; !reflect.DeepEqual(dep.Spec.Template.Labels, want) {
+		t.Fatalf("expected Prune to remove checksum labels, got %v", dep.Spec.Template.Labels)
+	}
+	if want := map[string]string{"checksum/configmap-app-config": "aaaaaaaaaaaa"}; !reflect.DeepEqual(dep.Spec.Template.Annotations, want) {
+		t.Fatalf("annotations mismatch\nwant: %v\ngot:  %v", want, dep.Spec.Template.Annotations)
+	}
+}
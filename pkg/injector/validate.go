@@ -0,0 +1,22 @@
+package injector
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Validate checks the key against the Kubernetes rules for label and
+// annotation keys, and a label's value against the rules for label values.
+// The API server rejects objects that break either.
+func (k InjectedKey) Validate() error {
+	problems := validation.IsQualifiedName(k.Key)
+	if k.Field == "labels" {
+		problems = append(problems, validation.IsValidLabelValue(k.Value)...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: invalid %s key %q: %s", k.Workload, strings.TrimSuffix(k.Field, "s"), k.Key, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package injector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInjectedKeyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     InjectedKey
+		wantErr string
+	}{
+		{
+			name: "valid label",
+			key:  InjectedKey{Field: "labels", Key: "checksum/configmap-app-config", Value: "0123456789ab"},
+		},
+		{
+			name:    "trailing dash",
+			key:     InjectedKey{Field: "annotations", Key: "checksum/configmap-app-config-", Value: "0123456789ab"},
+			wantErr: `invalid annotation key "checksum/configmap-app-config-"`,
+		},
+		{
+			name:    "invalid prefix",
+			key:     InjectedKey{Field: "labels", Key: "Checksums!/configmap-app", Value: "0123456789ab"},
+			wantErr: "prefix part",
+		},
+		{
+			name:    "invalid label value",
+			key:     InjectedKey{Field: "labels", Key: "checksum/configmap-app", Value: "not a value"},
+			wantErr: `invalid label key "checksum/configmap-app"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.key.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}